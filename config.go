@@ -10,11 +10,90 @@ import (
 	"os"
 )
 
+// AWS info used for S3 upload
+type S3Target struct {
+	AWSRegion      string `json:"aws_region,omitempty"`
+	AWSAccessKeyID string `json:"aws_access_key_id,omitempty"`
+	AWSAccessKey   string `json:"aws_access_key,omitempty"`
+	AWSBucket      string `json:"aws_bucket,omitempty"`
+}
+
 // A monitored host and all data needed for it
 type MonitoredHost struct {
 	Disabled bool   `json:"disabled,omitempty"`
 	Name     string `json:"name,omitempty"`
 	Addr     string `json:"address,omitempty"`
+
+	// Pending events per active handler on any of this host's instances above which we warn,
+	// overriding the global threshold because normal backlogs differ greatly between hosts
+	PendingEventsPerHandlerWarning int64 `json:"pending_events_per_handler_warning,omitempty"`
+
+	// Additional query parameters merged into each ping of this host, such as for diagnostics
+	PingParams map[string]string `json:"ping_params,omitempty"`
+
+	// Paths of the client certificate and key presented to this host, for hosts requiring mutual
+	// TLS, and of the CA certificates by which the host's certificate is verified if not the system's
+	TLSClientCert string `json:"tls_client_cert,omitempty"`
+	TLSClientKey  string `json:"tls_client_key,omitempty"`
+	TLSCA         string `json:"tls_ca,omitempty"`
+
+	// S3 target for this host's archives, overriding the global AWS info where specified
+	S3Target
+}
+
+// Canary thresholds for a class of devices, selected by serial number prefix.  Any
+// thresholds left unspecified take on the built-in value for that class of device.
+// MinSequenceSamples is the number of consecutive events that must be observed within
+// a session before gaps in the sequence number are alerted.  Mode is "continuous" or "periodic",
+// and if unspecified is determined by why the device's session was opened.
+type CanaryRule struct {
+	SNPrefix               string `json:"sn_prefix,omitempty"`
+	SecsCapturedToReceived int64  `json:"secs_captured_to_received,omitempty"`
+	MsReceivedToRouted     int64  `json:"ms_received_to_routed,omitempty"`
+	SecsReceivedToReceived int64  `json:"secs_received_to_received,omitempty"`
+	SecsSilence            int64  `json:"secs_silence,omitempty"`
+	MinSequenceSamples     int64  `json:"min_sequence_samples,omitempty"`
+	Mode                   string `json:"mode,omitempty"`
+}
+
+// A daily window of time, in UTC, during which expected backlogs (such as from scheduled bulk
+// operations) are sent as routine messages rather than as alerts.  Begin and End are "HH:MM", and
+// the window may span midnight.  If Days (such as "sat" or "sun") are specified, the window
+// applies only on the days it begins.
+type SuppressionWindow struct {
+	Begin  string   `json:"begin,omitempty"`
+	End    string   `json:"end,omitempty"`
+	Days   []string `json:"days,omitempty"`
+	Reason string   `json:"reason,omitempty"`
+}
+
+// Quiet hours, during which non-critical Slack notifications sent via the webhook (or via any
+// webhook if unspecified) are held and then sent as a single digest once the quiet hours end
+type QuietHours struct {
+	SuppressionWindow
+	WebhookURL string `json:"webhook_url,omitempty"`
+}
+
+// Alert thresholds for a metric, compared using Operator (">", ">=", "<", or "<=") against each
+// newly-added aggregated bucket.  Once breached, an alert only resolves after the metric has been
+// back within the threshold for ClearBuckets consecutive buckets (by default, 1).
+type MetricThreshold struct {
+	Operator     string   `json:"operator,omitempty"`
+	Warning      *float64 `json:"warning,omitempty"`
+	Critical     *float64 `json:"critical,omitempty"`
+	ClearBuckets int      `json:"clear_buckets,omitempty"`
+}
+
+// A synthetic probe, whose Payload is POSTed to URL along with any Headers every IntervalSecs
+// (60 if unspecified), alerting if it fails or takes longer than SLAMs (2000 if unspecified)
+type Probe struct {
+	Disabled     bool              `json:"disabled,omitempty"`
+	Name         string            `json:"name,omitempty"`
+	URL          string            `json:"url,omitempty"`
+	Headers      map[string]string `json:"headers,omitempty"`
+	Payload      json.RawMessage   `json:"payload,omitempty"`
+	IntervalSecs int               `json:"interval_secs,omitempty"`
+	SLAMs        int64             `json:"sla_ms,omitempty"`
 }
 
 // ServiceConfig is the service configuration file format
@@ -23,6 +102,35 @@ type ServiceConfig struct {
 	// Canary disabled/enabled
 	CanaryDisabled bool `json:"canary_disabled,omitempty"`
 
+	// Canary events per second above which requests are rejected (50 if unspecified, negative to disable)
+	CanaryRateLimit int `json:"canary_rate_limit,omitempty"`
+
+	// Replace DeviceUIDs in canary alerts sent to Slack with a hash, such as for shared channels,
+	// leaving them intact in our logs and in DataDog tags
+	CanaryAnonymizeDevices bool `json:"canary_anonymize_devices,omitempty"`
+
+	// Canary thresholds by class of device
+	CanaryRules []CanaryRule `json:"canary_rules,omitempty"`
+
+	// Tags of canary devices, by DeviceUID or serial number, along with the tags whose alerts are
+	// suppressed and the Slack webhooks to which alerts for a tag are routed
+	CanaryDeviceTags     map[string][]string `json:"canary_device_tags,omitempty"`
+	CanaryTagsSuppressed []string            `json:"canary_tags_suppressed,omitempty"`
+	CanaryTagWebhooks    map[string]string   `json:"canary_tag_webhooks,omitempty"`
+
+	// Synthetic probes of request/response timing
+	Probes []Probe `json:"probes,omitempty"`
+
+	// Quiet hours for non-critical Slack notifications
+	QuietHours []QuietHours `json:"quiet_hours,omitempty"`
+
+	// Windows during which backlog alerts, and threshold alerts on events metrics, are downgraded
+	// to informational
+	SuppressionWindows []SuppressionWindow `json:"suppression_windows,omitempty"`
+
+	// Directory for generated sheets, stats, and queued uploads, defaulting to ~/data
+	DataDirectory string `json:"data_directory,omitempty"`
+
 	// Host URL
 	HostURL string `json:"host_url,omitempty"`
 
@@ -47,30 +155,210 @@ type ServiceConfig struct {
 	// Slack app integration
 	SlackWebhookURL string `json:"slack_webhook_url,omitempty"`
 
+	// Webhook used when the primary Slack webhook fails
+	SlackStandbyWebhookURL string `json:"slack_standby_webhook_url,omitempty"`
+
+	// How loudly each event's notification mentions the channel: "none", "here", or "channel" (the
+	// default), by event: restart, handlers_changed, instance_drop, crash_loop, or fatal_spread.
+	// This doesn't affect whether the notification is held during quiet hours.
+	SlackMentions map[string]string `json:"slack_mentions,omitempty"`
+
+	// Slack user IDs and channel IDs permitted to run state-changing commands, such as sending
+	// requests to instances (anyone may run them if neither is specified)
+	SlackAllowedUsers    []string `json:"slack_allowed_users,omitempty"`
+	SlackAllowedChannels []string `json:"slack_allowed_channels,omitempty"`
+
+	// S3 disabled/enabled, such as for deployments that only keep stats locally
+	S3Disabled bool `json:"s3_disabled,omitempty"`
+
 	// AWS info used for S3 upload
 	AWSRegion      string `json:"aws_region,omitempty"`
 	AWSAccessKeyID string `json:"aws_access_key_id,omitempty"`
 	AWSAccessKey   string `json:"aws_access_key,omitempty"`
 	AWSBucket      string `json:"aws_bucket,omitempty"`
 
+	// Bearer token required by the on-demand archive endpoint, which is disabled if unspecified
+	ArchiveToken string `json:"archive_token,omitempty"`
+
+	// Days to keep local stats files for prior service versions (30 if unspecified)
+	StatsRetentionDays int `json:"stats_retention_days,omitempty"`
+
+	// Daily digest of the prior day's stats posted to Slack, and the UTC hour after which it's posted
+	DigestEnabled bool `json:"digest_enabled,omitempty"`
+	DigestHourUTC int  `json:"digest_hour_utc,omitempty"`
+
+	// Monthly rollup of daily S3 archives, and whether the dailies are deleted once rolled up
+	S3RollupMonthly       bool `json:"s3_rollup_monthly,omitempty"`
+	S3RollupDeleteDailies bool `json:"s3_rollup_delete_dailies,omitempty"`
+
+	// Days after which daily and monthly archives are deleted from S3 (never if unspecified)
+	S3RetentionDays int `json:"s3_retention_days,omitempty"`
+
+	// Minimum acceptable hit rate percentage, by cache name
+	CacheHitRateFloors map[string]float64 `json:"cache_hit_rate_floors,omitempty"`
+
+	// Alert thresholds by metric, named as uploaded to DataDog (such as disk.reads or cache.device.hitrate)
+	MetricThresholds map[string]MetricThreshold `json:"metric_thresholds,omitempty"`
+
+	// Ratio of an instance's discovery handlers to the mean across instances above which we warn
+	DiscoveryImbalanceRatio float64 `json:"discovery_imbalance_ratio,omitempty"`
+
+	// Number of service version changes within the window (in minutes) at which a host is
+	// considered to be crash-looping (3 within 30 if unspecified)
+	RestartLoopCount      int `json:"restart_loop_count,omitempty"`
+	RestartLoopWindowMins int `json:"restart_loop_window_mins,omitempty"`
+
+	// Fraction of a host's instances that, if lost between consecutive polls, is escalated
+	// as a sharp drop (0.25 if unspecified)
+	InstanceDropFraction float64 `json:"instance_drop_fraction,omitempty"`
+
+	// Number of recent pings of each instance over which its ping error rate is computed (20 if
+	// unspecified), and the rate above which we warn if its siblings are healthy (0.2 if unspecified)
+	PingErrorWindow int     `json:"ping_error_window,omitempty"`
+	PingErrorRate   float64 `json:"ping_error_rate,omitempty"`
+
+	// Age in minutes of a host's newest stats above which we warn (120 if unspecified)
+	StatsStaleMins int `json:"stats_stale_mins,omitempty"`
+
+	// Number of standard deviations above the mean of an instance's recent disk writes at which
+	// a bucket is considered a spike (disabled if unspecified), and the number of recent buckets
+	// forming that baseline (24 if unspecified).  A spike must also be at least the minimum MiB above
+	// the mean (16 if unspecified), so that a steady baseline with little deviation isn't alerted
+	// upon for a trivial increase.
+	DiskWriteSpikeStddevs float64 `json:"disk_write_spike_stddevs,omitempty"`
+	DiskWriteSpikeWindow  int     `json:"disk_write_spike_window,omitempty"`
+	DiskWriteSpikeMinMiB  float64 `json:"disk_write_spike_min_mib,omitempty"`
+
+	// Maximum random delay in seconds before each host's poll and added to each polling loop's wake
+	// time, so that requests are spread out rather than synchronized (10 if unspecified, negative to disable)
+	PollJitterSecs int `json:"poll_jitter_secs,omitempty"`
+
+	// Pending events per active handler on an instance above which we warn, for hosts that don't
+	// specify their own threshold (disabled if unspecified)
+	PendingEventsPerHandlerWarning int64 `json:"pending_events_per_handler_warning,omitempty"`
+
+	// Fraction of a host's instances that, if all reporting the same fatal within a bucket, is
+	// escalated as an incident rather than logged as an isolated occurrence (0.5 if unspecified)
+	FatalSpreadFraction float64 `json:"fatal_spread_fraction,omitempty"`
+
+	// Fraction of an instance's memory below which its free memory is considered low (0.1 if
+	// unspecified), and the number of consecutive buckets for which it must be low before we warn
+	// (3 if unspecified)
+	MemoryFreeFraction float64 `json:"memory_free_fraction,omitempty"`
+	MemoryLowBuckets   int     `json:"memory_low_buckets,omitempty"`
+
+	// Minutes for which instances may report a service version other than their host's, as they do
+	// during a rolling deploy, before we alert (30 if unspecified, negative to never alert)
+	VersionMismatchAlertMins int `json:"version_mismatch_alert_mins,omitempty"`
+
+	// Size in minutes of the stats buckets that hosts are expected to report, warning when a host's
+	// differs (not checked if unspecified)
+	ExpectedBucketMins int `json:"expected_bucket_mins,omitempty"`
+
+	// Seconds for which a host's discovered service instances are reused by commands (5 if unspecified)
+	InstanceCacheSecs int `json:"instance_cache_secs,omitempty"`
+
+	// Uptime below which an instance is considered to have restarted
+	RestartUptimeMins int `json:"restart_uptime_mins,omitempty"`
+
+	// Maximum number of bucket columns in generated sheets, beyond which each span of N buckets
+	// is merged into one column (unlimited if unspecified)
+	SheetMaxColumns int `json:"sheet_max_columns,omitempty"`
+
+	// Maximum number of handlers shown by "show handlers", beyond which the full list is
+	// offered as a download (25 if unspecified)
+	ShowHandlersMax int `json:"show_handlers_max,omitempty"`
+
+	// Text removed from node IDs (":notehandler-tcp" if unspecified) and from node tags ("_igress"
+	// if unspecified) shown by the activity command, and the maximum width of each of its columns,
+	// beyond which text is truncated (unlimited if unspecified)
+	ActivityNodeIDRemovals []string `json:"activity_node_id_removals,omitempty"`
+	ActivityTagRemovals    []string `json:"activity_tag_removals,omitempty"`
+	ActivityColumnMaxWidth int      `json:"activity_column_max_width,omitempty"`
+
+	// Thresholds above which the cells of a metric's rows in generated sheets are highlighted, by
+	// metric: malloc, diskrd, diskwr, netrcv, netsnd (all in the sheet's units), queued, routed, or
+	// fatals (such as 0 to highlight any fatal)
+	SheetHighlightThresholds map[string]float64 `json:"sheet_highlight_thresholds,omitempty"`
+
+	// Units used for the OS rows of generated sheets: kb, mb (the default), or gb
+	SheetUnits string `json:"sheet_units,omitempty"`
+
 	// Datadog creds
 	DatadogSite   string `json:"datadog_site,omitempty"`
 	DatadogAppKey string `json:"datadog_app_key,omitempty"`
 	DatadogAPIKey string `json:"datadog_api_key,omitempty"`
+
+	// InfluxDB v2 endpoint, credentials, and bucket to which stats are also written, if specified
+	InfluxURL    string `json:"influx_url,omitempty"`
+	InfluxToken  string `json:"influx_token,omitempty"`
+	InfluxOrg    string `json:"influx_org,omitempty"`
+	InfluxBucket string `json:"influx_bucket,omitempty"`
+
+	// OTLP/HTTP collector endpoint to which stats are also exported, if specified, along with any
+	// headers required by the collector, such as for authorization
+	OTLPEndpoint string            `json:"otlp_endpoint,omitempty"`
+	OTLPHeaders  map[string]string `json:"otlp_headers,omitempty"`
+
+	// Maximum size in bytes of each payload of metrics submitted to DataDog (3000000 if unspecified),
+	// and the number of payloads submitted concurrently (4 if unspecified)
+	DatadogBatchBytes  int `json:"datadog_batch_bytes,omitempty"`
+	DatadogConcurrency int `json:"datadog_concurrency,omitempty"`
+
+	// Number of consecutive upload cycles in which submissions to DataDog fail before alerting (3 if unspecified)
+	DatadogFailureAlertCount int `json:"datadog_failure_alert_count,omitempty"`
+
+	// Also aggregate stats for each service type, such as for hosts on which handlers, discovery,
+	// and noteboard run in the same process space.  These are uploaded to DataDog as
+	// notehub.<host>.<service type>.<metric>, written to InfluxDB as the notehub_service measurement
+	// tagged with the service type, exported to OTLP as notehub.<service type>.<metric>, and shown
+	// as a summary tab for each service type in a host's sheet.
+	StatsByServiceType bool `json:"stats_by_service_type,omitempty"`
+
+	// Metric suffixes (such as disk.reads) to upload to DataDog, InfluxDB, and OTLP, and to exclude from upload
+	DatadogMetricsAllowed []string `json:"datadog_metrics,omitempty"`
+	DatadogMetricsDenied  []string `json:"datadog_metrics_excluded,omitempty"`
 }
 
 // ConfigPath (here for golint)
 const ConfigPath = "/config/config.json"
 
+// Environment variables that, respectively, specify the config file's path and the config JSON itself
+const ConfigPathEnv = "NOTEHUB_WATCH_CONFIG"
+const ConfigJSONEnv = "NOTEHUB_WATCH_CONFIG_JSON"
+
+// Config file path specified on the command line, which overrides the environment
+var configPathFlag string
+
 // Config is our configuration, read out of a file for security reasons
 var Config ServiceConfig
 
-// ServiceReadConfig gets the current value of the service config
+// ServiceReadConfig gets the current value of the service config, preferring JSON supplied
+// directly in the environment, then the path from the command line or environment, and
+// finally the default path within the home directory.
 func ServiceReadConfig() {
 
+	// Use the JSON directly if supplied
+	if configJSON := os.Getenv(ConfigJSONEnv); configJSON != "" {
+		err := json.Unmarshal([]byte(configJSON), &Config)
+		if err != nil {
+			fmt.Printf("Can't parse config JSON from %s: %s\n", ConfigJSONEnv, err)
+			os.Exit(-1)
+		}
+		return
+	}
+
+	// Determine the path
+	path := configPathFlag
+	if path == "" {
+		path = os.Getenv(ConfigPathEnv)
+	}
+	if path == "" {
+		homedir, _ := os.UserHomeDir()
+		path = homedir + ConfigPath
+	}
+
 	// Read the file and unmarshall if no error
-	homedir, _ := os.UserHomeDir()
-	path := homedir + ConfigPath
 	contents, err := os.ReadFile(path)
 	if err != nil {
 		fmt.Printf("can't load config from %s: %s\n", path, err)
@@ -6,9 +6,16 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
+	"path"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	datadog "github.com/DataDog/datadog-api-client-go/api/v1/datadog"
 )
@@ -24,9 +31,163 @@ func (list statOccurrence) Less(i, j int) bool {
 	return si.Time < sj.Time
 }
 
+// Whether uploads to DataDog are paused, which persists across restarts by way of a file
+// in the data directory so that uploads can be suspended without changing the config
+const datadogPausedFilename = "datadog-paused"
+
+var datadogPaused atomic.Bool
+
+// Load the persisted paused state
+func datadogLoadPaused() {
+	_, err := os.Stat(configDataDirectory + datadogPausedFilename)
+	datadogPaused.Store(err == nil)
+	if datadogPaused.Load() {
+		fmt.Printf("datadog: uploads are paused\n")
+	}
+}
+
+// Pause or resume uploads, persisting the state
+func datadogSetPaused(paused bool) (err error) {
+	if paused {
+		err = os.WriteFile(configDataDirectory+datadogPausedFilename, []byte{}, 0644)
+	} else {
+		err = os.Remove(configDataDirectory + datadogPausedFilename)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return
+	}
+	datadogPaused.Store(paused)
+	return
+}
+
+// Handle the datadog command, which pauses or resumes uploads, or reports their state
+func datadogCommand(action string) (response string) {
+	switch action {
+	case "off":
+		err := datadogSetPaused(true)
+		if err != nil {
+			return fmt.Sprintf("error pausing datadog uploads: %s", err)
+		}
+	case "on":
+		err := datadogSetPaused(false)
+		if err != nil {
+			return fmt.Sprintf("error resuming datadog uploads: %s", err)
+		}
+	case "":
+	default:
+		return "/notehub datadog [on|off]"
+	}
+	if Config.DatadogAPIKey == "" {
+		return "datadog uploads are not configured"
+	}
+	if datadogPaused.Load() {
+		return "datadog uploads are paused"
+	}
+	return "datadog uploads are active"
+}
+
+// Health of the submission pipeline, tracked by consecutive upload cycles that failed so that
+// we can alert once it has been failing for a while and say so once it recovers.  Each host's
+// upload of stats is a cycle, however many batches it was submitted in.
+const datadogFailureAlertCountDefault = 3
+
+var datadogHealthLock sync.Mutex
+var datadogFailures int
+var datadogAlerted bool
+
+// Record the result of an upload cycle to DataDog
+func datadogRecordResult(err error) {
+	datadogHealthLock.Lock()
+	defer datadogHealthLock.Unlock()
+
+	if err == nil {
+		if datadogAlerted {
+			message := fmt.Sprintf("DataDog uploads recovered after %d failures", datadogFailures)
+			goBackground(func() { slackSendMessage(message) })
+		}
+		datadogFailures = 0
+		datadogAlerted = false
+		return
+	}
+
+	datadogFailures++
+	alertCount := Config.DatadogFailureAlertCount
+	if alertCount <= 0 {
+		alertCount = datadogFailureAlertCountDefault
+	}
+	if datadogFailures >= alertCount && !datadogAlerted {
+		datadogAlerted = true
+		message := fmt.Sprintf("DataDog uploads failing (%d consecutive failures): %s", datadogFailures, err)
+		goBackground(func() { slackSendAlert(message) })
+	}
+}
+
+// Get the health of the submission pipeline
+func datadogHealth() (degraded bool, failures int) {
+	datadogHealthLock.Lock()
+	defer datadogHealthLock.Unlock()
+	return datadogAlerted, datadogFailures
+}
+
+// The metrics uploaded for each host, by the suffix following "notehub.<host>."
+var datadogMetrics = []struct {
+	suffix string
+	value  func(stat AggregatedStat) float64
+}{
+	{"disk.reads", func(stat AggregatedStat) float64 { return float64(stat.DiskReads) }},
+	{"disk.writes", func(stat AggregatedStat) float64 { return float64(stat.DiskWrites) }},
+	{"net.received", func(stat AggregatedStat) float64 { return float64(stat.NetReceived) }},
+	{"net.sent", func(stat AggregatedStat) float64 { return float64(stat.NetSent) }},
+	{"http.conn", func(stat AggregatedStat) float64 { return float64(stat.HttpConnTotal) }},
+	{"http.connreused", func(stat AggregatedStat) float64 { return float64(stat.HttpConnReused) }},
+	{"handlers", func(stat AggregatedStat) float64 { return float64(stat.HandlersDiscovery + stat.HandlersContinuous) }},
+	{"events.received", func(stat AggregatedStat) float64 { return float64(stat.EventsReceived) }},
+	{"events.routed", func(stat AggregatedStat) float64 { return float64(stat.EventsRouted) }},
+	{"database.reads", func(stat AggregatedStat) float64 { return float64(stat.DatabaseReads) }},
+	{"database.writes", func(stat AggregatedStat) float64 { return float64(stat.DatabaseWrites) }},
+	{"api.calls", func(stat AggregatedStat) float64 { return float64(stat.APITotal) }},
+}
+
+// Metrics reported only by noteboard instances of versions that support them, which are
+// uploaded only for hosts that report them so that other hosts don't appear to have none
+var datadogNoteboardMetrics = []struct {
+	suffix string
+	value  func(stat AggregatedStat) float64
+}{
+	{"noteboard.boards", func(stat AggregatedStat) float64 { return float64(stat.BoardsActive) }},
+	{"noteboard.websockets", func(stat AggregatedStat) float64 { return float64(stat.WebsocketsActive) }},
+}
+
+// See whether a metric suffix should be uploaded, given the configured allow and deny lists, whose
+// entries may be patterns such as "cache.*.hitrate".  With no allow list, all metrics are allowed.
+func datadogMetricEnabled(suffix string) bool {
+	for _, pattern := range Config.DatadogMetricsDenied {
+		if matched, _ := path.Match(pattern, suffix); matched {
+			return false
+		}
+	}
+	if len(Config.DatadogMetricsAllowed) == 0 {
+		return true
+	}
+	for _, pattern := range Config.DatadogMetricsAllowed {
+		if matched, _ := path.Match(pattern, suffix); matched {
+			return true
+		}
+	}
+	return false
+}
+
 // Write new stats to DataDog
 func datadogUploadStats(hostname string, bucketSecs int64, addedStats map[string][]StatsStat) (err error) {
 
+	// Exit if DataDog isn't configured, such as when only writing to InfluxDB, or is paused
+	if Config.DatadogAPIKey == "" || datadogPaused.Load() {
+		return
+	}
+
 	// Generate the list of aggregated stats
 	aggregatedStats := statsAggregate(addedStats, bucketSecs)
 	if len(aggregatedStats) == 0 {
@@ -40,140 +201,307 @@ func datadogUploadStats(hostname string, bucketSecs int64, addedStats map[string
 	var series datadog.Series
 	seriesArray := []datadog.Series{}
 
-	series = datadog.Series{Metric: "notehub." + hostname + ".disk.reads", Type: datadog.PtrString("gauge")}
-	for _, stat := range aggregatedStats {
-		point := []*float64{
-			datadog.PtrFloat64(float64(stat.Time)),
-			datadog.PtrFloat64(float64(stat.DiskReads)),
+	metrics := datadogMetrics
+	for _, m := range datadogNoteboardMetrics {
+		for _, stat := range aggregatedStats {
+			if m.value(stat) != 0 {
+				metrics = append(metrics, m)
+				break
+			}
 		}
-		series.Points = append(series.Points, point)
 	}
-	seriesArray = append(seriesArray, series)
-
-	series = datadog.Series{Metric: "notehub." + hostname + ".disk.writes", Type: datadog.PtrString("gauge")}
-	for _, stat := range aggregatedStats {
-		point := []*float64{
-			datadog.PtrFloat64(float64(stat.Time)),
-			datadog.PtrFloat64(float64(stat.DiskWrites)),
+	for _, m := range metrics {
+		if !datadogMetricEnabled(m.suffix) {
+			continue
 		}
-		series.Points = append(series.Points, point)
+		series = datadog.Series{Metric: "notehub." + hostname + "." + m.suffix, Type: datadog.PtrString("gauge")}
+		for _, stat := range aggregatedStats {
+			point := []*float64{
+				datadog.PtrFloat64(float64(stat.Time)),
+				datadog.PtrFloat64(m.value(stat)),
+			}
+			series.Points = append(series.Points, point)
+		}
+		seriesArray = append(seriesArray, series)
 	}
-	seriesArray = append(seriesArray, series)
 
-	series = datadog.Series{Metric: "notehub." + hostname + ".net.received", Type: datadog.PtrString("gauge")}
-	for _, stat := range aggregatedStats {
-		point := []*float64{
-			datadog.PtrFloat64(float64(stat.Time)),
-			datadog.PtrFloat64(float64(stat.NetReceived)),
+	// Optionally the same metrics for each service type, such as for hosts on which handlers,
+	// discovery, and noteboard run in the same process space
+	if Config.StatsByServiceType {
+		for serviceType, typeStats := range statsAggregateBy(addedStats, bucketSecs, statsServiceType) {
+			sort.Sort(statOccurrence(typeStats))
+			for _, m := range datadogMetrics {
+				if !datadogMetricEnabled(m.suffix) {
+					continue
+				}
+				series = datadog.Series{Metric: "notehub." + hostname + "." + serviceType + "." + m.suffix, Type: datadog.PtrString("gauge")}
+				for _, stat := range typeStats {
+					point := []*float64{
+						datadog.PtrFloat64(float64(stat.Time)),
+						datadog.PtrFloat64(m.value(stat)),
+					}
+					series.Points = append(series.Points, point)
+				}
+				seriesArray = append(seriesArray, series)
+			}
 		}
-		series.Points = append(series.Points, point)
 	}
-	seriesArray = append(seriesArray, series)
 
-	series = datadog.Series{Metric: "notehub." + hostname + ".net.sent", Type: datadog.PtrString("gauge")}
+	// Cache hit rates, for those caches whose hosts report hits and misses
+	cacheKeys := map[string]bool{}
 	for _, stat := range aggregatedStats {
-		point := []*float64{
-			datadog.PtrFloat64(float64(stat.Time)),
-			datadog.PtrFloat64(float64(stat.NetSent)),
+		for k, c := range stat.Caches {
+			if _, ok := cacheHitRate(c); ok {
+				cacheKeys[k] = true
+			}
 		}
-		series.Points = append(series.Points, point)
 	}
-	seriesArray = append(seriesArray, series)
-
-	series = datadog.Series{Metric: "notehub." + hostname + ".http.conn", Type: datadog.PtrString("gauge")}
-	for _, stat := range aggregatedStats {
-		point := []*float64{
-			datadog.PtrFloat64(float64(stat.Time)),
-			datadog.PtrFloat64(float64(stat.HttpConnTotal)),
+	for k := range cacheKeys {
+		if !datadogMetricEnabled("cache." + k + ".hitrate") {
+			continue
 		}
-		series.Points = append(series.Points, point)
+		series = datadog.Series{Metric: "notehub." + hostname + ".cache." + k + ".hitrate", Type: datadog.PtrString("gauge")}
+		for _, stat := range aggregatedStats {
+			rate, ok := cacheHitRate(stat.Caches[k])
+			if !ok {
+				continue
+			}
+			point := []*float64{
+				datadog.PtrFloat64(float64(stat.Time)),
+				datadog.PtrFloat64(rate),
+			}
+			series.Points = append(series.Points, point)
+		}
+		seriesArray = append(seriesArray, series)
 	}
-	seriesArray = append(seriesArray, series)
 
-	series = datadog.Series{Metric: "notehub." + hostname + ".http.connreused", Type: datadog.PtrString("gauge")}
-	for _, stat := range aggregatedStats {
-		point := []*float64{
-			datadog.PtrFloat64(float64(stat.Time)),
-			datadog.PtrFloat64(float64(stat.HttpConnReused)),
-		}
-		series.Points = append(series.Points, point)
+	// Submit the metrics
+	if len(seriesArray) == 0 {
+		return
 	}
-	seriesArray = append(seriesArray, series)
+	err = datadogSubmitSeries(seriesArray)
+	datadogRecordResult(err)
 
-	series = datadog.Series{Metric: "notehub." + hostname + ".handlers", Type: datadog.PtrString("gauge")}
-	for _, stat := range aggregatedStats {
-		point := []*float64{
-			datadog.PtrFloat64(float64(stat.Time)),
-			datadog.PtrFloat64(float64(stat.HandlersDiscovery + stat.HandlersContinuous)),
-		}
-		series.Points = append(series.Points, point)
+	// Done
+	return
+
+}
+
+// Write the number of the host's service instances, timestamped now, broken down by service type
+func datadogUploadInstances(hostname string, serviceInstanceIDs []string) (err error) {
+
+	// Exit if DataDog isn't configured or is paused
+	if Config.DatadogAPIKey == "" || datadogPaused.Load() || !datadogMetricEnabled("instances") {
+		return
 	}
-	seriesArray = append(seriesArray, series)
 
-	series = datadog.Series{Metric: "notehub." + hostname + ".events.received", Type: datadog.PtrString("gauge")}
-	for _, stat := range aggregatedStats {
-		point := []*float64{
-			datadog.PtrFloat64(float64(stat.Time)),
-			datadog.PtrFloat64(float64(stat.EventsReceived)),
-		}
-		series.Points = append(series.Points, point)
+	// Count the instances of each service type
+	counts := map[string]int{}
+	for _, siid := range serviceInstanceIDs {
+		counts[statsServiceType(siid)]++
 	}
-	seriesArray = append(seriesArray, series)
 
-	series = datadog.Series{Metric: "notehub." + hostname + ".events.routed", Type: datadog.PtrString("gauge")}
-	for _, stat := range aggregatedStats {
-		point := []*float64{
-			datadog.PtrFloat64(float64(stat.Time)),
-			datadog.PtrFloat64(float64(stat.EventsRouted)),
-		}
-		series.Points = append(series.Points, point)
+	now := datadog.PtrFloat64(float64(time.Now().UTC().Unix()))
+	seriesArray := []datadog.Series{}
+	for serviceType, count := range counts {
+		tags := []string{"host:" + hostname, "service:" + serviceType}
+		series := datadog.Series{Metric: "notehub.instances", Type: datadog.PtrString("gauge"), Tags: &tags}
+		series.Points = append(series.Points, []*float64{now, datadog.PtrFloat64(float64(count))})
+		seriesArray = append(seriesArray, series)
+	}
+	if len(seriesArray) == 0 {
+		return
 	}
-	seriesArray = append(seriesArray, series)
 
-	series = datadog.Series{Metric: "notehub." + hostname + ".database.reads", Type: datadog.PtrString("gauge")}
-	for _, stat := range aggregatedStats {
-		point := []*float64{
-			datadog.PtrFloat64(float64(stat.Time)),
-			datadog.PtrFloat64(float64(stat.DatabaseReads)),
-		}
-		series.Points = append(series.Points, point)
+	return datadogSubmitSeries(seriesArray)
+
+}
+
+// Write a single gauge value to DataDog in the background
+func datadogSubmitGaugeAsync(metric string, value float64, tags []string) {
+	goBackground(func() { datadogSubmitGauge(metric, value, tags) })
+}
+
+// Write a single gauge value to DataDog, timestamped now
+func datadogSubmitGauge(metric string, value float64, tags []string) (err error) {
+
+	// Exit if DataDog isn't configured or is paused
+	if Config.DatadogAPIKey == "" || datadogPaused.Load() {
+		return
 	}
-	seriesArray = append(seriesArray, series)
 
-	series = datadog.Series{Metric: "notehub." + hostname + ".database.writes", Type: datadog.PtrString("gauge")}
-	for _, stat := range aggregatedStats {
-		point := []*float64{
-			datadog.PtrFloat64(float64(stat.Time)),
-			datadog.PtrFloat64(float64(stat.DatabaseWrites)),
-		}
-		series.Points = append(series.Points, point)
+	series := datadog.Series{Metric: metric, Type: datadog.PtrString("gauge")}
+	if len(tags) > 0 {
+		series.Tags = &tags
+	}
+	point := []*float64{
+		datadog.PtrFloat64(float64(time.Now().UTC().Unix())),
+		datadog.PtrFloat64(value),
 	}
-	seriesArray = append(seriesArray, series)
+	series.Points = append(series.Points, point)
 
-	series = datadog.Series{Metric: "notehub." + hostname + ".api.calls", Type: datadog.PtrString("gauge")}
-	for _, stat := range aggregatedStats {
-		point := []*float64{
-			datadog.PtrFloat64(float64(stat.Time)),
-			datadog.PtrFloat64(float64(stat.APITotal)),
+	return datadogSubmitSeries([]datadog.Series{series})
+
+}
+
+// Defaults for the size of each payload, which is kept under DataDog's limit of 3.2MB, and for
+// the number of payloads submitted at once
+const datadogBatchBytesDefault = 3000000
+const datadogConcurrencyDefault = 4
+
+// Submit a set of series to DataDog, batched into payloads that are within DataDog's size limit
+// and submitted concurrently.  Because each batch succeeds or fails on its own, a failure only
+// loses the metrics within that batch.
+func datadogSubmitSeries(seriesArray []datadog.Series) (err error) {
+
+	maxBytes := Config.DatadogBatchBytes
+	if maxBytes <= 0 {
+		maxBytes = datadogBatchBytesDefault
+	}
+	concurrency := Config.DatadogConcurrency
+	if concurrency <= 0 {
+		concurrency = datadogConcurrencyDefault
+	}
+
+	batches := datadogBatchSeries(seriesArray, maxBytes)
+	if len(batches) == 1 {
+		return datadogSubmitBatch(batches[0])
+	}
+
+	var wg sync.WaitGroup
+	var failedLock sync.Mutex
+	failed := 0
+	slots := make(chan struct{}, concurrency)
+	for _, batch := range batches {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(batch []datadog.Series) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			err2 := datadogSubmitBatch(batch)
+			if err2 != nil {
+				failedLock.Lock()
+				failed++
+				err = err2
+				failedLock.Unlock()
+			}
+		}(batch)
+	}
+	wg.Wait()
+
+	if failed > 0 {
+		err = fmt.Errorf("%d of %d batches failed: %s", failed, len(batches), err)
+	}
+	return
+
+}
+
+// Split a set of series into batches whose encoded size is within the limit, splitting the
+// points of any single series that is itself too large
+func datadogBatchSeries(seriesArray []datadog.Series, maxBytes int) (batches [][]datadog.Series) {
+
+	var batch []datadog.Series
+	batchBytes := 0
+	for _, series := range seriesArray {
+		for _, s := range datadogSplitSeries(series, maxBytes) {
+			seriesBytes := datadogSeriesBytes(s)
+			if len(batch) > 0 && batchBytes+seriesBytes > maxBytes {
+				batches = append(batches, batch)
+				batch = nil
+				batchBytes = 0
+			}
+			batch = append(batch, s)
+			batchBytes += seriesBytes
 		}
-		series.Points = append(series.Points, point)
 	}
-	seriesArray = append(seriesArray, series)
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
 
-	// Submit the metrics
-	ctx := context.Background()
+	return
+
+}
+
+// Split a series whose encoded size is beyond the limit into several series of the same metric
+func datadogSplitSeries(series datadog.Series, maxBytes int) []datadog.Series {
+	if len(series.Points) < 2 || datadogSeriesBytes(series) <= maxBytes {
+		return []datadog.Series{series}
+	}
+	half := len(series.Points) / 2
+	first := series
+	first.Points = series.Points[:half]
+	second := series
+	second.Points = series.Points[half:]
+	return append(datadogSplitSeries(first, maxBytes), datadogSplitSeries(second, maxBytes)...)
+}
+
+// Get the encoded size of a series
+func datadogSeriesBytes(series datadog.Series) int {
+	seriesJSON, _ := json.Marshal(series)
+	return len(seriesJSON)
+}
+
+// Submit a single payload of series to DataDog
+func datadogSubmitBatch(seriesArray []datadog.Series) (err error) {
+
+	ctx := datadogContext()
+	configuration := datadog.NewConfiguration()
+	apiClient := datadog.NewAPIClient(configuration)
+	body := datadog.MetricsPayload{Series: seriesArray}
+	var r *http.Response
+	_, r, err = apiClient.MetricsApi.SubmitMetrics(ctx, body, *datadog.NewSubmitMetricsOptionalParameters())
+	if err != nil {
+		fmt.Printf("datadog: error submitting metrics: %s\n", err)
+		fmt.Printf("%v\n", r)
+	}
+
+	// Done
+	return
+
+}
+
+// The DataDog API endpoint, such as "http://127.0.0.1:8080", used in place of that of the
+// configured site if specified, such as when testing
+var datadogEndpoint string
+
+// Get a context carrying our DataDog site and credentials
+func datadogContext() (ctx context.Context) {
+	ctx = context.Background()
 	ctx = context.WithValue(ctx, datadog.ContextServerVariables, map[string]string{"site": Config.DatadogSite})
+	if parts := strings.SplitN(datadogEndpoint, "://", 2); len(parts) == 2 {
+		ctx = context.WithValue(ctx, datadog.ContextServerIndex, 1)
+		ctx = context.WithValue(ctx, datadog.ContextServerVariables, map[string]string{"protocol": parts[0], "name": parts[1]})
+	}
 	keys := make(map[string]datadog.APIKey)
 	keys["apiKeyAuth"] = datadog.APIKey{Key: Config.DatadogAPIKey}
 	keys["appKeyAuth"] = datadog.APIKey{Key: Config.DatadogAppKey}
 	ctx = context.WithValue(ctx, datadog.ContextAPIKeys, keys)
+	return
+}
+
+// Post an event to DataDog in the background
+func datadogPostEventAsync(title string, text string, tags []string) {
+	goBackground(func() { datadogPostEvent(title, text, tags) })
+}
+
+// Post an event to DataDog, such as to mark a deploy on dashboards
+func datadogPostEvent(title string, text string, tags []string) (err error) {
+
+	// Exit if DataDog isn't configured or is paused
+	if Config.DatadogAPIKey == "" || datadogPaused.Load() {
+		return
+	}
+
+	ctx := datadogContext()
 	configuration := datadog.NewConfiguration()
 	apiClient := datadog.NewAPIClient(configuration)
-	body := datadog.MetricsPayload{Series: seriesArray}
+	body := datadog.NewEventCreateRequest(text, title)
+	body.SetTags(tags)
+	body.SetDateHappened(time.Now().UTC().Unix())
 	var r *http.Response
-	_, r, err = apiClient.MetricsApi.SubmitMetrics(ctx, body, *datadog.NewSubmitMetricsOptionalParameters())
+	_, r, err = apiClient.EventsApi.CreateEvent(ctx, *body)
 	if err != nil {
-		fmt.Printf("datadog: error submitting metrics: %s\n", err)
+		fmt.Printf("datadog: error posting event: %s\n", err)
 		fmt.Printf("%v\n", r)
 	}
 
@@ -0,0 +1,130 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	datadog "github.com/DataDog/datadog-api-client-go/api/v1/datadog"
+)
+
+func TestDatadogHealthFailsThenRecovers(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved; datadogEndpoint = ""; datadogFailures = 0; datadogAlerted = false }()
+	Config.DatadogAPIKey = "key"
+	Config.DatadogFailureAlertCount = 2
+	Config.DatadogMetricsAllowed = nil
+	Config.DatadogMetricsDenied = nil
+	Config.SlackWebhookURL = ""
+	datadogPaused.Store(false)
+	datadogFailures = 0
+	datadogAlerted = false
+
+	// A DataDog endpoint that rejects our key until it's fixed
+	var status int32
+	var submissions int32
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/series" || r.Header.Get("DD-API-KEY") != "key" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		atomic.AddInt32(&submissions, 1)
+		w.Header().Set("Content-Type", "application/json")
+		if code := atomic.LoadInt32(&status); code != http.StatusAccepted {
+			w.WriteHeader(int(code))
+			w.Write([]byte(`{"errors":["Forbidden"]}`))
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer endpoint.Close()
+	datadogEndpoint = endpoint.URL
+
+	addedStats := map[string][]StatsStat{"a:handler": {{SnapshotTaken: 1646092800, OSMemTotal: 1, EventsRouted: 5}}}
+	steps := []struct {
+		name     string
+		status   int32
+		degraded bool
+		failures int
+	}{
+		{"first failure", http.StatusForbidden, false, 1},
+		{"alerts at the configured count", http.StatusForbidden, true, 2},
+		{"stays degraded", http.StatusForbidden, true, 3},
+		{"recovers", http.StatusAccepted, false, 0},
+		{"counts afresh", http.StatusForbidden, false, 1},
+	}
+	for _, s := range steps {
+		atomic.StoreInt32(&status, s.status)
+		err := datadogUploadStats("prod", 300, addedStats)
+		if (err != nil) != (s.status != http.StatusAccepted) {
+			t.Errorf("%s: upload error %v with status %d", s.name, err, s.status)
+		}
+		degraded, failures := datadogHealth()
+		if degraded != s.degraded || failures != s.failures {
+			t.Errorf("%s: degraded %t failures %d, want degraded %t failures %d", s.name, degraded, failures, s.degraded, s.failures)
+		}
+	}
+	if int(atomic.LoadInt32(&submissions)) != len(steps) {
+		t.Errorf("%d submissions, want %d", submissions, len(steps))
+	}
+	backgroundWork.Wait()
+}
+
+func TestDatadogBatchSeries(t *testing.T) {
+
+	// Many per-key series, each with an hour of 5-minute points
+	seriesArray := []datadog.Series{}
+	totalPoints := 0
+	for i := 0; i < 200; i++ {
+		series := datadog.Series{Metric: fmt.Sprintf("notehub.host.cache.key%d.hitrate", i), Type: datadog.PtrString("gauge")}
+		for j := 0; j < 12; j++ {
+			series.Points = append(series.Points, []*float64{datadog.PtrFloat64(float64(1646092800 + j*300)), datadog.PtrFloat64(float64(j))})
+		}
+		totalPoints += len(series.Points)
+		seriesArray = append(seriesArray, series)
+	}
+
+	// A series too large for a batch by itself
+	big := datadog.Series{Metric: "notehub.host.events.routed", Type: datadog.PtrString("gauge")}
+	for j := 0; j < 2000; j++ {
+		big.Points = append(big.Points, []*float64{datadog.PtrFloat64(float64(1646092800 + j*300)), datadog.PtrFloat64(float64(j))})
+	}
+	totalPoints += len(big.Points)
+	seriesArray = append(seriesArray, big)
+
+	tests := []struct {
+		maxBytes   int
+		minBatches int
+	}{
+		{datadogBatchBytesDefault, 1},
+		{20000, 4},
+		{5000, 10},
+	}
+	for _, tt := range tests {
+		batches := datadogBatchSeries(seriesArray, tt.maxBytes)
+		if len(batches) < tt.minBatches {
+			t.Errorf("max %d: %d batches, want at least %d", tt.maxBytes, len(batches), tt.minBatches)
+		}
+		points := 0
+		for i, batch := range batches {
+			batchBytes := 0
+			for _, series := range batch {
+				batchBytes += datadogSeriesBytes(series)
+				points += len(series.Points)
+			}
+			if batchBytes > tt.maxBytes {
+				t.Errorf("max %d: batch %d is %d bytes", tt.maxBytes, i, batchBytes)
+			}
+		}
+		if points != totalPoints {
+			t.Errorf("max %d: %d points batched, want %d", tt.maxBytes, points, totalPoints)
+		}
+	}
+
+}
@@ -0,0 +1,182 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Daily digest of each host's prior UTC day, posted to Slack once the configured hour has
+// passed.  The day of the most recent digest is kept in the data directory so that a restart
+// doesn't post it again.
+
+// How often to check whether the digest is due
+const digestCheckMins = 5
+
+// File containing the date of the most recent digest
+const digestLastFilename = "digest-last"
+
+// Number of fatal categories shown in the digest
+const digestFatalsMax = 3
+
+// Periodically post the daily digest when due
+func digestMaintainer() {
+	for {
+		time.Sleep(time.Duration(digestCheckMins) * time.Minute)
+		if !Config.DigestEnabled {
+			continue
+		}
+		now := time.Now().UTC()
+		if now.Hour() < Config.DigestHourUTC {
+			continue
+		}
+		today := now.Format("20060102")
+		last, _ := os.ReadFile(configDataDirectory + digestLastFilename)
+		if string(last) == today {
+			continue
+		}
+		err := os.WriteFile(configDataDirectory+digestLastFilename, []byte(today), 0644)
+		if err != nil {
+			fmt.Printf("digest: %s\n", err)
+		}
+		slackSendMessage(digestGenerate(time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, time.UTC)))
+	}
+}
+
+// Generate the digest of all hosts for the specified UTC day
+func digestGenerate(day time.Time) (response string) {
+	response = fmt.Sprintf("daily digest for %s\n", day.Format("2006-01-02"))
+	response += "```"
+	for _, host := range Config.MonitoredHosts {
+		if !host.Disabled {
+			response += digestHost(host.Name, day.Unix())
+		}
+	}
+	response += "```"
+	return
+}
+
+// Summarize a host's stats for the day beginning at the specified time
+func digestHost(hostname string, dayBegin int64) (response string) {
+
+	hs := digestHostStats(hostname, dayBegin)
+	if len(hs.Stats) == 0 || hs.BucketMins == 0 {
+		return fmt.Sprintf("%s: no stats\n", hostname)
+	}
+
+	// Events routed and peak backlog, the latter being the largest pending count of any bucket
+	// summed across instances
+	var routed int64
+	pendingByBucket := map[int64]int64{}
+	var peakMem uint64
+	fatals := map[string]int64{}
+	boots := map[string]bool{}
+	for siid, sis := range hs.Stats {
+		for _, s := range sis {
+			if s.NodeStarted >= dayBegin && s.NodeStarted < dayBegin+secs1Day {
+				boots[fmt.Sprintf("%s/%d", siid, s.NodeStarted)] = true
+			}
+			routed += s.EventsRouted
+			pendingByBucket[s.SnapshotTaken] += s.EventsPending
+			if s.OSMemTotal-s.OSMemFree > peakMem && s.OSMemTotal != 0 {
+				peakMem = s.OSMemTotal - s.OSMemFree
+			}
+			for k, v := range s.Fatals {
+				fatals[k] += v
+			}
+		}
+	}
+	var peakPending int64
+	for _, pending := range pendingByBucket {
+		if pending > peakPending {
+			peakPending = pending
+		}
+	}
+
+	// Instances that started during the day, whether restarting on their own or because of a
+	// deploy, as seen in the distinct boot times recorded with each instance's buckets
+	restarts := len(boots)
+
+	// The most frequent fatals
+	fatalKeys := make([]string, 0, len(fatals))
+	for k := range fatals {
+		fatalKeys = append(fatalKeys, k)
+	}
+	sort.Slice(fatalKeys, func(i, j int) bool {
+		if fatals[fatalKeys[i]] != fatals[fatalKeys[j]] {
+			return fatals[fatalKeys[i]] > fatals[fatalKeys[j]]
+		}
+		return fatalKeys[i] < fatalKeys[j]
+	})
+	if len(fatalKeys) > digestFatalsMax {
+		fatalKeys = fatalKeys[:digestFatalsMax]
+	}
+	topFatals := []string{}
+	for _, k := range fatalKeys {
+		topFatals = append(topFatals, fmt.Sprintf("%s:%d", k, fatals[k]))
+	}
+
+	response = fmt.Sprintf("%s: routed %d  peak pending %d  restarts %d  peak mem %dMB\n",
+		hostname, routed, peakPending, restarts, peakMem/(1024*1024))
+	if len(topFatals) > 0 {
+		response += fmt.Sprintf("    fatals %s\n", strings.Join(topFatals, " "))
+	}
+	return
+
+}
+
+// Get the host's stats for the day beginning at the specified time.  The in-memory stats are only
+// those of the current service version, so the day's files are also read for each other service
+// version present, such as after a deploy.  Because node IDs change with the service version, the
+// instances of each version are distinct.
+func digestHostStats(hostname string, dayBegin int64) (hs HostStats) {
+
+	hs, exists := statsExtract(hostname, dayBegin, secs1Day)
+	if !exists || hs.Stats == nil {
+		hs.Stats = map[string][]StatsStat{}
+	}
+	statsLock.Lock()
+	currentVersion := ""
+	if exists {
+		currentVersion = statsServiceVersions[hostname]
+	}
+	statsLock.Unlock()
+
+	entries, err := os.ReadDir(configDataDirectory)
+	if err != nil {
+		fmt.Printf("digest: error reading data directory: %s\n", err)
+		return
+	}
+	for _, entry := range entries {
+		if statsFileOfOtherHost(hostname, entry.Name()) {
+			continue
+		}
+		serviceVersion, day, ok := rollupParseDailyFilename(hostname, entry.Name())
+		if !ok || day.Unix() != dayBegin || serviceVersion == currentVersion {
+			continue
+		}
+		fileHs, err := readFileLocally(hostname, serviceVersion, dayBegin)
+		if err != nil {
+			fmt.Printf("digest: %s: %s\n", entry.Name(), err)
+			continue
+		}
+		if hs.BucketMins == 0 {
+			hs.BucketMins = fileHs.BucketMins
+		}
+		for siid, sis := range fileHs.Stats {
+			if _, present := hs.Stats[siid]; present {
+				siid = serviceVersion + "/" + siid
+			}
+			hs.Stats[siid] = sis
+		}
+	}
+
+	return
+
+}
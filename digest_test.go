@@ -0,0 +1,52 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDigestIncludesPriorServiceVersions(t *testing.T) {
+	saved := configDataDirectory
+	savedConfig := Config
+	defer func() { configDataDirectory = saved; Config = savedConfig }()
+	configDataDirectory = t.TempDir() + "/"
+	Config.MonitoredHosts = []MonitoredHost{{Name: "prod"}, {Name: "prod-eu"}}
+	statsInit()
+
+	// Yesterday's stats from before a deploy are only on disk, as are another host's
+	const bucketSecs = 300
+	dayBegin := yesterdayTime()
+	statsTestDailyFile(t, "prod", "v1", dayBegin, dayBegin+12*60*60, 10, bucketSecs)
+	statsTestDailyFile(t, "prod-eu", "v1", dayBegin, dayBegin+12*60*60, 10, bucketSecs)
+
+	// After the deploy, the current version's stats are in memory
+	newest := dayBegin + 20*60*60
+	sis := []StatsStat{}
+	for i := 0; i < 5; i++ {
+		sis = append(sis, StatsStat{SnapshotTaken: newest - int64(i)*bucketSecs, OSMemTotal: 1, EventsRouted: 100})
+	}
+	stats["prod"] = HostStats{Name: "prod", Time: newest, BucketMins: bucketSecs / 60, Stats: map[string][]StatsStat{"new:handler": sis}}
+	statsServiceVersions["prod"] = "v2"
+
+	hs := digestHostStats("prod", dayBegin)
+	if len(hs.Stats) != 2 || len(hs.Stats["siid"]) != 10 || len(hs.Stats["new:handler"]) == 0 {
+		t.Fatalf("digest stats of %d instances, want those of both versions", len(hs.Stats))
+	}
+	if response := digestHost("prod", dayBegin); !strings.Contains(response, "routed 500 ") {
+		t.Errorf("digest %q doesn't include both versions' events", response)
+	}
+
+	// A host whose stats aren't loaded is summarized from its files alone
+	stats = map[string]HostStats{}
+	statsServiceVersions = map[string]string{}
+	if hs = digestHostStats("prod", dayBegin); len(hs.Stats) != 1 || hs.BucketMins != bucketSecs/60 {
+		t.Errorf("digest stats of %d instances in %d-minute buckets from files alone", len(hs.Stats), hs.BucketMins)
+	}
+	if hs = digestHostStats("prod", dayBegin-secs1Day); len(hs.Stats) != 0 {
+		t.Errorf("digest of a day without stats has %d instances", len(hs.Stats))
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// On-demand archive of the current day's stats to S3
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// The result of archiving a host
+type archiveResult struct {
+	Host     string `json:"host,omitempty"`
+	Filename string `json:"filename,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Archive handler, which requires a POST specifying the host (or "all") so that
+// probes and crawlers can't trigger it, as well as the token.  Without a configured
+// token the endpoint is disabled, leaving the Slack command as the only way to archive.
+func inboundWebArchiveHandler(httpRsp http.ResponseWriter, httpReq *http.Request) {
+
+	// Validate the request
+	if Config.ArchiveToken == "" {
+		http.Error(httpRsp, "archive endpoint is disabled because no archive token is configured", http.StatusForbidden)
+		return
+	}
+	if httpReq.Method != "POST" {
+		http.Error(httpRsp, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if httpReq.Header.Get("Authorization") != "Bearer "+Config.ArchiveToken {
+		http.Error(httpRsp, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	hostname := httpReq.URL.Query().Get("host")
+	if hostname == "" {
+		http.Error(httpRsp, "host is required (or 'all')", http.StatusBadRequest)
+		return
+	}
+
+	// Archive the hosts
+	results := []archiveResult{}
+	for _, host := range Config.MonitoredHosts {
+		if host.Disabled || (hostname != "all" && hostname != host.Name) {
+			continue
+		}
+		r := archiveResult{Host: host.Name}
+		var err error
+		r.Filename, err = statsArchiveHost(host.Name)
+		if err != nil {
+			r.Error = err.Error()
+		}
+		results = append(results, r)
+	}
+	if len(results) == 0 {
+		http.Error(httpRsp, "host not found", http.StatusNotFound)
+		return
+	}
+
+	// Done
+	rspJSON, _ := json.Marshal(results)
+	httpRsp.Header().Set("Content-Type", "application/json")
+	httpRsp.Write(rspJSON)
+
+}
@@ -0,0 +1,44 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestArchiveHandlerRequiresToken(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved }()
+	Config.MonitoredHosts = nil
+
+	tests := []struct {
+		name          string
+		token         string
+		method        string
+		authorization string
+		status        int
+	}{
+		{"disabled without a token", "", "POST", "", http.StatusForbidden},
+		{"disabled even if one is sent", "", "POST", "Bearer ", http.StatusForbidden},
+		{"requires POST", "secret", "GET", "Bearer secret", http.StatusMethodNotAllowed},
+		{"requires the token", "secret", "POST", "", http.StatusUnauthorized},
+		{"rejects the wrong token", "secret", "POST", "Bearer wrong", http.StatusUnauthorized},
+		{"accepts the token", "secret", "POST", "Bearer secret", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		Config.ArchiveToken = tt.token
+		req := httptest.NewRequest(tt.method, "/archive?host=nonexistent", nil)
+		if tt.authorization != "" {
+			req.Header.Set("Authorization", tt.authorization)
+		}
+		rsp := httptest.NewRecorder()
+		inboundWebArchiveHandler(rsp, req)
+		if rsp.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, rsp.Code, tt.status)
+		}
+	}
+}
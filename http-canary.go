@@ -6,10 +6,14 @@
 package main
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -19,16 +23,28 @@ import (
 
 // Retained between canary notifications
 type deviceContext struct {
-	sn         string
-	continuous bool
-	warnings   int64
+	sn             string
+	continuous     bool
+	warnings       int64
+	unroutedWarned int64
 }
 type lastEvent struct {
 	sessionID    string
 	seqNo        int64
+	samples      int64
 	capturedTime int64
 	receivedTime int64
 	routedTime   int64
+	receivedMs   int64
+	routedMs     int64
+	interval     int64
+}
+
+// Built-in canary thresholds, most specific serial number prefix first
+var canaryDefaultRules = []CanaryRule{
+	// For NTN, the packet interval is 15m
+	{SNPrefix: "ntn", SecsCapturedToReceived: 20 * 60, MsReceivedToRouted: 10000, SecsReceivedToReceived: 25 * 60, SecsSilence: 20 * 60, MinSequenceSamples: 2},
+	{SNPrefix: "", SecsCapturedToReceived: 120, MsReceivedToRouted: 10000, SecsReceivedToReceived: 5 * 60, SecsSilence: 6 * 60, MinSequenceSamples: 2},
 }
 
 var canaryLock sync.Mutex
@@ -43,21 +59,18 @@ func inboundWebCanaryHandler(httpRsp http.ResponseWriter, httpReq *http.Request)
 		return
 	}
 
-	// Instantiate the map
-	canaryLock.Lock()
-	if last == nil {
-		last = map[string]lastEvent{}
-	}
-	if device == nil {
-		device = map[string]deviceContext{}
-	}
-	canaryLock.Unlock()
-
 	// Exit if someone is probing us
 	if httpReq.Method == "GET" {
 		return
 	}
 
+	// Shed load if we're being flooded, such as by a misconfigured route, so that the
+	// lock and parsing below can't starve our other handlers
+	if !canaryRateAllow(time.Now()) {
+		httpRsp.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
 	// Get the body if supplied
 	eventJSON, err := io.ReadAll(httpReq.Body)
 	if err != nil {
@@ -71,13 +84,90 @@ func inboundWebCanaryHandler(httpRsp http.ResponseWriter, httpReq *http.Request)
 		return
 	}
 
+	// Process it, alerting on anything amiss except for latencies that are expected during
+	// suppression windows, which are downgraded to routine messages
+	now := time.Now().UTC()
+	routingLatencyMs, errstr, backlog := canaryProcessEvent(e, now)
+	if e.NotefileID == "_temp.qo" {
+		canaryRecordRoutingLatency(e, routingLatencyMs)
+	}
+	if errstr != "" {
+		if suppressed, reason := alertSuppressed(now); backlog && suppressed {
+			canaryMessageVia(e.DeviceUID, e.DeviceSN, slackRoutine, errstr+" (suppressed: "+reason+")")
+		} else {
+			canaryMessage(e.DeviceUID, e.DeviceSN, errstr)
+		}
+	}
+
+}
+
+// Default number of canary events per second that are processed, well above the volume of
+// a fleet of canary devices, with bursts of up to a few seconds' worth allowed
+const canaryRateLimitDefault = 50
+const canaryRateBurstSecs = 5
+
+// Token bucket limiting the rate at which canary events are processed
+var canaryRateLock sync.Mutex
+var canaryRateTokens float64
+var canaryRateUpdated time.Time
+
+// Take a token from the bucket, refilling it at the configured rate, returning false if it's empty
+func canaryRateAllow(now time.Time) bool {
+
+	limit := float64(Config.CanaryRateLimit)
+	if limit == 0 {
+		limit = canaryRateLimitDefault
+	}
+	if limit < 0 {
+		return true
+	}
+	burst := limit * canaryRateBurstSecs
+
+	canaryRateLock.Lock()
+	defer canaryRateLock.Unlock()
+	if canaryRateUpdated.IsZero() {
+		canaryRateTokens = burst
+	} else if elapsed := now.Sub(canaryRateUpdated).Seconds(); elapsed > 0 {
+		canaryRateTokens += elapsed * limit
+		if canaryRateTokens > burst {
+			canaryRateTokens = burst
+		}
+	}
+	canaryRateUpdated = now
+	if canaryRateTokens < 1 {
+		return false
+	}
+	canaryRateTokens--
+	return true
+
+}
+
+// Process a canary event that was routed at the specified time, updating what we know of the
+// device and returning its routing latency, the reason to alert (if any), and whether that reason
+// is a latency, which may be expected during suppression windows.  This is independent of how the
+// event arrived, so that captured events may be replayed.
+func canaryProcessEvent(e note.Event, now time.Time) (routingLatencyMs int64, errstr string, backlog bool) {
+
+	// Instantiate the map
+	canaryLock.Lock()
+	if last == nil {
+		last = map[string]lastEvent{}
+	}
+	if device == nil {
+		device = map[string]deviceContext{}
+	}
+	canaryLock.Unlock()
+
 	// Remember info about the last session
 	if e.NotefileID == "_session.qo" {
 		canaryLock.Lock()
 		d, present := device[e.DeviceUID]
-		if present && e.Body != nil {
-			body := *e.Body
-			d.continuous = strings.Contains(body["why"].(string), "continuous")
+		if present {
+			why := ""
+			if e.Body != nil {
+				why, _ = (*e.Body)["why"].(string)
+			}
+			d.continuous = canaryDeviceContinuous(e.DeviceSN, why)
 		}
 		d.sn = e.DeviceSN
 		device[e.DeviceUID] = d
@@ -99,53 +189,136 @@ func inboundWebCanaryHandler(httpRsp http.ResponseWriter, httpReq *http.Request)
 	} else {
 		t.capturedTime = e.When
 	}
-	t.routedTime = time.Now().UTC().Unix()
+	t.routedTime = now.Unix()
+	t.receivedMs = int64(e.Received * 1000)
+	t.routedMs = now.UnixMilli()
 	if e.Body != nil {
-		body := *e.Body
-		t.seqNo = int64(body["count"].(float64))
+		count, ok := (*e.Body)["count"].(float64)
+		if !ok {
+			fmt.Printf("canary: %s %s ignoring event without a numeric count: %s\n", e.DeviceSN, e.DeviceUID, e.EventUID)
+			return
+		}
+		t.seqNo = int64(count)
 	}
 
 	// Alert
 	canaryLock.Lock()
-	errstr := ""
+	l := last[e.DeviceUID]
+
+	// A new session (such as after a reboot) starts a new sequence baseline, and
+	// sequence gaps are only checked once enough events have been observed within it
+	if t.sessionID == l.sessionID {
+		t.samples = l.samples + 1
+	} else {
+		t.samples = 1
+	}
+
+	// Remember how often the device's events are received within the session, so that we know
+	// when its next event should have been received even if it never gets routed to us
+	if t.sessionID == l.sessionID && t.receivedTime > l.receivedTime {
+		t.interval = t.receivedTime - l.receivedTime
+	}
+
 	d, present := device[e.DeviceUID]
 	if present {
 		d.sn = e.DeviceSN
 		device[e.DeviceUID] = d
 
-		var secsCapturedToReceived, secsReceivedToReceived int64
-		secsCapturedToReceived = 120
-		secsReceivedToReceived = 5 * 60
-		if strings.HasPrefix(d.sn, "ntn") {
-			// For NTN, the packet interval is 15m
-			secsCapturedToReceived = 20 * 60
-			secsReceivedToReceived = 25 * 60
-		}
+		rule := canaryRuleForDevice(d.sn)
+		checkSequence := t.sessionID == l.sessionID && l.samples >= rule.MinSequenceSamples
 
-		l := last[e.DeviceUID]
 		if d.continuous && t.sessionID != l.sessionID {
 			errstr = "continuous session dropped and reconnected: " + t.sessionID
-		} else if t.seqNo != l.seqNo+1 {
+		} else if checkSequence && t.seqNo != l.seqNo+1 {
 			if t.seqNo == l.seqNo+2 {
 				errstr = fmt.Sprintf("packet/event was dropped (#%d)", l.seqNo+1)
 			} else {
 				errstr = fmt.Sprintf("sequence out of order (expected %d but received %d): %s", l.seqNo+1, t.seqNo, e.EventUID)
 			}
-		} else if (t.receivedTime - t.capturedTime) > secsCapturedToReceived {
-			errstr = fmt.Sprintf("event took %d secs to get from notecard to notehub: %s", t.receivedTime-t.capturedTime, e.EventUID)
-		} else if (t.routedTime - t.receivedTime) > 10 {
-			errstr = fmt.Sprintf("event took %d secs to be routed once it was received by notehub: %s", t.routedTime-t.receivedTime, e.EventUID)
-		} else if (t.receivedTime - l.receivedTime) > secsReceivedToReceived {
-			errstr = fmt.Sprintf("%d minutes between events received by notehub: %s", (t.routedTime-t.receivedTime)/60, e.EventUID)
+		} else if secs := t.receivedTime - t.capturedTime; secs > rule.SecsCapturedToReceived {
+			backlog = true
+			errstr = fmt.Sprintf("event took %d secs to get from notecard to notehub (%d secs over %d sec limit): %s",
+				secs, secs-rule.SecsCapturedToReceived, rule.SecsCapturedToReceived, e.EventUID)
+		} else if ms := t.routedMs - t.receivedMs; ms > rule.MsReceivedToRouted {
+			backlog = true
+			errstr = fmt.Sprintf("event took %d ms to be routed once it was received by notehub (%d ms over %d ms limit): %s",
+				ms, ms-rule.MsReceivedToRouted, rule.MsReceivedToRouted, e.EventUID)
+		} else if secs := t.receivedTime - l.receivedTime; l.receivedTime != 0 && secs > rule.SecsReceivedToReceived {
+			backlog = true
+			errstr = fmt.Sprintf("%d minutes between events received by notehub (%d secs over %d sec limit): %s",
+				secs/60, secs-rule.SecsReceivedToReceived, rule.SecsReceivedToReceived, e.EventUID)
 		}
 	}
 	last[e.DeviceUID] = t
 	canaryLock.Unlock()
 
-	// Send message
-	if errstr != "" {
-		canaryMessage(e.DeviceUID, e.DeviceSN, errstr)
+	routingLatencyMs = t.routedMs - t.receivedMs
+	return
+
+}
+
+// Record the routing latency, which unlike the notecard's capture time has sub-second resolution
+func canaryRecordRoutingLatency(e note.Event, routingLatencyMs int64) {
+	datadogSubmitGaugeAsync("notehub.canary.routing_latency_ms", float64(routingLatencyMs), canaryDatadogTags(e))
+}
+
+// Get the DataDog tags of a canary event's metrics, which always carry the full DeviceUID
+func canaryDatadogTags(e note.Event) (tags []string) {
+	tags = []string{"device:" + e.DeviceUID}
+	for _, tag := range canaryDeviceTags(e.DeviceUID, e.DeviceSN) {
+		tags = append(tags, "canary_tag:"+tag)
 	}
+	return
+}
+
+// Replay a file of captured canary events, one JSON event per line, through the same processing
+// as those that are routed to us, printing rather than sending the alerts.  Each event is treated
+// as having been routed when notehub says it was, so that the replay is deterministic.
+func canaryReplay(path string) (alerts int, err error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var e note.Event
+		err = json.Unmarshal([]byte(line), &e)
+		if err != nil {
+			fmt.Printf("canary replay: line %d: %s\n", lineNo, err)
+			continue
+		}
+
+		routed := time.Unix(int64(e.Received), int64((e.Received-float64(int64(e.Received)))*1e9)).UTC()
+		if e.Routed != 0 {
+			routed = time.Unix(e.Routed, 0).UTC()
+		}
+		_, errstr, backlog := canaryProcessEvent(e, routed)
+		if errstr == "" {
+			continue
+		}
+		alerts++
+		suppressed := ""
+		if ok, reason := alertSuppressed(routed); backlog && ok {
+			suppressed = " (suppressed: " + reason + ")"
+		}
+		fmt.Printf("canary replay: %s %s %s %s%s\n", routed.Format("01-02 15:04:05"), e.DeviceSN, e.DeviceUID, errstr, suppressed)
+	}
+	if err2 := scanner.Err(); err2 != nil {
+		err = err2
+	} else {
+		err = nil
+	}
+	return
 
 }
 
@@ -175,14 +348,28 @@ func canarySweepDevices() {
 	for deviceUID, d := range deviceCopy {
 		l := lastCopy[deviceUID]
 
-		var receivedInterval int64
-		receivedInterval = 6 * 60
-		if strings.HasPrefix(d.sn, "ntn") {
-			// For NTN, the packet interval is 15m
-			receivedInterval = 20 * 60
+		rule := canaryRuleForDevice(d.sn)
+
+		// Because we only see events once they're routed, an event that notehub received but never
+		// routed is detected by the device's next event being overdue, beyond the tolerance for the
+		// time between events, by more than the routing SLA.  This is sooner than the silence
+		// detector fires when routing has stopped entirely, without alerting on ordinary jitter.
+		if unroutedAgeMs := canaryUnroutedAgeMs(l, rule.SecsReceivedToReceived, now); unroutedAgeMs > rule.MsReceivedToRouted && d.unroutedWarned != l.receivedTime {
+			d.unroutedWarned = l.receivedTime
+			deviceCopy[deviceUID] = d
+			canaryLock.Lock()
+			device[deviceUID] = d
+			canaryLock.Unlock()
+			message := fmt.Sprintf("event expected to be received at %s hasn't been routed after %d secs (%d ms limit)",
+				time.Unix(now-unroutedAgeMs/1000, 0).UTC().Format("01-02 15:04:05"), unroutedAgeMs/1000, rule.MsReceivedToRouted)
+			if suppressed, reason := alertSuppressed(time.Unix(now, 0)); suppressed {
+				fmt.Printf("canary: %s %s %s (suppressed: %s)\n", d.sn, deviceUID, message, reason)
+			} else {
+				canaryMessage(deviceUID, d.sn, message)
+			}
 		}
 
-		if now-l.receivedTime >= receivedInterval {
+		if now-l.receivedTime >= rule.SecsSilence {
 			d.warnings++
 			deviceCopy[deviceUID] = d
 			canaryLock.Lock()
@@ -199,7 +386,137 @@ func canarySweepDevices() {
 
 }
 
-// Output a canary message
+// Get the age of the event that the device should most recently have had received by notehub
+// but which hasn't been routed to us, based upon how often its events have been received and
+// allowing for the tolerated time between events, or zero if none is overdue or its interval
+// isn't yet known
+func canaryUnroutedAgeMs(l lastEvent, toleranceSecs int64, now int64) (ageMs int64) {
+	if l.interval <= 0 || l.receivedTime == 0 {
+		return 0
+	}
+	expected := l.receivedTime + l.interval
+	if l.interval < toleranceSecs {
+		expected = l.receivedTime + toleranceSecs
+	}
+	if now <= expected {
+		return 0
+	}
+	return (now - expected) * 1000
+}
+
+// Output a canary message, labeled with the device's tags, suppressed if any of its tags are
+// suppressed, and routed to the webhook of the first of its tags that has one
 func canaryMessage(deviceUID string, sn string, message string) {
-	slackSendMessage(fmt.Sprintf("canary: %s %s %s", sn, deviceUID, message))
+	canaryMessageVia(deviceUID, sn, slackCritical, message)
+}
+
+// Output a canary message with the specified severity
+func canaryMessageVia(deviceUID string, sn string, severity slackSeverity, message string) {
+	tags := canaryDeviceTags(deviceUID, sn)
+	displayUID := deviceUID
+	if Config.CanaryAnonymizeDevices {
+		displayUID = canaryAnonymizedUID(deviceUID)
+		fmt.Printf("canary: %s %s is %s: %s\n", sn, deviceUID, displayUID, message)
+	}
+	if len(tags) == 0 {
+		slackSendMessageVia(Config.SlackWebhookURL, severity, fmt.Sprintf("canary: %s %s %s", sn, displayUID, message))
+		return
+	}
+	message = fmt.Sprintf("canary: %s %s [%s] %s", sn, displayUID, strings.Join(tags, ","), message)
+	webhookURL := Config.SlackWebhookURL
+	for _, tag := range tags {
+		for _, suppressed := range Config.CanaryTagsSuppressed {
+			if tag == suppressed {
+				fmt.Printf("%s (suppressed: %s)\n", message, tag)
+				return
+			}
+		}
+	}
+	for _, tag := range tags {
+		if url, present := Config.CanaryTagWebhooks[tag]; present {
+			webhookURL = url
+			break
+		}
+	}
+	slackSendMessageVia(webhookURL, severity, message)
+}
+
+// Get a stable stand-in for a DeviceUID that can be correlated with the full UID in our logs, but
+// from which the UID can't be recovered
+func canaryAnonymizedUID(deviceUID string) string {
+	hash := sha256.Sum256([]byte(deviceUID))
+	return "dev:" + hex.EncodeToString(hash[:])[:12]
+}
+
+// Get the configured tags of a device, by its DeviceUID and its serial number
+func canaryDeviceTags(deviceUID string, sn string) (tags []string) {
+	tags = append(tags, Config.CanaryDeviceTags[deviceUID]...)
+	if sn != "" {
+		for _, tag := range Config.CanaryDeviceTags[sn] {
+			duplicate := false
+			for _, t := range tags {
+				duplicate = duplicate || t == tag
+			}
+			if !duplicate {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return
+}
+
+// Canary modes, which determine whether session continuity is expected of a device
+const canaryModeContinuous = "continuous"
+const canaryModePeriodic = "periodic"
+
+// Determine whether a device is continuous, which is configured by serial number or else
+// inferred from why its session was opened.  Periodic devices legitimately open a new
+// session every cycle, so they're only evaluated on interval and latency.
+func canaryDeviceContinuous(sn string, why string) bool {
+	switch canaryRuleForDevice(sn).Mode {
+	case canaryModeContinuous:
+		return true
+	case canaryModePeriodic:
+		return false
+	}
+	return strings.Contains(why, "continuous")
+}
+
+// Get the canary thresholds that apply to a device, based upon its serial number.  The built-in
+// rule for the device's class is used as a base, overridden by the first matching configured rule.
+func canaryRuleForDevice(sn string) (rule CanaryRule) {
+
+	for _, r := range canaryDefaultRules {
+		if strings.HasPrefix(sn, r.SNPrefix) {
+			rule = r
+			break
+		}
+	}
+
+	for _, r := range Config.CanaryRules {
+		if !strings.HasPrefix(sn, r.SNPrefix) {
+			continue
+		}
+		if r.SecsCapturedToReceived != 0 {
+			rule.SecsCapturedToReceived = r.SecsCapturedToReceived
+		}
+		if r.MsReceivedToRouted != 0 {
+			rule.MsReceivedToRouted = r.MsReceivedToRouted
+		}
+		if r.SecsReceivedToReceived != 0 {
+			rule.SecsReceivedToReceived = r.SecsReceivedToReceived
+		}
+		if r.SecsSilence != 0 {
+			rule.SecsSilence = r.SecsSilence
+		}
+		if r.MinSequenceSamples != 0 {
+			rule.MinSequenceSamples = r.MinSequenceSamples
+		}
+		if r.Mode != "" {
+			rule.Mode = r.Mode
+		}
+		break
+	}
+
+	return
 }
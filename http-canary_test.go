@@ -0,0 +1,242 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blues/note-go/note"
+)
+
+// A canary event from a device in the specified session, with the specified count
+func canaryTestEvent(session string, count float64, received time.Time) note.Event {
+	body := map[string]interface{}{"count": count}
+	return note.Event{
+		EventUID:   "event",
+		DeviceUID:  "dev:1",
+		DeviceSN:   "canary",
+		NotefileID: "_temp.qo",
+		SessionUID: session,
+		Received:   float64(received.Unix()),
+		When:       received.Unix(),
+		Body:       &body,
+	}
+}
+
+func TestCanarySequenceGaps(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved; last = nil; device = nil }()
+	Config.CanaryRules = nil
+	last = nil
+	device = nil
+
+	// The device's session is known before its events arrive
+	now := time.Date(2022, time.March, 1, 12, 0, 0, 0, time.UTC)
+	canaryProcessEvent(note.Event{DeviceUID: "dev:1", DeviceSN: "canary", NotefileID: "_session.qo", SessionUID: "s1"}, now)
+
+	steps := []struct {
+		name    string
+		session string
+		count   float64
+		alert   string
+	}{
+		{"first event starts at an arbitrary count", "s1", 57, ""},
+		{"second event only establishes the baseline", "s1", 60, ""},
+		{"consecutive", "s1", 61, ""},
+		{"dropped", "s1", 63, "dropped"},
+		{"out of order", "s1", 70, "out of order"},
+		{"new session after a reboot", "s2", 1, ""},
+		{"baseline of the new session", "s2", 5, ""},
+		{"consecutive in the new session", "s2", 6, ""},
+		{"dropped in the new session", "s2", 8, "dropped"},
+	}
+	for i, s := range steps {
+		received := now.Add(time.Duration(i) * time.Minute)
+		_, errstr, _ := canaryProcessEvent(canaryTestEvent(s.session, s.count, received), received.Add(time.Second))
+		if (errstr == "") != (s.alert == "") || !strings.Contains(errstr, s.alert) {
+			t.Errorf("%s: alert %q, want %q", s.name, errstr, s.alert)
+		}
+	}
+}
+
+func TestCanaryReplay(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved; last = nil; device = nil }()
+	Config.CanaryRules = nil
+	last = nil
+	device = nil
+
+	// A capture of a session, a baseline, a consecutive event, and then a dropped one,
+	// along with lines that should be skipped rather than stop the replay
+	now := time.Date(2022, time.March, 1, 12, 0, 0, 0, time.UTC)
+	events := []note.Event{{DeviceUID: "dev:1", DeviceSN: "canary", NotefileID: "_session.qo", SessionUID: "s1", Received: float64(now.Unix())}}
+	for i, count := range []float64{57, 58, 59, 61} {
+		events = append(events, canaryTestEvent("s1", count, now.Add(time.Duration(i+1)*time.Minute)))
+	}
+	lines := []string{}
+	for i, e := range events {
+		b, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(b))
+		if i == 1 {
+			lines = append(lines, "", "not json")
+		}
+	}
+	path := filepath.Join(t.TempDir(), "canary.ndjson")
+	err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alerts, err := canaryReplay(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alerts != 1 {
+		t.Errorf("replay raised %d alerts, want 1", alerts)
+	}
+	if _, err = canaryReplay(filepath.Join(t.TempDir(), "missing.ndjson")); err == nil {
+		t.Errorf("replaying a missing capture succeeded")
+	}
+}
+
+func TestCanaryHandlerRateLimited(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved; canaryRateUpdated = time.Time{} }()
+	Config.CanaryDisabled = false
+	Config.CanaryRateLimit = 10
+	canaryRateUpdated = time.Time{}
+
+	// Hammer the handler far beyond the limit, so that only the burst gets through
+	burst := Config.CanaryRateLimit * canaryRateBurstSecs
+	accepted, limited := 0, 0
+	for i := 0; i < 10*burst; i++ {
+		rsp := httptest.NewRecorder()
+		inboundWebCanaryHandler(rsp, httptest.NewRequest(http.MethodPost, "/canary", strings.NewReader("not an event")))
+		switch rsp.Code {
+		case http.StatusOK:
+			accepted++
+		case http.StatusTooManyRequests:
+			limited++
+		default:
+			t.Fatalf("status %d", rsp.Code)
+		}
+	}
+	if accepted < burst || accepted > burst+2 || limited == 0 {
+		t.Errorf("%d accepted and %d limited, want about %d accepted", accepted, limited, burst)
+	}
+
+	// Once flooding stops, traffic at the expected volume passes
+	now := time.Now().Add(time.Duration(canaryRateBurstSecs) * time.Second)
+	for i := 0; i < 60; i++ {
+		now = now.Add(time.Second / time.Duration(Config.CanaryRateLimit))
+		if !canaryRateAllow(now) {
+			t.Fatalf("event %d at the limited rate was refused", i)
+		}
+	}
+}
+
+func TestCanaryAnonymizesSlackButNotRecords(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved; last = nil; device = nil }()
+	var received []string
+	webhook := slackTestWebhook(t, http.StatusOK, &received)
+	defer webhook.Close()
+	Config.SlackWebhookURL = webhook.URL
+	Config.SlackStandbyWebhookURL = ""
+	Config.CanaryRules = nil
+	Config.CanaryDeviceTags = nil
+	Config.CanaryAnonymizeDevices = true
+	last = nil
+	device = nil
+
+	// A device that drops an event
+	const uid = "dev:864475044204278"
+	now := time.Date(2022, time.March, 1, 12, 0, 0, 0, time.UTC)
+	canaryProcessEvent(note.Event{DeviceUID: uid, DeviceSN: "canary", NotefileID: "_session.qo", SessionUID: "s1"}, now)
+	errstr := ""
+	for i, count := range []float64{1, 2, 3, 5} {
+		e := canaryTestEvent("s1", count, now.Add(time.Duration(i)*time.Minute))
+		e.DeviceUID = uid
+		_, errstr, _ = canaryProcessEvent(e, now.Add(time.Duration(i)*time.Minute+time.Second))
+	}
+	if errstr == "" {
+		t.Fatalf("dropped event wasn't detected")
+	}
+	canaryMessage(uid, "canary", errstr)
+
+	// Slack sees only the stand-in, which is stable so that it can be correlated
+	if len(received) != 1 {
+		t.Fatalf("%d messages posted, want 1", len(received))
+	}
+	if strings.Contains(received[0], uid) || !strings.Contains(received[0], canaryAnonymizedUID(uid)) {
+		t.Errorf("message not anonymized: %q", received[0])
+	}
+	if canaryAnonymizedUID(uid) == canaryAnonymizedUID("dev:1") {
+		t.Errorf("stand-in isn't distinct")
+	}
+
+	// What we keep internally, and what we tag metrics with, is the full UID
+	canaryLock.Lock()
+	_, present := last[uid]
+	canaryLock.Unlock()
+	if !present {
+		t.Errorf("device isn't recorded by its full UID")
+	}
+	tags := canaryDatadogTags(note.Event{DeviceUID: uid, DeviceSN: "canary"})
+	if len(tags) == 0 || tags[0] != "device:"+uid {
+		t.Errorf("DataDog tags %v, want the full UID", tags)
+	}
+}
+
+func TestCanaryMalformedBodies(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved; last = nil; device = nil }()
+	Config.CanaryRules = nil
+	last = nil
+	device = map[string]deviceContext{}
+
+	now := time.Date(2022, time.March, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		notefileID string
+		body       *map[string]interface{}
+		recorded   bool
+	}{
+		{"session without a body", "_session.qo", nil, false},
+		{"session without a reason", "_session.qo", &map[string]interface{}{}, false},
+		{"session with a numeric reason", "_session.qo", &map[string]interface{}{"why": 7}, false},
+		{"event without a count", "_temp.qo", &map[string]interface{}{}, false},
+		{"event with a string count", "_temp.qo", &map[string]interface{}{"count": "12"}, false},
+		{"event with a null count", "_temp.qo", &map[string]interface{}{"count": nil}, false},
+		{"event with an object count", "_temp.qo", &map[string]interface{}{"count": map[string]interface{}{}}, false},
+		{"well-formed event", "_temp.qo", &map[string]interface{}{"count": float64(1)}, true},
+	}
+	for i, tt := range tests {
+		uid := fmt.Sprintf("dev:%d", i)
+		e := note.Event{DeviceUID: uid, DeviceSN: "canary", NotefileID: tt.notefileID, SessionUID: "s1", Received: float64(now.Unix()), Body: tt.body}
+
+		// The device's session is already known, so that its reason is examined
+		device[uid] = deviceContext{sn: "canary"}
+
+		_, errstr, _ := canaryProcessEvent(e, now.Add(time.Second))
+		if errstr != "" {
+			t.Errorf("%s: alerted %q", tt.name, errstr)
+		}
+		if _, present := last[uid]; present != tt.recorded {
+			t.Errorf("%s: recorded %t, want %t", tt.name, present, tt.recorded)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Serves the health of our own pipelines
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// The health of the watcher
+type healthResponse struct {
+	Status          string `json:"status,omitempty"`
+	Datadog         string `json:"datadog,omitempty"`
+	DatadogFailures int    `json:"datadog_failures,omitempty"`
+}
+
+// Health handler
+func inboundWebHealthzHandler(httpRsp http.ResponseWriter, httpReq *http.Request) {
+
+	r := healthResponse{Status: "ok", Datadog: "ok"}
+	switch {
+	case Config.DatadogAPIKey == "":
+		r.Datadog = "disabled"
+	case datadogPaused.Load():
+		r.Datadog = "paused"
+	}
+	degraded, failures := datadogHealth()
+	r.DatadogFailures = failures
+	if degraded {
+		r.Status = "degraded"
+		r.Datadog = "failing"
+	}
+
+	// Done
+	rspJSON, _ := json.Marshal(r)
+	httpRsp.Header().Set("Content-Type", "application/json")
+	httpRsp.Write(rspJSON)
+
+}
@@ -0,0 +1,84 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Aggregated stats over a recent window, for external tools
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Bounds on the window that may be requested, which can be no longer than the stats held in memory
+const statsWindowMinSecs = 60
+const statsWindowMaxSecs = statsWindowSecs
+
+// Parse a relative "ago" expression such as 30m, 2h, or 1d into seconds
+func statsParseSince(since string) (secs int64, err error) {
+	if len(since) < 2 {
+		err = fmt.Errorf("since must be a number followed by m, h, or d")
+		return
+	}
+	n, err := strconv.ParseInt(since[:len(since)-1], 10, 64)
+	if err != nil || n <= 0 {
+		err = fmt.Errorf("since must be a positive number followed by m, h, or d")
+		return
+	}
+	switch since[len(since)-1] {
+	case 'm':
+		secs = n * 60
+	case 'h':
+		secs = n * 60 * 60
+	case 'd':
+		secs = n * secs1Day
+	default:
+		err = fmt.Errorf("since must be a number followed by m, h, or d")
+		return
+	}
+	if secs < statsWindowMinSecs || secs > statsWindowMaxSecs {
+		err = fmt.Errorf("since must be between %dm and %dd", statsWindowMinSecs/60, statsWindowMaxSecs/secs1Day)
+	}
+	return
+}
+
+// Stats handler, returning the host's stats aggregated across its instances for the window
+func inboundWebStatsHandler(httpRsp http.ResponseWriter, httpReq *http.Request) {
+
+	// Validate the request
+	hostname := httpReq.URL.Query().Get("host")
+	if hostname == "" {
+		http.Error(httpRsp, "host is required", http.StatusBadRequest)
+		return
+	}
+	since := httpReq.URL.Query().Get("since")
+	if since == "" {
+		since = "1h"
+	}
+	secs, err := statsParseSince(since)
+	if err != nil {
+		http.Error(httpRsp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Extract the window
+	now := time.Now().UTC().Unix()
+	hs, exists := statsExtract(hostname, now-secs, secs+1)
+	if !exists {
+		http.Error(httpRsp, "no stats loaded for host", http.StatusNotFound)
+		return
+	}
+	aggregatedStats := []AggregatedStat{}
+	if hs.BucketMins != 0 {
+		aggregatedStats = append(aggregatedStats, statsAggregate(hs.Stats, hs.BucketMins*60)...)
+	}
+
+	// Done
+	rspJSON, _ := json.Marshal(aggregatedStats)
+	httpRsp.Header().Set("Content-Type", "application/json")
+	httpRsp.Write(rspJSON)
+
+}
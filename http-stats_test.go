@@ -0,0 +1,35 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestStatsParseSince(t *testing.T) {
+	tests := []struct {
+		since   string
+		want    int64
+		wantErr bool
+	}{
+		{"30m", 30 * 60, false},
+		{"2h", 2 * 60 * 60, false},
+		{"2d", 2 * secs1Day, false},
+		{"48h", 48 * 60 * 60, false},
+		{"49h", 0, true},
+		{"7d", 0, true},
+		{"0m", 0, true},
+		{"1s", 0, true},
+		{"m", 0, true},
+	}
+	for _, tt := range tests {
+		secs, err := statsParseSince(tt.since)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err %v, wantErr %v", tt.since, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && secs != tt.want {
+			t.Errorf("%s: %d secs, want %d", tt.since, secs, tt.want)
+		}
+	}
+}
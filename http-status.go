@@ -0,0 +1,92 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Serves a simple read-only status page
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"time"
+)
+
+// How often the status page refreshes itself
+const statusRefreshSecs = 60
+
+// The status of a single host, as shown on the status page
+type hostStatus struct {
+	name          string
+	state         string
+	version       string
+	instances     int
+	statsAgeMins  int64
+	statsLoaded   bool
+	eventsPending int64
+}
+
+// Status page handler
+func inboundWebStatusHandler(httpRsp http.ResponseWriter, httpReq *http.Request) {
+
+	now := time.Now().UTC()
+
+	// Generate the page
+	response := "<html><head>\n"
+	response += fmt.Sprintf("<meta http-equiv=\"refresh\" content=\"%d\">\n", statusRefreshSecs)
+	response += "<title>notehub status</title>\n"
+	response += "<style>body{font-family:sans-serif} td,th{padding:4px 12px;text-align:left}" +
+		" .up{color:green} .down{color:red} .unknown{color:gray}</style>\n"
+	response += "</head><body>\n"
+	response += "<table>\n"
+	response += "<tr><th>host</th><th>state</th><th>version</th><th>instances</th><th>stats age</th><th>events pending</th></tr>\n"
+	for _, host := range Config.MonitoredHosts {
+		if host.Disabled {
+			continue
+		}
+		s := statusOfHost(host.Name, now)
+		age := "-"
+		if s.statsLoaded {
+			age = fmt.Sprintf("%d mins", s.statsAgeMins)
+		}
+		response += fmt.Sprintf("<tr><td>%s</td><td class=\"%s\">%s</td><td>%s</td><td>%d</td><td>%s</td><td>%d</td></tr>\n",
+			html.EscapeString(s.name), s.state, s.state, html.EscapeString(s.version), s.instances, age, s.eventsPending)
+	}
+	response += "</table>\n"
+	response += fmt.Sprintf("<p>as of %s UTC</p>\n", now.Format("2006-01-02 15:04:05"))
+	response += "</body></html>\n"
+
+	httpRsp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	httpRsp.Write([]byte(response))
+
+}
+
+// Get the status of a host from what we last learned of it in memory
+func statusOfHost(hostname string, now time.Time) (s hostStatus) {
+	s.name = hostname
+
+	// Whether the host responded to its most recent ping
+	serviceLock.Lock()
+	s.state = "unknown"
+	if ping, present := lastServicePings[hostname]; present {
+		if ping.err == nil || errors.Is(ping.err, errNoHandlers) {
+			s.state = "up"
+		} else {
+			s.state = "down"
+		}
+	}
+	s.version = lastServiceVersions[hostname]
+	s.instances = len(lastServiceHandlers[hostname])
+	serviceLock.Unlock()
+
+	// The age of its stats, and the events pending in their most recent bucket, from the summary
+	// of its stats so that the page isn't held up by a poll that is in progress
+	if summary, exists := statsGetSummary(hostname); exists {
+		s.statsLoaded = true
+		s.statsAgeMins = (now.Unix() - summary.statsTime) / 60
+		s.eventsPending = summary.eventsPending
+	}
+
+	return
+}
@@ -16,9 +16,15 @@ func HTTPInboundHandler(port string) {
 	// Topics
 	http.HandleFunc("/github", inboundWebGithubHandler)
 	http.HandleFunc("/watcher", inboundWebSlackRequestHandler)
+	http.HandleFunc("/watcher/action", inboundWebSlackActionHandler)
 	http.HandleFunc("/ping", inboundWebPingHandler)
+	http.HandleFunc("/healthz", inboundWebHealthzHandler)
 	http.HandleFunc("/canary", inboundWebCanaryHandler)
+	http.HandleFunc("/archive", inboundWebArchiveHandler)
+	http.HandleFunc("/stats", inboundWebStatsHandler)
+	http.HandleFunc("/status", inboundWebStatusHandler)
 	http.HandleFunc(sheetRoute, inboundWebSheetHandler)
+	http.HandleFunc(sheetListRoute, inboundWebSheetListHandler)
 	http.HandleFunc("/", inboundWebRootHandler)
 
 	// HTTP
@@ -0,0 +1,140 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Write new stats to InfluxDB using its line protocol, as the same aggregated metrics that are
+// uploaded to DataDog.  Each bucket is written as a single point of the "notehub" measurement,
+// tagged with the host, with a field for each metric.
+func influxUploadStats(hostname string, bucketSecs int64, addedStats map[string][]StatsStat) (err error) {
+
+	// Exit if InfluxDB isn't configured
+	if Config.InfluxURL == "" || Config.InfluxBucket == "" {
+		return
+	}
+
+	// Generate the list of aggregated stats
+	aggregatedStats := statsAggregate(addedStats, bucketSecs)
+	if len(aggregatedStats) == 0 {
+		return
+	}
+
+	// Generate a line for each bucket
+	var lines bytes.Buffer
+	influxAppendLines(&lines, "notehub,host="+influxEscape(hostname), aggregatedStats)
+
+	// Optionally the same for each service type, as a separate measurement so that the
+	// service types aren't counted twice when summing the host's points
+	if Config.StatsByServiceType {
+		for serviceType, typeStats := range statsAggregateBy(addedStats, bucketSecs, statsServiceType) {
+			influxAppendLines(&lines, "notehub_service,host="+influxEscape(hostname)+",service="+influxEscape(serviceType), typeStats)
+		}
+	}
+	if lines.Len() == 0 {
+		return
+	}
+
+	// Write them
+	err = influxWrite(lines.Bytes())
+	if err != nil {
+		fmt.Printf("influx: error writing metrics: %s\n", err)
+	}
+
+	// Done
+	return
+
+}
+
+// Append a line for each bucket of aggregated stats, old-to-new, with the specified measurement and tags
+func influxAppendLines(lines *bytes.Buffer, measurement string, aggregatedStats []AggregatedStat) {
+
+	sort.Sort(statOccurrence(aggregatedStats))
+	for _, stat := range aggregatedStats {
+		fields := []string{}
+		for _, m := range datadogMetrics {
+			if datadogMetricEnabled(m.suffix) {
+				fields = append(fields, influxEscape(m.suffix)+"="+strconv.FormatFloat(m.value(stat), 'f', -1, 64))
+			}
+		}
+		for _, m := range datadogNoteboardMetrics {
+			if v := m.value(stat); v != 0 && datadogMetricEnabled(m.suffix) {
+				fields = append(fields, influxEscape(m.suffix)+"="+strconv.FormatFloat(v, 'f', -1, 64))
+			}
+		}
+		cacheKeys := []string{}
+		for k := range stat.Caches {
+			cacheKeys = append(cacheKeys, k)
+		}
+		sort.Strings(cacheKeys)
+		for _, k := range cacheKeys {
+			suffix := "cache." + k + ".hitrate"
+			if rate, ok := cacheHitRate(stat.Caches[k]); ok && datadogMetricEnabled(suffix) {
+				fields = append(fields, influxEscape(suffix)+"="+strconv.FormatFloat(rate, 'f', -1, 64))
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		lines.WriteString(fmt.Sprintf("%s %s %d\n", measurement, strings.Join(fields, ","), stat.Time))
+	}
+
+}
+
+// Escape a tag value or field key for the line protocol
+func influxEscape(s string) string {
+	return strings.NewReplacer(",", "\\,", "=", "\\=", " ", "\\ ").Replace(s)
+}
+
+// Write lines, timestamped in seconds, to the configured InfluxDB bucket
+func influxWrite(lines []byte) (err error) {
+
+	ctx, cancel := context.WithTimeout(shutdownContext, time.Second*time.Duration(30))
+	defer cancel()
+
+	params := url.Values{}
+	params.Set("bucket", Config.InfluxBucket)
+	params.Set("precision", "s")
+	if Config.InfluxOrg != "" {
+		params.Set("org", Config.InfluxOrg)
+	}
+	writeURL := strings.TrimSuffix(Config.InfluxURL, "/") + "/api/v2/write?" + params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", writeURL, bytes.NewReader(lines))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if Config.InfluxToken != "" {
+		req.Header.Set("Authorization", "Token "+Config.InfluxToken)
+	}
+
+	httpclient := &http.Client{}
+	rsp, err := httpclient.Do(req)
+	if err != nil {
+		return
+	}
+	defer rsp.Body.Close()
+
+	// A successful write has no content
+	if rsp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(rsp.Body)
+		err = fmt.Errorf("%s: %s", rsp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return
+
+}
@@ -66,7 +66,7 @@ func inputHandler() {
 		switch arg0LC {
 
 		case "slack":
-			slackSendMessage(messageAfterFirstWord)
+			slackPostMessage(Config.SlackWebhookURL, messageAfterFirstWord)
 
 		case "stats":
 			statsMaintainNow.Signal()
@@ -5,7 +5,15 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -15,32 +23,154 @@ const configDataDirectoryBase = "/data/"
 // Fully-resolved data directory
 var configDataDirectory = ""
 
+// Context that is cancelled on shutdown, so that outbound requests abort promptly
+var shutdownContext = context.Background()
+
+// Uploads and notifications done in the background, which are waited for before exiting
+var backgroundWork sync.WaitGroup
+
+// Do something in the background, tracking it so that it can be waited for
+func goBackground(f func()) {
+	backgroundWork.Add(1)
+	go func() {
+		defer backgroundWork.Done()
+		f()
+	}()
+}
+
 // Main service entry point
 func main() {
 
+	// Cancel outbound requests when we're asked to shut down
+	var stop context.CancelFunc
+	shutdownContext, stop = signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Parse the command line
+	flag.StringVar(&configPathFlag, "config", "", "path of the config file")
+	var selftest bool
+	flag.BoolVar(&selftest, "selftest", false, "check connectivity to each host, S3, and DataDog, then exit")
+	var once bool
+	flag.BoolVar(&once, "once", false, "update, save, and upload the stats of each host once, then exit")
+	var canaryReplayPath string
+	flag.StringVar(&canaryReplayPath, "canary-replay", "", "replay a file of captured canary events, one per line, printing any alerts, then exit")
+	flag.Parse()
+
 	// Read creds
 	ServiceReadConfig()
 
-	// Compute folder location
+	// Compute folder location, and make sure that it's usable before doing anything else
 	configDataDirectory = os.Getenv("HOME") + configDataDirectoryBase
-	_ = configDataDirectory
+	if Config.DataDirectory != "" {
+		configDataDirectory = strings.TrimSuffix(Config.DataDirectory, "/") + "/"
+	}
+	err := dataDirectoryInit(configDataDirectory)
+	if err != nil {
+		fmt.Printf("data directory %s is not usable: %s\n", configDataDirectory, err)
+		os.Exit(-1)
+	}
+
+	// Restore whether DataDog uploads were paused
+	datadogLoadPaused()
+
+	// If just testing, do so and exit
+	if selftest {
+		if !selftestAllHosts() {
+			os.Exit(-1)
+		}
+		return
+	}
+
+	// If replaying canary events, do so and exit
+	if canaryReplayPath != "" {
+		alerts, err := canaryReplay(canaryReplayPath)
+		if err != nil {
+			fmt.Printf("canary replay: %s\n", err)
+			os.Exit(-1)
+		}
+		fmt.Printf("canary replay: %d alerts\n", alerts)
+		return
+	}
+
+	// If running a single cycle, do so and exit
+	if once {
+		failed := statsOnce()
+		if failed > 0 {
+			fmt.Printf("%d failures\n", failed)
+			os.Exit(-1)
+		}
+		return
+	}
 
 	// Spawn the stats maintenance task
 	go statsMaintainer()
 
+	// Spawn the task that retries failed S3 uploads
+	go s3Retrier()
+
+	// Spawn the task that rolls up daily S3 archives into monthly archives
+	go rollupMaintainer()
+
+	// Spawn the task that posts the daily digest
+	go digestMaintainer()
+
+	// Spawn the task that sends what was held during quiet hours
+	go quietMaintainer()
+
 	// Spawn the availability task
 	go pingWatcher()
 
+	// Spawn the synthetic probe task
+	go probeWatcher()
+
 	// Spawn the console input handler
 	go inputHandler()
 
 	// Init our web request inbound server
 	go HTTPInboundHandler(":80")
 
-	// Housekeeping
+	// Housekeeping, until we're asked to shut down
 	for {
-		time.Sleep(1 * time.Minute)
-		canarySweepDevices()
+		select {
+		case <-shutdownContext.Done():
+			fmt.Printf("shutting down\n")
+			return
+		case <-time.After(1 * time.Minute):
+			canarySweepDevices()
+		}
 	}
 
 }
+
+// Create the data directory if it doesn't exist, and verify that we can write to it
+func dataDirectoryInit(dir string) (err error) {
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return
+	}
+
+	// Write a file and read it back
+	f, err := os.CreateTemp(dir, "selftest-*")
+	if err != nil {
+		return
+	}
+	filename := f.Name()
+	defer os.Remove(filename)
+	written := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+	_, err = f.Write(written)
+	f.Close()
+	if err != nil {
+		return
+	}
+	read, err := os.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(read, written) {
+		err = fmt.Errorf("self-test file read back differently than it was written")
+	}
+
+	return
+
+}
@@ -99,12 +99,16 @@ type StatsCache struct {
 	Invalidations int64 `json:"invalidations,omitempty"`
 	Entries       int64 `json:"entries,omitempty"`
 	EntriesHWM    int64 `json:"hwm,omitempty"`
+	Hits          int64 `json:"hits,omitempty"`
+	Misses        int64 `json:"misses,omitempty"`
+	Resets        int64 `json:"resets,omitempty"`
 }
 
 // StatsStat is the data structure of a single running statistics batch
 type StatsStat struct {
 
-	// These fields are present only in the first 'live' stat, NOT inside every single stat
+	// These fields are present only in the first 'live' stat, NOT inside every single stat,
+	// except that we record the instance's boot time with each of its buckets
 	ServiceVersion       string `json:"service_version,omitempty"`
 	LegacyServiceVersion int64  `json:"started,omitempty"`
 	NodeStarted          int64  `json:"node_started,omitempty"`
@@ -131,6 +135,9 @@ type StatsStat struct {
 	EventsEnqueued                  int64                    `json:"events_enqueued,omitempty"`
 	EventsDequeued                  int64                    `json:"events_dequeued,omitempty"`
 	EventsRouted                    int64                    `json:"events_routed,omitempty"`
+	EventsPending                   int64                    `json:"events_pending,omitempty"`
+	BoardsActive                    int64                    `json:"boards_active,omitempty"`
+	WebsocketsActive                int64                    `json:"websockets_active,omitempty"`
 	Handlers                        map[string]StatsHandler  `json:"handlers,omitempty"`
 	Databases                       map[string]StatsDatabase `json:"databases,omitempty"`
 	Caches                          map[string]StatsCache    `json:"caches,omitempty"`
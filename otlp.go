@@ -0,0 +1,214 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The subset of the OTLP metrics data model that we export, encoded as JSON for OTLP/HTTP
+// so that no collector-specific client library is needed.  Collectors accepting only gRPC
+// aren't supported.
+type otlpExport struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+type otlpScope struct {
+	Name string `json:"name"`
+}
+type otlpMetric struct {
+	Name  string    `json:"name"`
+	Gauge otlpGauge `json:"gauge"`
+}
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+type otlpDataPoint struct {
+	TimeUnixNano string          `json:"timeUnixNano"`
+	AsDouble     float64         `json:"asDouble"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+}
+type otlpAttribute struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// Export new stats to an OTLP collector, as the same aggregated metrics that are uploaded to
+// DataDog.  Rather than embedding the host in each metric's name, as is done for DataDog, the
+// host is an attribute of the resource, so that metrics are named notehub.<metric>.
+func otlpUploadStats(hostname string, bucketSecs int64, addedStats map[string][]StatsStat) (err error) {
+
+	// Exit if OTLP isn't configured
+	if Config.OTLPEndpoint == "" {
+		return
+	}
+
+	// Generate the list of aggregated stats
+	aggregatedStats := statsAggregate(addedStats, bucketSecs)
+	if len(aggregatedStats) == 0 {
+		return
+	}
+
+	// Generate a gauge for each metric, optionally along with one for each service type
+	metrics := otlpMetrics("notehub.", aggregatedStats)
+	if Config.StatsByServiceType {
+		byServiceType := statsAggregateBy(addedStats, bucketSecs, statsServiceType)
+		serviceTypes := []string{}
+		for serviceType := range byServiceType {
+			serviceTypes = append(serviceTypes, serviceType)
+		}
+		sort.Strings(serviceTypes)
+		for _, serviceType := range serviceTypes {
+			metrics = append(metrics, otlpMetrics("notehub."+serviceType+".", byServiceType[serviceType])...)
+		}
+	}
+	if len(metrics) == 0 {
+		return
+	}
+
+	// Export them
+	export := otlpExport{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			{Key: "service.name", Value: otlpAnyValue{StringValue: "notehub-watch"}},
+			{Key: "host.name", Value: otlpAnyValue{StringValue: hostname}},
+		}},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   otlpScope{Name: "notehub-watch"},
+			Metrics: metrics,
+		}},
+	}}}
+	err = otlpExportMetrics(export)
+	if err != nil {
+		fmt.Printf("otlp: error exporting metrics: %s\n", err)
+	}
+
+	// Done
+	return
+
+}
+
+// Generate a gauge for each metric, named with the specified prefix, with a data point for each bucket
+func otlpMetrics(prefix string, aggregatedStats []AggregatedStat) (metrics []otlpMetric) {
+
+	// Sort stats as old-to-new
+	sort.Sort(statOccurrence(aggregatedStats))
+
+	addMetric := func(suffix string, value func(stat AggregatedStat) (float64, bool)) {
+		if !datadogMetricEnabled(suffix) {
+			return
+		}
+		m := otlpMetric{Name: prefix + suffix}
+		for _, stat := range aggregatedStats {
+			if v, ok := value(stat); ok {
+				m.Gauge.DataPoints = append(m.Gauge.DataPoints, otlpDataPoint{
+					TimeUnixNano: strconv.FormatInt(stat.Time*int64(time.Second), 10),
+					AsDouble:     v,
+				})
+			}
+		}
+		if len(m.Gauge.DataPoints) > 0 {
+			metrics = append(metrics, m)
+		}
+	}
+	for _, m := range datadogMetrics {
+		value := m.value
+		addMetric(m.suffix, func(stat AggregatedStat) (float64, bool) { return value(stat), true })
+	}
+	for _, m := range datadogNoteboardMetrics {
+		value := m.value
+		addMetric(m.suffix, func(stat AggregatedStat) (float64, bool) { v := value(stat); return v, v != 0 })
+	}
+	cacheKeys := map[string]bool{}
+	for _, stat := range aggregatedStats {
+		for k := range stat.Caches {
+			cacheKeys[k] = true
+		}
+	}
+	sortedCacheKeys := []string{}
+	for k := range cacheKeys {
+		sortedCacheKeys = append(sortedCacheKeys, k)
+	}
+	sort.Strings(sortedCacheKeys)
+	for _, k := range sortedCacheKeys {
+		key := k
+		addMetric("cache."+key+".hitrate", func(stat AggregatedStat) (float64, bool) { return cacheHitRate(stat.Caches[key]) })
+	}
+
+	return
+
+}
+
+// Post metrics to the configured collector's OTLP/HTTP metrics endpoint
+func otlpExportMetrics(export otlpExport) (err error) {
+
+	body, err := json.Marshal(export)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(shutdownContext, time.Second*time.Duration(30))
+	defer cancel()
+
+	exportURL := strings.TrimSuffix(Config.OTLPEndpoint, "/")
+	if !strings.HasSuffix(exportURL, "/v1/metrics") {
+		exportURL += "/v1/metrics"
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", exportURL, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range Config.OTLPHeaders {
+		req.Header.Set(k, v)
+	}
+
+	httpclient := &http.Client{}
+	rsp, err := httpclient.Do(req)
+	if err != nil {
+		return
+	}
+	defer rsp.Body.Close()
+
+	// A partial success is reported in the body of a successful response
+	rspBody, _ := io.ReadAll(rsp.Body)
+	if rsp.StatusCode/100 != 2 {
+		err = fmt.Errorf("%s: %s", rsp.Status, strings.TrimSpace(string(rspBody)))
+		return
+	}
+	var partial struct {
+		PartialSuccess struct {
+			RejectedDataPoints string `json:"rejectedDataPoints"`
+			ErrorMessage       string `json:"errorMessage"`
+		} `json:"partialSuccess"`
+	}
+	if json.Unmarshal(rspBody, &partial) == nil && partial.PartialSuccess.ErrorMessage != "" {
+		err = fmt.Errorf("%s data points rejected: %s", partial.PartialSuccess.RejectedDataPoints, partial.PartialSuccess.ErrorMessage)
+	}
+
+	return
+
+}
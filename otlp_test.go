@@ -0,0 +1,101 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOTLPUploadStatsToCollector(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved }()
+
+	// A collector that records what's exported to it, failing if specified
+	var exports []otlpExport
+	var paths, auths []string
+	status := http.StatusOK
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var export otlpExport
+		if err := json.NewDecoder(r.Body).Decode(&export); err != nil {
+			t.Errorf("malformed export: %s", err)
+		}
+		exports = append(exports, export)
+		paths = append(paths, r.URL.Path)
+		auths = append(auths, r.Header.Get("Authorization"))
+		w.WriteHeader(status)
+	}))
+	defer collector.Close()
+	Config.OTLPEndpoint = collector.URL
+	Config.OTLPHeaders = map[string]string{"Authorization": "Bearer token"}
+	Config.StatsByServiceType = false
+	Config.DatadogMetricsAllowed = []string{"disk.reads"}
+	Config.DatadogMetricsDenied = nil
+
+	const bucketSecs = 300
+	const newest = 1646093100
+	addedStats := map[string][]StatsStat{
+		"n1:handler": {{SnapshotTaken: newest, OSDiskRead: 3}, {SnapshotTaken: newest - bucketSecs, OSDiskRead: 1}},
+		"n2:handler": {{SnapshotTaken: newest, OSDiskRead: 4}, {SnapshotTaken: newest - bucketSecs, OSDiskRead: 2}},
+	}
+	err := otlpUploadStats("prod", bucketSecs, addedStats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exports) != 1 {
+		t.Fatalf("%d exports, want 1", len(exports))
+	}
+	if paths[0] != "/v1/metrics" || auths[0] != "Bearer token" {
+		t.Errorf("exported to %s with authorization %q", paths[0], auths[0])
+	}
+
+	// The host is an attribute of the resource rather than part of the metric's name
+	rm := exports[0].ResourceMetrics
+	if len(rm) != 1 || len(rm[0].ScopeMetrics) != 1 {
+		t.Fatalf("unexpected export shape: %+v", exports[0])
+	}
+	host := ""
+	for _, a := range rm[0].Resource.Attributes {
+		if a.Key == "host.name" {
+			host = a.Value.StringValue
+		}
+	}
+	if host != "prod" {
+		t.Errorf("host.name %q, want prod", host)
+	}
+
+	// Only the allowed metric is exported, with a data point for each bucket, old to new
+	metrics := rm[0].ScopeMetrics[0].Metrics
+	if len(metrics) != 1 || metrics[0].Name != "notehub.disk.reads" {
+		t.Fatalf("metrics %+v, want only notehub.disk.reads", metrics)
+	}
+	points := metrics[0].Gauge.DataPoints
+	want := []otlpDataPoint{
+		{TimeUnixNano: "1646092800000000000", AsDouble: 3},
+		{TimeUnixNano: "1646093100000000000", AsDouble: 7},
+	}
+	if len(points) != len(want) {
+		t.Fatalf("data points %+v, want %+v", points, want)
+	}
+	for i := range want {
+		if points[i].TimeUnixNano != want[i].TimeUnixNano || points[i].AsDouble != want[i].AsDouble {
+			t.Errorf("data point %d is %+v, want %+v", i, points[i], want[i])
+		}
+	}
+
+	// A collector's failure is reported
+	status = http.StatusServiceUnavailable
+	if err = otlpUploadStats("prod", bucketSecs, addedStats); err == nil {
+		t.Errorf("collector failure wasn't reported")
+	}
+
+	// Nothing is exported when no endpoint is configured
+	Config.OTLPEndpoint = ""
+	if err = otlpUploadStats("prod", bucketSecs, addedStats); err != nil || len(exports) != 2 {
+		t.Errorf("exported without an endpoint")
+	}
+}
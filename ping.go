@@ -6,9 +6,34 @@ package main
 
 import (
 	"fmt"
+	"math/rand"
+	"sync"
 	"time"
 )
 
+// Maximum random delay between polls if unspecified
+const pollJitterSecsDefault = 10
+
+// Source of the random delays, seeded so that separate watchers don't share the same sequence
+var pollJitterLock sync.Mutex
+var pollJitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// Get a random delay, up to the configured maximum, used to keep the polls of our hosts from
+// being synchronized.  Stats buckets are aligned by the times at which the instances took their
+// snapshots rather than by when we poll them, so jittered polls don't affect bucket alignment.
+func pollJitter() time.Duration {
+	maxSecs := Config.PollJitterSecs
+	if maxSecs == 0 {
+		maxSecs = pollJitterSecsDefault
+	}
+	if maxSecs < 0 {
+		return 0
+	}
+	pollJitterLock.Lock()
+	defer pollJitterLock.Unlock()
+	return time.Duration(pollJitterRand.Int63n(int64(maxSecs) * int64(time.Second)))
+}
+
 // Ping hosts for up/down notification
 func pingWatcher() {
 
@@ -18,6 +43,7 @@ func pingWatcher() {
 		// Get the service instances for the service, sending slack messages if anything changed
 		for _, host := range Config.MonitoredHosts {
 			if !host.Disabled {
+				time.Sleep(pollJitter())
 				_, _, _, _, _, err := watcherGetServiceInstances(host.Name, host.Addr)
 				if err != nil {
 					fmt.Printf("%s: ping: %s\n", host.Name, err)
@@ -26,7 +52,7 @@ func pingWatcher() {
 		}
 
 		// Sleep
-		time.Sleep(time.Duration(1) * time.Minute)
+		time.Sleep(time.Duration(1)*time.Minute + pollJitter())
 
 	}
 
@@ -0,0 +1,114 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The outcome of recent pings of each service instance, by SIID, so that an instance
+// that intermittently fails while its siblings succeed can be noticed
+const pingWindowDefault = 20
+const pingErrorRateDefault = 0.2
+
+var pingLock sync.Mutex
+var pingResults map[string][]bool
+var pingAlerted map[string]bool
+
+// Record the outcome of pinging a service instance
+func pingRecordResult(siid string, success bool) {
+	pingLock.Lock()
+	defer pingLock.Unlock()
+	if pingResults == nil {
+		pingResults = map[string][]bool{}
+	}
+	window := Config.PingErrorWindow
+	if window <= 0 {
+		window = pingWindowDefault
+	}
+	results := append(pingResults[siid], success)
+	if len(results) > window {
+		results = results[len(results)-window:]
+	}
+	pingResults[siid] = results
+}
+
+// Get the fraction of a service instance's recent pings that failed, and how many pings that is out of
+func pingErrorRate(siid string) (rate float64, pings int) {
+	pingLock.Lock()
+	defer pingLock.Unlock()
+	failures := 0
+	for _, success := range pingResults[siid] {
+		if !success {
+			failures++
+		}
+	}
+	pings = len(pingResults[siid])
+	if pings > 0 {
+		rate = float64(failures) / float64(pings)
+	}
+	return
+}
+
+// Report the ping error rate of each of the host's instances, alerting on those whose error rate
+// is above the threshold while the host's other instances are below it.  When all of them fail,
+// it's the host rather than the instance that's the problem.
+func pingCheckErrorRates(hostname string, serviceInstanceIDs []string) {
+
+	threshold := Config.PingErrorRate
+	if threshold <= 0 {
+		threshold = pingErrorRateDefault
+	}
+
+	rates := map[string]float64{}
+	degraded := []string{}
+	for _, siid := range serviceInstanceIDs {
+		rate, pings := pingErrorRate(siid)
+		if pings == 0 {
+			continue
+		}
+		rates[siid] = rate
+		datadogSubmitGaugeAsync("notehub."+hostname+".instance.ping_error_rate", rate, []string{"siid:" + siid})
+		if rate > threshold {
+			degraded = append(degraded, siid)
+		}
+	}
+	sort.Strings(degraded)
+
+	pingLock.Lock()
+	if pingAlerted == nil {
+		pingAlerted = map[string]bool{}
+	}
+	hostHealthy := len(degraded) < len(rates)
+	for siid, rate := range rates {
+		if rate <= threshold {
+			pingAlerted[siid] = false
+		}
+	}
+	alerts := []string{}
+	for _, siid := range degraded {
+		if !hostHealthy || pingAlerted[siid] {
+			continue
+		}
+		pingAlerted[siid] = true
+		alerts = append(alerts, fmt.Sprintf("%s: %s failed %.0f%% of recent pings while its siblings are healthy",
+			hostname, strings.TrimSuffix(siid, ":notehandler-tcp"), rates[siid]*100))
+	}
+	pingLock.Unlock()
+
+	for _, alert := range alerts {
+		slackSendAlert(alert)
+	}
+
+}
+
+// Describe a service instance's recent ping error rate
+func pingErrorRateStr(siid string) string {
+	rate, pings := pingErrorRate(siid)
+	return fmt.Sprintf("%.0f%% of %d recent pings failed\n", rate*100, pings)
+}
@@ -0,0 +1,127 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Synthetic probes, which unlike the device canary actively POST a known request to an endpoint
+// and time the round trip, so that we find out when a host is slow to respond before any device
+// does.  Latency is recorded to DataDog, and a breach of a probe's SLA (including a failed
+// request) is alerted once, with a further message when it has recovered.
+
+// Defaults for how often each probe is sent and for its SLA
+const probeIntervalSecsDefault = 60
+const probeSLAMsDefault = 2000
+
+// Probes currently in breach of their SLA, by name
+var probeBreached = map[string]bool{}
+
+// Periodically send each probe
+func probeWatcher() {
+
+	lastSent := map[string]time.Time{}
+	for {
+		select {
+		case <-shutdownContext.Done():
+			return
+		case <-time.After(time.Second * time.Duration(10)):
+		}
+
+		now := time.Now()
+		for _, p := range Config.Probes {
+			if p.Disabled || p.URL == "" {
+				continue
+			}
+			intervalSecs := p.IntervalSecs
+			if intervalSecs <= 0 {
+				intervalSecs = probeIntervalSecsDefault
+			}
+			if now.Sub(lastSent[p.Name]) < time.Second*time.Duration(intervalSecs) {
+				continue
+			}
+			lastSent[p.Name] = now
+			probeCheck(p)
+		}
+	}
+
+}
+
+// Send a probe, record its latency, and alert if its SLA has been breached or has recovered
+func probeCheck(p Probe) {
+
+	slaMs := p.SLAMs
+	if slaMs <= 0 {
+		slaMs = probeSLAMsDefault
+	}
+
+	latencyMs, err := probeSend(p)
+	if err == nil {
+		err2 := datadogSubmitGauge("notehub.probe.latency", float64(latencyMs), []string{"probe:" + p.Name})
+		if err2 != nil {
+			fmt.Printf("probe: %s: error recording latency: %s\n", p.Name, err2)
+		}
+		if latencyMs > slaMs {
+			err = fmt.Errorf("responded in %dms (SLA %dms)", latencyMs, slaMs)
+		}
+	}
+
+	if err != nil {
+		fmt.Printf("probe: %s: %s\n", p.Name, err)
+		if !probeBreached[p.Name] {
+			probeBreached[p.Name] = true
+			slackSendAlert(fmt.Sprintf("probe %s: %s", p.Name, err))
+		}
+		return
+	}
+	if probeBreached[p.Name] {
+		delete(probeBreached, p.Name)
+		slackSendMessage(fmt.Sprintf("probe %s: recovered, responded in %dms", p.Name, latencyMs))
+	}
+
+}
+
+// POST the probe's payload to its endpoint, returning the round-trip time
+func probeSend(p Probe) (latencyMs int64, err error) {
+
+	ctx, cancel := context.WithTimeout(shutdownContext, time.Second*time.Duration(30))
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.URL, bytes.NewReader(p.Payload))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range p.Headers {
+		req.Header.Set(k, v)
+	}
+
+	httpclient := &http.Client{}
+	began := time.Now()
+	rsp, err := httpclient.Do(req)
+	if err != nil {
+		return
+	}
+	defer rsp.Body.Close()
+
+	// The round trip includes reading the full response
+	_, err = io.Copy(io.Discard, rsp.Body)
+	latencyMs = time.Since(began).Milliseconds()
+	if err != nil {
+		return
+	}
+	if rsp.StatusCode/100 != 2 {
+		err = fmt.Errorf("%s", rsp.Status)
+	}
+
+	return
+
+}
@@ -0,0 +1,154 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Quiet hours, during which routine Slack notifications are held rather than sent, and then sent
+// as a single digest once the quiet hours end.  Critical alerts are always sent immediately.
+// What's held is kept in the data directory so that a restart during quiet hours doesn't lose it.
+
+// File containing the notifications being held, by webhook
+const quietHeldFilename = "quiet-held.json"
+
+// Maximum number of held notifications shown in a digest
+const quietDigestMax = 100
+
+// A notification held during quiet hours
+type quietMessage struct {
+	Time int64  `json:"time,omitempty"`
+	Text string `json:"text,omitempty"`
+}
+
+var quietLock sync.Mutex
+
+// Determine whether quiet hours apply to a webhook at the specified time
+func quietHoursActive(webhookURL string, now time.Time) bool {
+	for _, q := range Config.QuietHours {
+		if q.WebhookURL != "" && q.WebhookURL != webhookURL {
+			continue
+		}
+		if suppressionWindowActive(q.SuppressionWindow, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Hold a routine notification if quiet hours apply, returning true if it was held
+func quietHold(webhookURL string, message string, now time.Time) bool {
+
+	if !quietHoursActive(webhookURL, now) {
+		return false
+	}
+
+	quietLock.Lock()
+	defer quietLock.Unlock()
+	held := quietLoad()
+	held[webhookURL] = append(held[webhookURL], quietMessage{Time: now.UTC().Unix(), Text: message})
+	err := quietSave(held)
+	if err != nil {
+		fmt.Printf("quiet: can't hold message, sending it instead: %s\n", err)
+		return false
+	}
+	return true
+
+}
+
+// Periodically send the digests of those webhooks whose quiet hours have ended
+func quietMaintainer() {
+	for {
+		time.Sleep(time.Duration(1) * time.Minute)
+		quietSendDigests(time.Now())
+	}
+}
+
+// Send a digest of what was held for each webhook whose quiet hours have ended.  What was held
+// for a webhook is only removed once its digest has been posted, so that it's retried if not.
+func quietSendDigests(now time.Time) {
+
+	quietLock.Lock()
+	due := map[string][]quietMessage{}
+	for webhookURL, messages := range quietLoad() {
+		if !quietHoursActive(webhookURL, now) {
+			due[webhookURL] = messages
+		}
+	}
+	quietLock.Unlock()
+
+	for webhookURL, messages := range due {
+		if len(messages) > 0 {
+			err := slackPostMessage(webhookURL, quietDigest(messages))
+			if err != nil {
+				continue
+			}
+		}
+
+		// Remove only what was sent, because more may have been held while posting
+		quietLock.Lock()
+		held := quietLoad()
+		if len(held[webhookURL]) > len(messages) {
+			held[webhookURL] = held[webhookURL][len(messages):]
+		} else {
+			delete(held, webhookURL)
+		}
+		err := quietSave(held)
+		if err != nil {
+			fmt.Printf("quiet: %s\n", err)
+		}
+		quietLock.Unlock()
+	}
+
+}
+
+// Format the held notifications as a single message
+func quietDigest(messages []quietMessage) (digest string) {
+	digest = fmt.Sprintf("%d notifications during quiet hours:\n", len(messages))
+	for i, m := range messages {
+		if i == quietDigestMax {
+			digest += fmt.Sprintf("...and %d more\n", len(messages)-quietDigestMax)
+			break
+		}
+		digest += fmt.Sprintf("%s %s\n", time.Unix(m.Time, 0).UTC().Format("01-02 15:04"), m.Text)
+	}
+	return
+}
+
+// Load the held notifications.  Must be called with quietLock held.
+func quietLoad() (held map[string][]quietMessage) {
+	held = map[string][]quietMessage{}
+	contents, err := os.ReadFile(configDataDirectory + quietHeldFilename)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(contents, &held)
+	if err != nil {
+		fmt.Printf("quiet: discarding unreadable %s: %s\n", quietHeldFilename, err)
+		held = map[string][]quietMessage{}
+	}
+	return
+}
+
+// Save the held notifications, removing the file if there are none.  Must be called with quietLock held.
+func quietSave(held map[string][]quietMessage) (err error) {
+	if len(held) == 0 {
+		err = os.Remove(configDataDirectory + quietHeldFilename)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	contents, err := json.Marshal(held)
+	if err != nil {
+		return
+	}
+	return writeFileAtomically(configDataDirectory+quietHeldFilename, contents, 0600)
+}
@@ -0,0 +1,61 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQuietDigestKeptUntilPosted(t *testing.T) {
+	saved := configDataDirectory
+	savedConfig := Config
+	defer func() { configDataDirectory = saved; Config = savedConfig }()
+	configDataDirectory = t.TempDir() + "/"
+	Config = ServiceConfig{}
+
+	var received []string
+	status := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.URL.Path)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	quietLock.Lock()
+	err := quietSave(map[string][]quietMessage{server.URL: {{Time: now.Unix(), Text: "held"}}})
+	quietLock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed post leaves what was held to be retried
+	quietSendDigests(now)
+	if len(received) != 1 {
+		t.Fatalf("posted %d digests, want 1", len(received))
+	}
+	quietLock.Lock()
+	held := quietLoad()
+	quietLock.Unlock()
+	if len(held[server.URL]) != 1 {
+		t.Fatalf("after a failed post, %d held, want 1", len(held[server.URL]))
+	}
+
+	// A successful post removes it
+	status = http.StatusOK
+	quietSendDigests(now)
+	if len(received) != 2 {
+		t.Fatalf("posted %d digests, want 2", len(received))
+	}
+	quietLock.Lock()
+	held = quietLoad()
+	quietLock.Unlock()
+	if len(held) != 0 {
+		t.Errorf("after a successful post, %d webhooks held, want 0", len(held))
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Comparison of a host's behavior before and after a deploy
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Response to the regression command
+type regressionResponse struct {
+	Host            string             `json:"host,omitempty"`
+	PreviousVersion string             `json:"previous_version,omitempty"`
+	CurrentVersion  string             `json:"current_version,omitempty"`
+	Previous        regressionWindow   `json:"previous"`
+	Current         regressionWindow   `json:"current"`
+	Changes         []regressionChange `json:"changes,omitempty"`
+	Error           string             `json:"error,omitempty"`
+}
+
+// Key metrics summed across the host's instances over the most recent hour of a service version
+type regressionWindow struct {
+	Ending         int64   `json:"ending,omitempty"`
+	Minutes        int64   `json:"minutes"`
+	MemoryUsedMB   float64 `json:"memory_used_mb"`
+	EventsRouted   int64   `json:"events_routed"`
+	DatabaseReads  int64   `json:"database_reads"`
+	DatabaseWrites int64   `json:"database_writes"`
+	Fatals         int64   `json:"fatals"`
+}
+
+// The change in a single metric, which has no percentage if there was nothing before
+type regressionChange struct {
+	Metric    string   `json:"metric,omitempty"`
+	Before    float64  `json:"before"`
+	After     float64  `json:"after"`
+	ChangePct *float64 `json:"change_pct,omitempty"`
+}
+
+// Compare the host's current hour against the last hour of its previous service version, formatted as text
+func watcherRegression(hostname string) (response string) {
+
+	r := watcherGetRegression(hostname)
+	if r.Error != "" {
+		return r.Error
+	}
+
+	response = fmt.Sprintf("%s %s (%d mins ending %s) vs %s (%d mins ending %s)\n", hostname,
+		r.CurrentVersion, r.Current.Minutes, time.Unix(r.Current.Ending, 0).UTC().Format("01-02 15:04"),
+		r.PreviousVersion, r.Previous.Minutes, time.Unix(r.Previous.Ending, 0).UTC().Format("01-02 15:04"))
+	response += "```"
+	for _, c := range r.Changes {
+		change := "n/a"
+		if c.ChangePct != nil {
+			change = fmt.Sprintf("%+.1f%%", *c.ChangePct)
+		}
+		response += fmt.Sprintf("%-18s %12.1f %12.1f %8s\n", c.Metric, c.Before, c.After, change)
+	}
+	response += "```"
+	return
+
+}
+
+// Compare the host's current hour against the last hour of its previous service version
+func watcherGetRegression(hostname string) (r regressionResponse) {
+	r.Host = hostname
+
+	// Get the current version's most recent hour from memory
+	statsLock.Lock()
+	if !uStatsLoaded(hostname) {
+		statsLock.Unlock()
+		r.Error = "no stats loaded for host"
+		return
+	}
+	r.CurrentVersion = statsServiceVersions[hostname]
+	hs, _ := uStatsExtract(hostname, 0, 0)
+	r.Current = regressionSummarize(hs.Stats, hs.BucketMins*60)
+	statsLock.Unlock()
+
+	// Get the previous version's most recent hour from its newest daily file
+	var day time.Time
+	var err error
+	r.PreviousVersion, day, err = regressionPreviousVersion(hostname, r.CurrentVersion)
+	if err != nil {
+		r.Error = err.Error()
+		return
+	}
+	prev, err := readFileLocally(hostname, r.PreviousVersion, day.Unix())
+	if err != nil {
+		r.Error = fmt.Sprintf("can't read stats for %s: %s", r.PreviousVersion, err)
+		return
+	}
+	r.Previous = regressionSummarize(prev.Stats, prev.BucketMins*60)
+	if r.Previous.Minutes == 0 {
+		r.Error = fmt.Sprintf("no stats for %s", r.PreviousVersion)
+		return
+	}
+
+	if r.Current.Minutes == 0 {
+		r.Error = fmt.Sprintf("no stats yet for %s", r.CurrentVersion)
+		return
+	}
+
+	// Compare them, with counts compared as rates because the current hour is usually partial
+	r.Changes = []regressionChange{
+		regressionCompare("memory used MB", r.Previous.MemoryUsedMB, r.Current.MemoryUsedMB),
+		regressionCompare("events routed/min", r.Previous.perMinute(r.Previous.EventsRouted), r.Current.perMinute(r.Current.EventsRouted)),
+		regressionCompare("db reads/min", r.Previous.perMinute(r.Previous.DatabaseReads), r.Current.perMinute(r.Current.DatabaseReads)),
+		regressionCompare("db writes/min", r.Previous.perMinute(r.Previous.DatabaseWrites), r.Current.perMinute(r.Current.DatabaseWrites)),
+		regressionCompare("fatals/min", r.Previous.perMinute(r.Previous.Fatals), r.Current.perMinute(r.Current.Fatals)),
+	}
+
+	return
+
+}
+
+// Find the most recent daily file of the host under a service version other than the current one
+func regressionPreviousVersion(hostname string, currentVersion string) (serviceVersion string, day time.Time, err error) {
+
+	entries, err := os.ReadDir(configDataDirectory)
+	if err != nil {
+		return
+	}
+	var newest time.Time
+	for _, entry := range entries {
+		filename := entry.Name()
+		if entry.IsDir() || statsFileOfOtherHost(hostname, filename) {
+			continue
+		}
+		fileVersion, fileDay, ok := rollupParseDailyFilename(hostname, filename)
+		if !ok || fileVersion == currentVersion || fileDay.Before(day) {
+			continue
+		}
+
+		// If there were several versions on the same day, the one most recently written is the previous one
+		info, err2 := entry.Info()
+		if err2 != nil {
+			continue
+		}
+		if fileDay.Equal(day) && info.ModTime().Before(newest) {
+			continue
+		}
+		serviceVersion = fileVersion
+		day = fileDay
+		newest = info.ModTime()
+	}
+	if serviceVersion == "" {
+		err = fmt.Errorf("no stats for a previous service version of %s", hostname)
+	}
+	return
+
+}
+
+// Sum the key metrics across instances over the most recent hour of the stats
+func regressionSummarize(s map[string][]StatsStat, bucketSecs int64) (w regressionWindow) {
+
+	for _, sis := range s {
+		if len(sis) > 0 && sis[0].SnapshotTaken > w.Ending {
+			w.Ending = sis[0].SnapshotTaken
+		}
+	}
+	if w.Ending == 0 || bucketSecs == 0 {
+		return
+	}
+
+	// Memory is a level rather than a count, so it's averaged across the buckets
+	buckets := map[int64]bool{}
+	memoryUsed := map[int64]uint64{}
+	for _, sis := range s {
+		for _, stat := range sis {
+			if stat.SnapshotTaken <= w.Ending-3600 {
+				break
+			}
+			buckets[stat.SnapshotTaken] = true
+			if stat.OSMemTotal != 0 {
+				memoryUsed[stat.SnapshotTaken] += stat.OSMemTotal - stat.OSMemFree
+			}
+			w.EventsRouted += stat.EventsRouted
+			for _, db := range stat.Databases {
+				w.DatabaseReads += db.Reads
+				w.DatabaseWrites += db.Writes
+			}
+			for _, count := range stat.Fatals {
+				w.Fatals += count
+			}
+		}
+	}
+	w.Minutes = int64(len(buckets)) * bucketSecs / 60
+	if len(memoryUsed) > 0 {
+		total := uint64(0)
+		for _, used := range memoryUsed {
+			total += used
+		}
+		w.MemoryUsedMB = float64(total) / float64(len(memoryUsed)) / (1024 * 1024)
+	}
+	return
+
+}
+
+// Get the per-minute rate of a count over the window
+func (w regressionWindow) perMinute(count int64) float64 {
+	if w.Minutes == 0 {
+		return 0
+	}
+	return float64(count) / float64(w.Minutes)
+}
+
+// Compute the change in a metric
+func regressionCompare(metric string, before float64, after float64) (c regressionChange) {
+	c.Metric = metric
+	c.Before = before
+	c.After = after
+	if before != 0 {
+		pct := (after - before) * 100 / before
+		c.ChangePct = &pct
+	}
+	return
+}
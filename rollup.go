@@ -0,0 +1,272 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Monthly rollup of the daily archives in S3.  Once a month has ended, the daily files
+// for each host and service version within that month are combined into a single
+// monthly archive containing each of the days' JSON files, and the daily files are
+// optionally deleted.  Because the presence of the monthly archive is checked before
+// doing any work, this is safe to re-run and will catch up if we were down at the
+// month boundary.
+
+// How often to check whether a rollup is due
+const rollupCheckMins = 60
+
+// Periodically roll up the prior month's archives, and delete those that have expired
+func rollupMaintainer() {
+	for {
+		time.Sleep(time.Duration(rollupCheckMins) * time.Minute)
+		if s3Disabled() || (!Config.S3RollupMonthly && Config.S3RetentionDays <= 0) {
+			continue
+		}
+		for _, host := range Config.MonitoredHosts {
+			if host.Disabled {
+				continue
+			}
+			if Config.S3RollupMonthly {
+				err := rollupHost(host.Name, rollupPriorMonth(time.Now().UTC()))
+				if err != nil {
+					fmt.Printf("%s: rollup: %s\n", host.Name, err)
+				}
+			}
+			if Config.S3RetentionDays > 0 {
+				err := rollupRemoveExpired(host.Name, time.Now().UTC())
+				if err != nil {
+					fmt.Printf("%s: retention: %s\n", host.Name, err)
+				}
+			}
+		}
+	}
+}
+
+// Get the UTC start of the month prior to the one containing the specified time
+func rollupPriorMonth(now time.Time) time.Time {
+	return time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// Get the monthly archive filename for a host's service version
+func rollupFilename(hostname string, serviceVersion string, month time.Time) string {
+	return hostname + "-" + serviceVersion + "-" + month.Format("200601") + zipType
+}
+
+// Parse a daily archive filename for the host, returning its service version and date
+func rollupParseDailyFilename(hostname string, filename string) (serviceVersion string, day time.Time, ok bool) {
+	if !strings.HasPrefix(filename, hostname+"-") || !strings.HasSuffix(filename, zipType) {
+		return
+	}
+	s := strings.TrimSuffix(strings.TrimPrefix(filename, hostname+"-"), zipType)
+	i := strings.LastIndex(s, "-")
+	if i <= 0 {
+		return
+	}
+	var err error
+	day, err = time.Parse("20060102", s[i+1:])
+	if err != nil {
+		return
+	}
+	serviceVersion = s[:i]
+	ok = true
+	return
+}
+
+// Parse a monthly archive filename for the host, returning its service version and month
+func rollupParseMonthlyFilename(hostname string, filename string) (serviceVersion string, month time.Time, ok bool) {
+	if !strings.HasPrefix(filename, hostname+"-") || !strings.HasSuffix(filename, zipType) {
+		return
+	}
+	s := strings.TrimSuffix(strings.TrimPrefix(filename, hostname+"-"), zipType)
+	i := strings.LastIndex(s, "-")
+	if i <= 0 {
+		return
+	}
+	var err error
+	month, err = time.Parse("200601", s[i+1:])
+	if err != nil {
+		return
+	}
+	serviceVersion = s[:i]
+	ok = true
+	return
+}
+
+// Delete the host's daily and monthly archives from S3 whose most recent day is older than the
+// retention period, ignoring anything that doesn't follow our naming convention
+func rollupRemoveExpired(hostname string, now time.Time) (err error) {
+	target := s3TargetForHost(hostname)
+	list := func(prefix string) ([]string, error) { return s3ListObjects(target, prefix) }
+	remove := func(filename string) error { return s3Delete(target, filename) }
+	return rollupRemoveExpiredUsing(hostname, now, list, remove)
+}
+
+// Delete the host's expired archives, using the specified functions to list and delete objects
+func rollupRemoveExpiredUsing(hostname string, now time.Time, list func(prefix string) ([]string, error), remove func(filename string) error) (err error) {
+	cutoff := now.AddDate(0, 0, -Config.S3RetentionDays)
+
+	var filenames []string
+	filenames, err = list(hostname + "-")
+	if err != nil {
+		return
+	}
+	for _, filename := range filenames {
+		if statsFileOfOtherHost(hostname, filename) {
+			continue
+		}
+		var lastDay time.Time
+		if _, day, ok := rollupParseDailyFilename(hostname, filename); ok {
+			lastDay = day
+		} else if _, month, ok := rollupParseMonthlyFilename(hostname, filename); ok {
+			lastDay = month.AddDate(0, 1, -1)
+		} else {
+			continue
+		}
+		if !lastDay.Before(cutoff) {
+			continue
+		}
+		err = remove(filename)
+		if err != nil {
+			return
+		}
+		fmt.Printf("retention: deleted %s from S3\n", filename)
+	}
+
+	return
+}
+
+// Combine the daily zip archives into a single zip archive containing all of their files
+func rollupCombine(dailies map[string][]byte) (contents []byte, err error) {
+
+	// Process the days in order so the archive is deterministic
+	filenames := make([]string, 0, len(dailies))
+	for filename := range dailies {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	buf := new(bytes.Buffer)
+	zipWriter := zip.NewWriter(buf)
+	for _, filename := range filenames {
+		daily := dailies[filename]
+		archive, err2 := zip.NewReader(bytes.NewReader(daily), int64(len(daily)))
+		if err2 != nil {
+			err = fmt.Errorf("%s: %s", filename, err2)
+			return
+		}
+		for _, zf := range archive.File {
+			f, err2 := zf.Open()
+			if err2 != nil {
+				err = fmt.Errorf("%s: %s", filename, err2)
+				return
+			}
+			dayContents, err2 := io.ReadAll(f)
+			f.Close()
+			if err2 != nil {
+				err = fmt.Errorf("%s: %s", filename, err2)
+				return
+			}
+			w, err2 := zipWriter.Create(zf.Name)
+			if err2 != nil {
+				err = err2
+				return
+			}
+			_, err = w.Write(dayContents)
+			if err != nil {
+				return
+			}
+		}
+	}
+	err = zipWriter.Close()
+	if err != nil {
+		return
+	}
+	contents = buf.Bytes()
+
+	return
+}
+
+// Determine which of the files listed for a host are the month's daily files that are yet to be
+// rolled up, grouped by the monthly archive into which they'll be rolled up.  Files of other hosts
+// whose names begin with this host's name are ignored.
+func rollupDailiesDue(hostname string, filenames []string, month time.Time) (dailiesByMonthly map[string][]string) {
+
+	existing := map[string]bool{}
+	for _, filename := range filenames {
+		existing[filename] = true
+	}
+
+	dailiesByMonthly = map[string][]string{}
+	for _, filename := range filenames {
+		if statsFileOfOtherHost(hostname, filename) {
+			continue
+		}
+		serviceVersion, day, ok := rollupParseDailyFilename(hostname, filename)
+		if !ok || day.Year() != month.Year() || day.Month() != month.Month() {
+			continue
+		}
+		monthlyFilename := rollupFilename(hostname, serviceVersion, month)
+		if existing[monthlyFilename] {
+			continue
+		}
+		dailiesByMonthly[monthlyFilename] = append(dailiesByMonthly[monthlyFilename], filename)
+	}
+
+	return
+}
+
+// Roll up the daily archives of a host for the specified month
+func rollupHost(hostname string, month time.Time) (err error) {
+	target := s3TargetForHost(hostname)
+
+	// List what's in the bucket for this host
+	var filenames []string
+	filenames, err = s3ListObjects(target, hostname+"-")
+	if err != nil {
+		return
+	}
+
+	// Roll up each service version that hasn't yet been rolled up
+	for monthlyFilename, dailyFilenames := range rollupDailiesDue(hostname, filenames, month) {
+
+		dailies := map[string][]byte{}
+		for _, filename := range dailyFilenames {
+			dailies[filename], err = s3Download(target, filename)
+			if err != nil {
+				return
+			}
+		}
+
+		var contents []byte
+		contents, err = rollupCombine(dailies)
+		if err != nil {
+			return
+		}
+		err = s3UploadStats(target, monthlyFilename, contents)
+		if err != nil {
+			return
+		}
+		fmt.Printf("rollup: combined %d daily files into %s\n", len(dailies), monthlyFilename)
+
+		if Config.S3RollupDeleteDailies {
+			for _, filename := range dailyFilenames {
+				err = s3Delete(target, filename)
+				if err != nil {
+					return
+				}
+				fmt.Printf("rollup: deleted %s\n", filename)
+			}
+		}
+	}
+
+	return
+}
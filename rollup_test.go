@@ -0,0 +1,186 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRollupFilename(t *testing.T) {
+	month := time.Date(2022, time.March, 1, 0, 0, 0, 0, time.UTC)
+	filename := rollupFilename("prod", "v1.2.3", month)
+	if filename != "prod-v1.2.3-202203.zip" {
+		t.Fatalf("rollupFilename = %s", filename)
+	}
+	serviceVersion, parsed, ok := rollupParseMonthlyFilename("prod", filename)
+	if !ok || serviceVersion != "v1.2.3" || !parsed.Equal(month) {
+		t.Fatalf("rollupParseMonthlyFilename = %s %s %t", serviceVersion, parsed, ok)
+	}
+}
+
+func TestRollupDailiesDue(t *testing.T) {
+	saved := Config.MonitoredHosts
+	defer func() { Config.MonitoredHosts = saved }()
+	Config.MonitoredHosts = []MonitoredHost{{Name: "prod"}, {Name: "prod-eu"}}
+
+	month := time.Date(2022, time.March, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		filenames []string
+		want      map[string][]string
+	}{
+		{
+			name: "groups by service version",
+			filenames: []string{
+				"prod-v1-20220301.zip",
+				"prod-v1-20220302.zip",
+				"prod-v2-20220315.zip",
+			},
+			want: map[string][]string{
+				"prod-v1-202203.zip": {"prod-v1-20220301.zip", "prod-v1-20220302.zip"},
+				"prod-v2-202203.zip": {"prod-v2-20220315.zip"},
+			},
+		},
+		{
+			name: "ignores other months",
+			filenames: []string{
+				"prod-v1-20220228.zip",
+				"prod-v1-20220401.zip",
+			},
+			want: map[string][]string{},
+		},
+		{
+			name: "ignores hosts whose names begin with the host's",
+			filenames: []string{
+				"prod-v1-20220301.zip",
+				"prod-eu-v1-20220301.zip",
+			},
+			want: map[string][]string{
+				"prod-v1-202203.zip": {"prod-v1-20220301.zip"},
+			},
+		},
+		{
+			name: "skips versions already rolled up",
+			filenames: []string{
+				"prod-v1-20220301.zip",
+				"prod-v1-202203.zip",
+				"prod-v2-20220301.zip",
+			},
+			want: map[string][]string{
+				"prod-v2-202203.zip": {"prod-v2-20220301.zip"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		got := rollupDailiesDue("prod", tt.filenames, month)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Create a zip archive containing the specified files
+func rollupTestZip(t *testing.T, files map[string]string) []byte {
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+	for name, contents := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(contents))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRollupCombine(t *testing.T) {
+	dailies := map[string][]byte{
+		"prod-v1-20220302.zip": rollupTestZip(t, map[string]string{"prod-v1-20220302.json": "two"}),
+		"prod-v1-20220301.zip": rollupTestZip(t, map[string]string{"prod-v1-20220301.json": "one"}),
+	}
+	contents, err := rollupCombine(dailies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(contents), int64(len(contents)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	names := []string{}
+	for _, zf := range archive.File {
+		f, err := zf.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(f)
+		f.Close()
+		got[zf.Name] = string(b)
+		names = append(names, zf.Name)
+	}
+	if !sort.StringsAreSorted(names) {
+		t.Errorf("days not in order: %v", names)
+	}
+	want := map[string]string{"prod-v1-20220301.json": "one", "prod-v1-20220302.json": "two"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRollupRemoveExpired(t *testing.T) {
+	savedConfig := Config
+	defer func() { Config = savedConfig }()
+	Config.MonitoredHosts = []MonitoredHost{{Name: "prod"}, {Name: "prod-eu"}}
+	Config.S3RetentionDays = 30
+
+	objects := []string{
+		"prod-v1-20220101.zip",
+		"prod-v1-20220301.zip",
+		"prod-v1-202201.zip",
+		"prod-v1-202202.zip",
+		"prod-eu-v1-20220101.zip",
+		"prod-notes.txt",
+	}
+	list := func(prefix string) (filenames []string, err error) {
+		for _, name := range objects {
+			if strings.HasPrefix(name, prefix) {
+				filenames = append(filenames, name)
+			}
+		}
+		return
+	}
+	deleted := []string{}
+	remove := func(filename string) error {
+		deleted = append(deleted, filename)
+		return nil
+	}
+
+	now := time.Date(2022, time.March, 15, 0, 0, 0, 0, time.UTC)
+	err := rollupRemoveExpiredUsing("prod", now, list, remove)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"prod-v1-20220101.zip", "prod-v1-202201.zip"}
+	if !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted %v, want %v", deleted, want)
+	}
+
+	// A failed delete stops the pass and is reported
+	remove = func(filename string) error { return fmt.Errorf("access denied") }
+	if err = rollupRemoveExpiredUsing("prod", now, list, remove); err == nil {
+		t.Errorf("failed delete was not reported")
+	}
+}
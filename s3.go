@@ -6,33 +6,97 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
-// Upload stats to S3
-func s3UploadStats(filename string, contents []byte) (err error) {
+// Get the S3 target for a host, with any per-host settings overriding the global config
+func s3TargetForHost(hostname string) (target S3Target) {
 
-	var sess *session.Session
-	sess, err = session.NewSession(
+	target = S3Target{
+		AWSRegion:      Config.AWSRegion,
+		AWSAccessKeyID: Config.AWSAccessKeyID,
+		AWSAccessKey:   Config.AWSAccessKey,
+		AWSBucket:      Config.AWSBucket,
+	}
+
+	for _, host := range Config.MonitoredHosts {
+		if host.Name != hostname {
+			continue
+		}
+		if host.AWSRegion != "" {
+			target.AWSRegion = host.AWSRegion
+		}
+		if host.AWSAccessKeyID != "" {
+			target.AWSAccessKeyID = host.AWSAccessKeyID
+		}
+		if host.AWSAccessKey != "" {
+			target.AWSAccessKey = host.AWSAccessKey
+		}
+		if host.AWSBucket != "" {
+			target.AWSBucket = host.AWSBucket
+		}
+		break
+	}
+
+	return
+}
+
+// Returned by anything that would use S3 when it's disabled
+var errS3Disabled = errors.New("s3 is disabled")
+
+// Noted just once, when S3 is first found to be disabled
+var s3DisabledNoted sync.Once
+
+// Determine whether S3 is disabled, saying so the first time that it's found to be
+func s3Disabled() bool {
+	if !Config.S3Disabled {
+		return false
+	}
+	s3DisabledNoted.Do(func() {
+		fmt.Printf("s3: disabled, so stats are only kept locally\n")
+	})
+	return true
+}
+
+// Open a session for the S3 target
+func s3Session(target S3Target) (sess *session.Session, err error) {
+	if s3Disabled() {
+		err = errS3Disabled
+		return
+	}
+	return session.NewSession(
 		&aws.Config{
-			Region: aws.String(Config.AWSRegion),
+			Region: aws.String(target.AWSRegion),
 			Credentials: credentials.NewStaticCredentials(
-				Config.AWSAccessKeyID,
-				Config.AWSAccessKey,
+				target.AWSAccessKeyID,
+				target.AWSAccessKey,
 				"",
 			),
 		})
+}
+
+// Upload stats to S3
+func s3UploadStats(target S3Target, filename string, contents []byte) (err error) {
+
+	var sess *session.Session
+	sess, err = s3Session(target)
 	if err != nil {
 		return
 	}
 
 	uploader := s3manager.NewUploader(sess)
 	_, err = uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(Config.AWSBucket),
+		Bucket: aws.String(target.AWSBucket),
 		ACL:    aws.String("public-read"),
 		Key:    aws.String(filename),
 		Body:   bytes.NewReader(contents),
@@ -40,3 +104,154 @@ func s3UploadStats(filename string, contents []byte) (err error) {
 
 	return
 }
+
+// List the names of the objects in the S3 bucket having the specified prefix
+func s3ListObjects(target S3Target, prefix string) (filenames []string, err error) {
+
+	var sess *session.Session
+	sess, err = s3Session(target)
+	if err != nil {
+		return
+	}
+
+	err = s3.New(sess).ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(target.AWSBucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			filenames = append(filenames, aws.StringValue(obj.Key))
+		}
+		return true
+	})
+
+	return
+}
+
+// Download an object from S3
+func s3Download(target S3Target, filename string) (contents []byte, err error) {
+
+	var sess *session.Session
+	sess, err = s3Session(target)
+	if err != nil {
+		return
+	}
+
+	buf := aws.NewWriteAtBuffer([]byte{})
+	downloader := s3manager.NewDownloader(sess)
+	_, err = downloader.Download(buf, &s3.GetObjectInput{
+		Bucket: aws.String(target.AWSBucket),
+		Key:    aws.String(filename),
+	})
+	if err != nil {
+		return
+	}
+	contents = buf.Bytes()
+
+	return
+}
+
+// Delete an object from S3
+func s3Delete(target S3Target, filename string) (err error) {
+
+	var sess *session.Session
+	sess, err = s3Session(target)
+	if err != nil {
+		return
+	}
+
+	_, err = s3.New(sess).DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(target.AWSBucket),
+		Key:    aws.String(filename),
+	})
+
+	return
+}
+
+// Directory within the data directory holding uploads that failed and are awaiting retry.  Pending
+// uploads are kept in a subdirectory per host, so that they're retried using that host's S3 target.
+const s3QueueDirectory = "s3queue"
+
+// How often failed uploads are retried
+const s3RetryMins = 5
+
+var s3QueueLock sync.Mutex
+
+// Get the path of the queue directory for a host
+func s3QueuePath(hostname string) string {
+	return configDataDirectory + "/" + s3QueueDirectory + "/" + hostname
+}
+
+// Queue a failed upload for retry, replacing any pending upload of the same file
+func s3QueueUpload(hostname string, filename string, contents []byte) (err error) {
+	s3QueueLock.Lock()
+	defer s3QueueLock.Unlock()
+
+	err = os.MkdirAll(s3QueuePath(hostname), 0755)
+	if err != nil {
+		return
+	}
+	err = os.WriteFile(s3QueuePath(hostname)+"/"+filename, contents, 0644)
+	if err != nil {
+		return
+	}
+	fmt.Printf("s3: queued %s for retry\n", filename)
+
+	return
+}
+
+// Remove a pending upload, because a more recent version of the file has since been uploaded
+func s3DequeueUpload(hostname string, filename string) {
+	s3QueueLock.Lock()
+	defer s3QueueLock.Unlock()
+
+	os.Remove(s3QueuePath(hostname) + "/" + filename)
+}
+
+// Periodically retry failed uploads
+func s3Retrier() {
+	for {
+		time.Sleep(time.Duration(s3RetryMins) * time.Minute)
+		if !s3Disabled() {
+			s3RetryUploads()
+		}
+	}
+}
+
+// Attempt to upload everything in the queue, removing those that succeed, and returning the
+// number still queued
+func s3RetryUploads() (pending int) {
+	s3QueueLock.Lock()
+	defer s3QueueLock.Unlock()
+
+	hostDirs, _ := os.ReadDir(configDataDirectory + "/" + s3QueueDirectory)
+	for _, hostDir := range hostDirs {
+		if !hostDir.IsDir() {
+			continue
+		}
+		hostname := hostDir.Name()
+		files, _ := os.ReadDir(s3QueuePath(hostname))
+		for _, file := range files {
+			path := s3QueuePath(hostname) + "/" + file.Name()
+			contents, err := os.ReadFile(path)
+			if err != nil {
+				fmt.Printf("s3: error reading queued %s: %s\n", file.Name(), err)
+				pending++
+				continue
+			}
+			err = s3UploadStats(s3TargetForHost(hostname), file.Name(), contents)
+			if err != nil {
+				fmt.Printf("s3: retry of %s failed: %s\n", file.Name(), err)
+				pending++
+				continue
+			}
+			fmt.Printf("s3: retry of %s succeeded\n", file.Name())
+			os.Remove(path)
+		}
+	}
+
+	// Report the depth of the queue
+	datadogSubmitGauge("notehub.watch.s3.queue", float64(pending), nil)
+
+	return
+
+}
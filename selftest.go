@@ -0,0 +1,179 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// End-to-end check that we can reach a host and everything downstream of it
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Response to the selftest command
+type selftestResponse struct {
+	Host   string                  `json:"host,omitempty"`
+	Passed bool                    `json:"passed"`
+	Stages []selftestStageResponse `json:"stages,omitempty"`
+	Error  string                  `json:"error,omitempty"`
+}
+
+// The result of a single stage of the self-test
+type selftestStageResponse struct {
+	Stage   string `json:"stage,omitempty"`
+	Passed  bool   `json:"passed"`
+	Skipped bool   `json:"skipped,omitempty"`
+	Result  string `json:"result,omitempty"`
+}
+
+// Run the self-test for a host, formatted as text
+func watcherSelftest(hostname string) (response string) {
+	return selftestFormat(watcherGetSelftest(hostname))
+}
+
+// Format the results of a self-test as text
+func selftestFormat(r selftestResponse) (response string) {
+
+	if r.Error != "" {
+		return r.Error
+	}
+
+	response = fmt.Sprintf("selftest of %s ", r.Host)
+	if r.Passed {
+		response += "passed\n"
+	} else {
+		response += "FAILED\n"
+	}
+	response += "```"
+	for _, s := range r.Stages {
+		status := "pass"
+		if s.Skipped {
+			status = "skip"
+		} else if !s.Passed {
+			status = "FAIL"
+		}
+		response += fmt.Sprintf("%-8s %s %s\n", s.Stage, status, s.Result)
+	}
+	response += "```"
+	return
+
+}
+
+// Run the self-test for a host, reaching it, writing locally, uploading to S3, and submitting
+// to DataDog, each with a small synthetic payload
+func watcherGetSelftest(hostname string) (r selftestResponse) {
+	r.Host = hostname
+
+	// Map name to address
+	hostaddr := ""
+	for _, v := range Config.MonitoredHosts {
+		if !v.Disabled {
+			if hostname == v.Name {
+				hostaddr = v.Addr
+				break
+			}
+		}
+	}
+	if hostaddr == "" {
+		r.Error = "host not found"
+		return
+	}
+
+	// The synthetic payload
+	now := time.Now().UTC()
+	payload, _ := json.Marshal(map[string]interface{}{"host": hostname, "selftest": now.Unix()})
+
+	// Ping the host and parse the response
+	s := selftestStageResponse{Stage: "ping"}
+	serviceVersion, serviceInstanceIDs, _, _, err := getServiceInstances(shutdownContext, hostaddr)
+	if err != nil {
+		s.Result = err.Error()
+	} else {
+		s.Passed = true
+		s.Result = fmt.Sprintf("%s has %d instances", serviceVersion, len(serviceInstanceIDs))
+	}
+	r.Stages = append(r.Stages, s)
+
+	// Write and read back a local file
+	s = selftestStageResponse{Stage: "local"}
+	err = dataDirectoryInit(configDataDirectory)
+	if err != nil {
+		s.Result = err.Error()
+	} else {
+		s.Passed = true
+		s.Result = configDataDirectory
+	}
+	r.Stages = append(r.Stages, s)
+
+	// Upload to S3, and remove what we uploaded
+	s = selftestStageResponse{Stage: "s3"}
+	target := s3TargetForHost(hostname)
+	if s3Disabled() {
+		s.Skipped = true
+		s.Result = "disabled"
+	} else if target.AWSBucket == "" {
+		s.Skipped = true
+		s.Result = "not configured"
+	} else {
+		filename := hostname + "-selftest.json"
+		err = s3UploadStats(target, filename, payload)
+		if err == nil {
+			err = s3Delete(target, filename)
+		}
+		if err != nil {
+			s.Result = err.Error()
+		} else {
+			s.Passed = true
+			s.Result = target.AWSBucket
+		}
+	}
+	r.Stages = append(r.Stages, s)
+
+	// Submit to DataDog
+	s = selftestStageResponse{Stage: "datadog"}
+	if Config.DatadogAPIKey == "" {
+		s.Skipped = true
+		s.Result = "not configured"
+	} else if datadogPaused.Load() {
+		s.Skipped = true
+		s.Result = "paused"
+	} else {
+		err = datadogSubmitGauge("notehub.watch.selftest", 1, []string{"host:" + hostname})
+		if err != nil {
+			s.Result = err.Error()
+		} else {
+			s.Passed = true
+			s.Result = Config.DatadogSite
+		}
+	}
+	r.Stages = append(r.Stages, s)
+
+	// Passed if nothing failed
+	r.Passed = true
+	for _, s := range r.Stages {
+		if !s.Passed && !s.Skipped {
+			r.Passed = false
+		}
+	}
+
+	return
+
+}
+
+// Run the self-test for every monitored host from the command line, returning false if any failed
+func selftestAllHosts() (passed bool) {
+	passed = true
+	for _, host := range Config.MonitoredHosts {
+		if host.Disabled {
+			continue
+		}
+		r := watcherGetSelftest(host.Name)
+		fmt.Printf("%s\n", strings.ReplaceAll(selftestFormat(r), "```", "\n"))
+		if !r.Passed {
+			passed = false
+		}
+	}
+	return
+}
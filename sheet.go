@@ -7,9 +7,12 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"html"
 	"io"
+	"math"
 	"net/http"
 	"os"
+	"regexp"
 	"sort"
 	"strings"
 	"time"
@@ -23,11 +26,28 @@ const sheetTrace = true
 // The route to our sheet handler
 const sheetRoute = "/file/"
 
+// The route to the list of generated sheets
+const sheetListRoute = "/files"
+
+// The naming pattern of generated sheets, which is host-YYYYMMDD-HHMMSS.xlsx, and of
+// other generated downloads such as JSON too large to show in Slack
+var sheetFilenamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+-[0-9]{8}-[0-9]{6}\.(xlsx|json|txt)$`)
+
+// Characters that may not appear in the prefix of a generated file's name
+var sheetFilenameInvalid = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
 // Handler to retrieve a sheet
 func inboundWebSheetHandler(w http.ResponseWriter, r *http.Request) {
 
+	// Validate the filename so that only generated sheets within the data directory
+	// can be retrieved, rather than arbitrary files reached by traversal
+	filename := strings.TrimPrefix(r.URL.Path, sheetRoute)
+	if strings.ContainsAny(filename, "/\\") || strings.Contains(filename, "..") || !sheetFilenamePattern.MatchString(filename) {
+		http.Error(w, "invalid filename", http.StatusBadRequest)
+		return
+	}
+
 	// Open the file
-	filename := r.RequestURI[len(sheetRoute):]
 	file := configDataDirectory + filename
 	contents, err := os.ReadFile(file)
 	if err != nil {
@@ -45,6 +65,153 @@ func inboundWebSheetHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// Handler to list the generated sheets, newest first
+func inboundWebSheetListHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Read the data directory, only looking at generated sheets so that
+	// nothing else in the directory is exposed
+	entries, err := os.ReadDir(configDataDirectory)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	files := []os.FileInfo{}
+	for _, entry := range entries {
+		if entry.IsDir() || !sheetFilenamePattern.MatchString(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, info)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+
+	// Generate the list
+	response := "<html><body><pre>\n"
+	for _, file := range files {
+		name := html.EscapeString(file.Name())
+		response += fmt.Sprintf("%s  %10d  <a href=\"%s%s\">%s</a>\n",
+			file.ModTime().UTC().Format("2006-01-02 15:04:05"), file.Size(), sheetRoute, name, name)
+	}
+	response += "</pre></body></html>\n"
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(response))
+
+}
+
+// Save a spreadsheet into the data directory, named with the prefix and the current time
+func sheetSave(f *excelize.File, prefix string) (filename string, err error) {
+
+	filename = fmt.Sprintf("%s-%s.xlsx", prefix, time.Now().UTC().Format("20060102-150405"))
+	err = f.SaveAs(configDataDirectory + filename)
+	if err != nil {
+		return
+	}
+
+	// Change file permissions to 444 so we can read it
+	err = os.Chmod(configDataDirectory+filename, 0444)
+	return
+
+}
+
+// Save a generated download into the data directory, named with the prefix and the current time
+func sheetSaveFile(prefix string, filetype string, contents []byte) (filename string, err error) {
+
+	prefix = sheetFilenameInvalid.ReplaceAllString(prefix, "_")
+	filename = fmt.Sprintf("%s-%s%s", prefix, time.Now().UTC().Format("20060102-150405"), filetype)
+	err = os.WriteFile(configDataDirectory+filename, contents, 0444)
+	return
+
+}
+
+// Generate a single sheet summarizing every host, with a tab for each
+func sheetGetFleetStats() (response string) {
+
+	// Create a new spreadsheet
+	f := excelize.NewFile()
+
+	// Generate a summary tab for each host from the stats already in memory, rather than polling
+	// every host in turn, noting those whose stats we don't have
+	hosts := 0
+	failed := 0
+	for _, host := range Config.MonitoredHosts {
+		if host.Disabled {
+			continue
+		}
+		hosts++
+		if sheetTrace {
+			fmt.Printf("sheetGetFleetStats: get stats for %s\n", host.Name)
+		}
+		ss, aggregatedStats, exists := sheetFleetHostStats(host.Name)
+		if !exists {
+			failed++
+			sheetUnavailableTab(f, host.Name, "no stats loaded")
+			continue
+		}
+		ss.VersionChanges = watcherVersionHistory(host.Name)
+		errstr := sheetAddTab(f, host.Name, "summary", ss, AppHandler{}, aggregatedStats)
+		if errstr != "" {
+			failed++
+			f.DeleteSheet(host.Name)
+			sheetUnavailableTab(f, host.Name, errstr)
+		}
+	}
+	if hosts == 0 {
+		return "no hosts are being monitored"
+	}
+
+	// Delete the default sheet
+	f.DeleteSheet("Sheet1")
+
+	// Save the spreadsheet
+	filename, err := sheetSave(f, "fleet")
+	if err != nil {
+		return err.Error()
+	}
+
+	// Generate response
+	response = fmt.Sprintf("fleet summary of %d hosts", hosts)
+	if failed > 0 {
+		response += fmt.Sprintf(" (%d unavailable)", failed)
+	}
+	response += "\n"
+	response += fmt.Sprintf("<%s%s%s|%s>", Config.HostURL, sheetRoute, filename, filename)
+	return
+
+}
+
+// Get a host's aggregated stats from memory, along with the summary needed for its tab
+func sheetFleetHostStats(hostname string) (ss serviceSummary, aggregatedStats []StatsStat, exists bool) {
+
+	// Aggregate while locked, because the in-memory stats are updated in place
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	if !uStatsLoaded(hostname) {
+		return
+	}
+	var hs HostStats
+	hs, exists = uStatsExtract(hostname, 0, 0)
+	if !exists {
+		return
+	}
+	ss.ServiceVersion = statsServiceVersions[hostname]
+	ss.BucketSecs = hs.BucketMins * 60
+	aggregatedStats = statsAggregateAsStatsStat(hs.Stats, ss.BucketSecs)
+	return
+
+}
+
+// Add a tab noting why a host's stats are unavailable
+func sheetUnavailableTab(f *excelize.File, sheetName string, reason string) {
+	f.NewSheet(sheetName)
+	f.SetCellValue(sheetName, cell(1, 1), "Unavailable")
+	f.SetCellValue(sheetName, cell(2, 1), reason)
+}
+
 // Add all the tabs for this service type
 func sheetAddTabs(serviceType string, hs *HostStats, ss serviceSummary, handlers map[string]AppHandler, f *excelize.File) (response string) {
 	var sn int
@@ -111,6 +278,7 @@ func sheetGetHostStats(hostname string, hostaddr string) (response string) {
 		response = fmt.Sprintf("sheetGetHostStats: error updating %s: %s\n", hostname, err)
 		return
 	}
+	ss.VersionChanges = watcherVersionHistory(hostname)
 
 	// Get the entire set of stats available in-memory
 	if sheetTrace {
@@ -125,24 +293,59 @@ func sheetGetHostStats(hostname string, hostaddr string) (response string) {
 		fmt.Printf("sheetGetHostStats: extracted and retrieved stats from %d handlers\n", len(hs.Stats))
 	}
 
+	// If nothing is in memory, such as just after a deploy, show what was most recently saved,
+	// described by the file's own service version, bucket size, and instances rather than by
+	// those currently running
+	fallback := ""
+	sheetSs, sheetHandlers := ss, handlers
+	if sheetStatsEmpty(hs) {
+		fallbackHs, fallbackVersion, fallbackFilename, err := sheetFallbackStats(hostname, ss.ServiceVersion)
+		if err != nil {
+			fmt.Printf("sheet: no stats in memory for %s, and none saved since yesterday: %s\n", hostname, err)
+		} else {
+			fmt.Printf("sheet: no stats in memory for %s, falling back to %s\n", hostname, fallbackFilename)
+			hs = fallbackHs
+			sheetSs, sheetHandlers = sheetFallbackSummary(ss, fallbackVersion, fallbackHs)
+			fallback = fallbackFilename
+		}
+	}
+
 	// Create a new spreadsheet
 	f := excelize.NewFile()
 
-	// Generate the summary tab
-	sheetAddTab(f, "Summary", "summary", ss, AppHandler{}, statsAggregateAsStatsStat(hs.Stats, hs.BucketMins*60))
+	// Generate the summary tab, optionally followed by one for each service type
+	sheetAddTab(f, "Summary", "summary", sheetSs, AppHandler{}, statsAggregateAsStatsStat(hs.Stats, hs.BucketMins*60))
+	if Config.StatsByServiceType {
+		byServiceType := map[string]map[string][]StatsStat{}
+		for siid, sis := range hs.Stats {
+			serviceType := statsServiceType(siid)
+			if byServiceType[serviceType] == nil {
+				byServiceType[serviceType] = map[string][]StatsStat{}
+			}
+			byServiceType[serviceType][siid] = sis
+		}
+		serviceTypes := []string{}
+		for serviceType := range byServiceType {
+			serviceTypes = append(serviceTypes, serviceType)
+		}
+		sort.Strings(serviceTypes)
+		for _, serviceType := range serviceTypes {
+			sheetAddTab(f, "Summary "+serviceType, "summary", sheetSs, AppHandler{}, statsAggregateAsStatsStat(byServiceType[serviceType], hs.BucketMins*60))
+		}
+	}
 
 	// Generate a page within the sheet for each service instance
 	if response == "" {
-		response = sheetAddTabs(DcServiceNameNotehandlerTCP, &hs, ss, handlers, f)
+		response = sheetAddTabs(DcServiceNameNotehandlerTCP, &hs, sheetSs, sheetHandlers, f)
 	}
 	if response == "" {
-		response = sheetAddTabs(DcServiceNameNoteDiscovery, &hs, ss, handlers, f)
+		response = sheetAddTabs(DcServiceNameNoteDiscovery, &hs, sheetSs, sheetHandlers, f)
 	}
 	if response == "" {
-		response = sheetAddTabs(DcServiceNameNoteboard, &hs, ss, handlers, f)
+		response = sheetAddTabs(DcServiceNameNoteboard, &hs, sheetSs, sheetHandlers, f)
 	}
 	if response == "" {
-		response = sheetAddTabs("", &hs, ss, handlers, f)
+		response = sheetAddTabs("", &hs, sheetSs, sheetHandlers, f)
 	}
 	if response != "" {
 		return
@@ -162,14 +365,7 @@ func sheetGetHostStats(hostname string, hostaddr string) (response string) {
 	if hostCleaned == "notefile.net" {
 		hostCleaned = "prod"
 	}
-	filename := fmt.Sprintf("%s-%s.xlsx", hostCleaned, time.Now().UTC().Format("20060102-150405"))
-	err = f.SaveAs(configDataDirectory + filename)
-	if err != nil {
-		return err.Error()
-	}
-
-	// Change file permissions to 444 so we can read it
-	err = os.Chmod(configDataDirectory+filename, 0444)
+	filename, err := sheetSave(f, hostCleaned)
 	if err != nil {
 		return err.Error()
 	}
@@ -183,6 +379,9 @@ func sheetGetHostStats(hostname string, hostaddr string) (response string) {
 		ss.ContinuousHandlers+ss.NotificationHandlers+ss.EphemeralHandlers+ss.DiscoveryHandlers,
 		ss.ContinuousHandlers, ss.NotificationHandlers, ss.EphemeralHandlers, ss.DiscoveryHandlers)
 	response += "```" + "\n"
+	if fallback != "" {
+		response += fmt.Sprintf("no recent stats in memory, so showing those saved in %s\n", fallback)
+	}
 	response += fmt.Sprintf("<%s%s%s|%s>", Config.HostURL, sheetRoute, filename, filename)
 
 	// Done
@@ -193,6 +392,70 @@ func sheetGetHostStats(hostname string, hostaddr string) (response string) {
 
 }
 
+// See whether there are no stats buckets at all for any of the host's instances
+func sheetStatsEmpty(hs HostStats) bool {
+	for _, sis := range hs.Stats {
+		if len(sis) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Load the most recent stats saved locally since yesterday, first under the current service version
+// and then under the previous one, which is what is needed after a deploy because in-memory stats
+// are only loaded from files of the current version.  The service version of the file is returned.
+func sheetFallbackStats(hostname string, serviceVersion string) (hs HostStats, fileVersion string, filename string, err error) {
+
+	for _, day := range []int64{todayTime(), yesterdayTime()} {
+		hs, err = readFileLocally(hostname, serviceVersion, day)
+		if err == nil && !sheetStatsEmpty(hs) {
+			fileVersion = serviceVersion
+			filename = statsFilename(hostname, serviceVersion, day, currentType)
+			return
+		}
+	}
+
+	previousVersion, previousDay, err := regressionPreviousVersion(hostname, serviceVersion)
+	if err != nil {
+		return
+	}
+	if previousDay.Unix() < yesterdayTime() {
+		err = fmt.Errorf("stats of %s were last saved %s", previousVersion, previousDay.Format("2006-01-02"))
+		return
+	}
+	hs, err = readFileLocally(hostname, previousVersion, previousDay.Unix())
+	if err == nil && sheetStatsEmpty(hs) {
+		err = fmt.Errorf("no stats saved for %s", previousVersion)
+	}
+	fileVersion = previousVersion
+	filename = statsFilename(hostname, previousVersion, previousDay.Unix(), currentType)
+	return
+
+}
+
+// Describe saved stats by the service version, bucket size, and instances of the file from which
+// they were loaded, because after a deploy those of the running instances no longer apply to them.
+// What's known of each instance is what was recorded with its most recent bucket.
+func sheetFallbackSummary(ss serviceSummary, fileVersion string, hs HostStats) (fallbackSs serviceSummary, handlers map[string]AppHandler) {
+
+	fallbackSs.ServiceVersion = fileVersion
+	fallbackSs.BucketSecs = hs.BucketMins * 60
+	fallbackSs.VersionChanges = ss.VersionChanges
+	handlers = map[string]AppHandler{}
+	for siid, sis := range hs.Stats {
+		fallbackSs.ServiceInstanceIDs = append(fallbackSs.ServiceInstanceIDs, siid)
+		h := AppHandler{NodeID: siid}
+		if len(sis) > 0 {
+			h.NodeStarted = sis[0].NodeStarted
+		}
+		handlers[siid] = h
+	}
+	sort.Strings(fallbackSs.ServiceInstanceIDs)
+	return
+
+}
+
 // Add the stats for a service instance as a tabbed sheet within the xlsx
 func sheetAddTab(f *excelize.File, sheetName string, siid string, ss serviceSummary, handler AppHandler, stats []StatsStat) (errstr string) {
 
@@ -211,6 +474,8 @@ func sheetAddTab(f *excelize.File, sheetName string, siid string, ss serviceSumm
 	styleSubcategory, _ := f.NewStyle(`{"font":{"color":"007f00","bold":true,"italic":false}}`)
 	styleRightAligned, _ := f.NewStyle(`{"alignment":{"horizontal":"right"}}`)
 	styleLeftAligned, _ := f.NewStyle(`{"alignment":{"horizontal":"left"}}`)
+	styleDeploy, _ := f.NewStyle(`{"font":{"color":"ffffff","bold":true},"fill":{"type":"pattern","color":["7f3fbf"],"pattern":1},"alignment":{"horizontal":"right"}}`)
+	styleHighlight, _ := f.NewConditionalStyle(`{"font":{"color":"9a0511"},"fill":{"type":"pattern","color":["fec7ce"],"pattern":1}}`)
 
 	// Base for dynamic info
 	row := 1
@@ -296,12 +561,19 @@ func sheetAddTab(f *excelize.File, sheetName string, siid string, ss serviceSumm
 		return
 	}
 
-	// Bucket parameters are assumed to be uniform
+	// Bucket parameters are assumed to be uniform, and if there are too many buckets we
+	// merge each span of N, with the headers reflecting that coarser resolution
+	stats, every := sheetDecimate(stats, Config.SheetMaxColumns)
 	buckets := len(stats)
-	bucketMins := int(ss.BucketSecs / 60)
+	bucketMins := int(ss.BucketSecs/60) * every
+	resolution := ""
+	if every > 1 {
+		resolution = fmt.Sprintf(", every %d mins", bucketMins)
+	}
 
 	// OS stats
-	f.SetCellValue(sheetName, cell(col, row), "OS (MiB)")
+	unitDivisor, unitName, unitSuffix := sheetUnits()
+	f.SetCellValue(sheetName, cell(col, row), "OS ("+unitName+resolution+")")
 	f.SetCellStyle(sheetName, cell(col, row), cell(col, row), styleCategory)
 	timeHeader(f, sheetName, col+1, row, bucketMins, buckets)
 	row++
@@ -317,50 +589,67 @@ func sheetAddTab(f *excelize.File, sheetName string, siid string, ss serviceSumm
 	}
 	row++
 
-	f.SetCellValue(sheetName, cell(col, row), "malloc mb")
+	// Mark the buckets during which the service version changed, with the version deployed
+	deploys := sheetDeployMarkers(stats, ss.BucketSecs*int64(every), ss.VersionChanges)
+	if len(deploys) > 0 {
+		f.SetCellValue(sheetName, cell(col, row), "deployed")
+		f.SetCellStyle(sheetName, cell(col, row), cell(col, row), styleMetric)
+		for i, version := range deploys {
+			f.SetCellValue(sheetName, cell(col+1+i, row), version)
+			f.SetCellStyle(sheetName, cell(col+1+i, row), cell(col+1+i, row), styleDeploy)
+		}
+		row++
+	}
+
+	f.SetCellValue(sheetName, cell(col, row), "malloc "+unitSuffix)
 	f.SetCellStyle(sheetName, cell(col, row), cell(col, row), styleMetric)
 	for i, stat := range stats {
 		if stat.OSMemTotal != 0 {
-			f.SetCellValue(sheetName, cell(col+1+i, row), (stat.OSMemTotal-stat.OSMemFree)/(1024*1024))
+			f.SetCellValue(sheetName, cell(col+1+i, row), (stat.OSMemTotal-stat.OSMemFree)/unitDivisor)
 		}
 	}
+	sheetHighlight(f, sheetName, "malloc", col+1, row, buckets, styleHighlight)
 	row++
 
-	f.SetCellValue(sheetName, cell(col, row), "mtotal mb")
+	f.SetCellValue(sheetName, cell(col, row), "mtotal "+unitSuffix)
 	f.SetCellStyle(sheetName, cell(col, row), cell(col, row), styleMetric)
 	for i, stat := range stats {
 		if stat.OSMemTotal != 0 {
-			f.SetCellValue(sheetName, cell(col+1+i, row), stat.OSMemTotal/(1024*1024))
+			f.SetCellValue(sheetName, cell(col+1+i, row), stat.OSMemTotal/unitDivisor)
 		}
 	}
 	row++
 
-	f.SetCellValue(sheetName, cell(col, row), "diskrd")
+	f.SetCellValue(sheetName, cell(col, row), "diskrd "+unitSuffix)
 	f.SetCellStyle(sheetName, cell(col, row), cell(col, row), styleMetric)
 	for i, stat := range stats {
-		f.SetCellValue(sheetName, cell(col+1+i, row), stat.OSDiskRead/(1024*1024))
+		f.SetCellValue(sheetName, cell(col+1+i, row), stat.OSDiskRead/unitDivisor)
 	}
+	sheetHighlight(f, sheetName, "diskrd", col+1, row, buckets, styleHighlight)
 	row++
 
-	f.SetCellValue(sheetName, cell(col, row), "diskwr")
+	f.SetCellValue(sheetName, cell(col, row), "diskwr "+unitSuffix)
 	f.SetCellStyle(sheetName, cell(col, row), cell(col, row), styleMetric)
 	for i, stat := range stats {
-		f.SetCellValue(sheetName, cell(col+1+i, row), stat.OSDiskWrite/(1024*1024))
+		f.SetCellValue(sheetName, cell(col+1+i, row), stat.OSDiskWrite/unitDivisor)
 	}
+	sheetHighlight(f, sheetName, "diskwr", col+1, row, buckets, styleHighlight)
 	row++
 
-	f.SetCellValue(sheetName, cell(col, row), "netrcv mb")
+	f.SetCellValue(sheetName, cell(col, row), "netrcv "+unitSuffix)
 	f.SetCellStyle(sheetName, cell(col, row), cell(col, row), styleMetric)
 	for i, stat := range stats {
-		f.SetCellValue(sheetName, cell(col+1+i, row), stat.OSNetReceived/(1024*1024))
+		f.SetCellValue(sheetName, cell(col+1+i, row), stat.OSNetReceived/unitDivisor)
 	}
+	sheetHighlight(f, sheetName, "netrcv", col+1, row, buckets, styleHighlight)
 	row++
 
-	f.SetCellValue(sheetName, cell(col, row), "netsnd mb")
+	f.SetCellValue(sheetName, cell(col, row), "netsnd "+unitSuffix)
 	f.SetCellStyle(sheetName, cell(col, row), cell(col, row), styleMetric)
 	for i, stat := range stats {
-		f.SetCellValue(sheetName, cell(col+1+i, row), stat.OSNetSent/(1024*1024))
+		f.SetCellValue(sheetName, cell(col+1+i, row), stat.OSNetSent/unitDivisor)
 	}
+	sheetHighlight(f, sheetName, "netsnd", col+1, row, buckets, styleHighlight)
 	row++
 
 	f.SetCellValue(sheetName, cell(col, row), "httpcon")
@@ -462,6 +751,7 @@ func sheetAddTab(f *excelize.File, sheetName string, siid string, ss serviceSumm
 	for i, stat := range stats {
 		f.SetCellValue(sheetName, cell(col+1+i, row), stat.EventsEnqueued)
 	}
+	sheetHighlight(f, sheetName, "queued", col+1, row, buckets, styleHighlight)
 	row++
 
 	f.SetCellValue(sheetName, cell(col, row), "routed")
@@ -469,10 +759,50 @@ func sheetAddTab(f *excelize.File, sheetName string, siid string, ss serviceSumm
 	for i, stat := range stats {
 		f.SetCellValue(sheetName, cell(col+1+i, row), stat.EventsRouted)
 	}
+	sheetHighlight(f, sheetName, "routed", col+1, row, buckets, styleHighlight)
 	row++
 
+	// Throughput is derived from each bucket's own duration, which is unaffected by decimation
+	f.SetCellValue(sheetName, cell(col, row), "routed/min")
+	f.SetCellStyle(sheetName, cell(col, row), cell(col, row), styleMetric)
+	if ss.BucketSecs >= 60 {
+		for i, stat := range stats {
+			perMin := float64(stat.EventsRouted) / float64(ss.BucketSecs/60)
+			f.SetCellValue(sheetName, cell(col+1+i, row), math.Round(perMin*10)/10)
+		}
+	}
 	row++
 
+	row++
+
+	// Noteboard stats, which are only reported by noteboard instances of versions that support them
+	noteboard := false
+	for _, stat := range stats {
+		noteboard = noteboard || stat.BoardsActive != 0 || stat.WebsocketsActive != 0
+	}
+	if noteboard {
+		f.SetCellValue(sheetName, cell(col, row), "Noteboard")
+		f.SetCellStyle(sheetName, cell(col, row), cell(col, row), styleCategory)
+		timeHeader(f, sheetName, col+1, row, bucketMins, buckets)
+		row++
+
+		f.SetCellValue(sheetName, cell(col, row), "boards")
+		f.SetCellStyle(sheetName, cell(col, row), cell(col, row), styleMetric)
+		for i, stat := range stats {
+			f.SetCellValue(sheetName, cell(col+1+i, row), stat.BoardsActive)
+		}
+		row++
+
+		f.SetCellValue(sheetName, cell(col, row), "websockets")
+		f.SetCellStyle(sheetName, cell(col, row), cell(col, row), styleMetric)
+		for i, stat := range stats {
+			f.SetCellValue(sheetName, cell(col+1+i, row), stat.WebsocketsActive)
+		}
+		row++
+
+		row++
+	}
+
 	// Fatals stats
 	km := map[string]bool{}
 	for _, stat := range stats {
@@ -498,6 +828,7 @@ func sheetAddTab(f *excelize.File, sheetName string, siid string, ss serviceSumm
 		for i, stat := range stats {
 			f.SetCellValue(sheetName, cell(col+1+i, row), stat.Fatals[k])
 		}
+		sheetHighlight(f, sheetName, "fatals", col+1, row, buckets, styleHighlight)
 		row++
 	}
 	if len(keys) > 0 {
@@ -551,6 +882,23 @@ func sheetAddTab(f *excelize.File, sheetName string, siid string, ss serviceSumm
 		}
 		row++
 
+		f.SetCellValue(sheetName, cell(col, row), "entriesHWM resets")
+		f.SetCellStyle(sheetName, cell(col, row), cell(col, row), styleMetric)
+		for i, stat := range stats {
+			f.SetCellValue(sheetName, cell(col+1+i, row), stat.Caches[k].Resets)
+		}
+		row++
+
+		f.SetCellValue(sheetName, cell(col, row), "hit rate %")
+		f.SetCellStyle(sheetName, cell(col, row), cell(col, row), styleMetric)
+		for i, stat := range stats {
+			rate, ok := cacheHitRate(stat.Caches[k])
+			if ok {
+				f.SetCellValue(sheetName, cell(col+1+i, row), int64(rate))
+			}
+		}
+		row++
+
 	}
 	if len(keys) > 0 {
 		row++
@@ -674,6 +1022,141 @@ func sheetAddTab(f *excelize.File, sheetName string, siid string, ss serviceSumm
 	return
 }
 
+// Reduce the stats, which are ordered newest first, to at most maxColumns by merging each span of
+// N buckets into one that ends at the newest of them, so that the time headers remain accurate
+// and no bucket's activity is dropped
+func sheetDecimate(stats []StatsStat, maxColumns int) (decimated []StatsStat, every int) {
+	every = 1
+	if maxColumns <= 0 || len(stats) <= maxColumns {
+		return stats, every
+	}
+	every = (len(stats) + maxColumns - 1) / maxColumns
+	for i := 0; i < len(stats); i += every {
+		end := i + every
+		if end > len(stats) {
+			end = len(stats)
+		}
+		decimated = append(decimated, sheetMergeSpan(stats[i:end]))
+	}
+	return
+}
+
+// Merge a span of buckets, ordered newest first, into one, summing the counters of activity within
+// the buckets and taking the levels from the newest bucket having data
+func sheetMergeSpan(span []StatsStat) (merged StatsStat) {
+
+	merged = span[0]
+	for _, stat := range span {
+		if stat.OSMemTotal != 0 {
+			merged = stat
+			break
+		}
+	}
+	merged.SnapshotTaken = span[0].SnapshotTaken
+	merged.OSDiskRead, merged.OSDiskWrite, merged.OSNetReceived, merged.OSNetSent = 0, 0, 0, 0
+	merged.HttpConnTotal, merged.HttpConnReused = 0, 0
+	merged.DiscoveryHandlersActivated, merged.EphemeralHandlersActivated = 0, 0
+	merged.ContinuousHandlersActivated, merged.NotificationHandlersActivated = 0, 0
+	merged.EventsEnqueued, merged.EventsRouted = 0, 0
+	merged.Databases = map[string]StatsDatabase{}
+	merged.Caches = map[string]StatsCache{}
+	merged.API = map[string]int64{}
+	merged.Fatals = map[string]int64{}
+	for k, v := range span[0].Caches {
+		merged.Caches[k] = StatsCache{Entries: v.Entries}
+	}
+
+	readMs := map[string]int64{}
+	writeMs := map[string]int64{}
+	for _, stat := range span {
+		merged.OSDiskRead += stat.OSDiskRead
+		merged.OSDiskWrite += stat.OSDiskWrite
+		merged.OSNetReceived += stat.OSNetReceived
+		merged.OSNetSent += stat.OSNetSent
+		merged.HttpConnTotal += stat.HttpConnTotal
+		merged.HttpConnReused += stat.HttpConnReused
+		merged.DiscoveryHandlersActivated += stat.DiscoveryHandlersActivated
+		merged.EphemeralHandlersActivated += stat.EphemeralHandlersActivated
+		merged.ContinuousHandlersActivated += stat.ContinuousHandlersActivated
+		merged.NotificationHandlersActivated += stat.NotificationHandlersActivated
+		merged.EventsEnqueued += stat.EventsEnqueued
+		merged.EventsRouted += stat.EventsRouted
+
+		// Database times are averages, so they're weighted by the operations in each bucket
+		for k, v := range stat.Databases {
+			m := merged.Databases[k]
+			m.Reads += v.Reads
+			m.Writes += v.Writes
+			readMs[k] += v.ReadMs * v.Reads
+			writeMs[k] += v.WriteMs * v.Writes
+			if v.ReadMsMax > m.ReadMsMax {
+				m.ReadMsMax = v.ReadMsMax
+			}
+			if v.WriteMsMax > m.WriteMsMax {
+				m.WriteMsMax = v.WriteMsMax
+			}
+			merged.Databases[k] = m
+		}
+		for k, v := range stat.Caches {
+			m := merged.Caches[k]
+			m.Invalidations += v.Invalidations
+			m.Hits += v.Hits
+			m.Misses += v.Misses
+			m.Resets += v.Resets
+			if v.EntriesHWM > m.EntriesHWM {
+				m.EntriesHWM = v.EntriesHWM
+			}
+			merged.Caches[k] = m
+		}
+		for k, v := range stat.API {
+			merged.API[k] += v
+		}
+		for k, v := range stat.Fatals {
+			merged.Fatals[k] += v
+		}
+	}
+	for k, m := range merged.Databases {
+		if m.Reads > 0 {
+			m.ReadMs = readMs[k] / m.Reads
+		}
+		if m.Writes > 0 {
+			m.WriteMs = writeMs[k] / m.Writes
+		}
+		merged.Databases[k] = m
+	}
+
+	return
+
+}
+
+// Find the columns whose buckets, each ending at its snapshot time, contain a service version
+// change, returning the version deployed in each
+func sheetDeployMarkers(stats []StatsStat, bucketSecs int64, changes []versionChange) (deploys map[int]string) {
+	deploys = map[int]string{}
+	if bucketSecs <= 0 {
+		return
+	}
+	for _, c := range changes {
+		for i, stat := range stats {
+			if stat.SnapshotTaken != 0 && c.Time > stat.SnapshotTaken-bucketSecs && c.Time <= stat.SnapshotTaken {
+				deploys[i] = c.Version
+			}
+		}
+	}
+	return
+}
+
+// Get the divisor and labels for the configured units of the OS rows, defaulting to MiB
+func sheetUnits() (divisor uint64, name string, suffix string) {
+	switch strings.ToLower(Config.SheetUnits) {
+	case "kb", "kib":
+		return 1024, "KiB", "kb"
+	case "gb", "gib":
+		return 1024 * 1024 * 1024, "GiB", "gb"
+	}
+	return 1024 * 1024, "MiB", "mb"
+}
+
 // Generate an uptime string
 func uptimeStr(started int64, now int64) (s string) {
 	uptimeSecs := now - started
@@ -702,6 +1185,20 @@ func cell(col int, row int) string {
 	return cell
 }
 
+// Highlight the cells of a row of bucket values that exceed the threshold configured for the
+// metric, leaving the row as-is if none is configured
+func sheetHighlight(f *excelize.File, sheetName string, metric string, col int, row int, buckets int, style int) {
+	threshold, present := Config.SheetHighlightThresholds[metric]
+	if !present || buckets == 0 {
+		return
+	}
+	area := cell(col, row) + ":" + cell(col+buckets-1, row)
+	err := f.SetConditionalFormat(sheetName, area, fmt.Sprintf(`[{"type":"cell","criteria":">","format":%d,"value":"%v"}]`, style, threshold))
+	if err != nil {
+		fmt.Printf("sheet: can't highlight %s: %s\n", metric, err)
+	}
+}
+
 // Generate a time header at the specified col/row
 func timeHeader(f *excelize.File, sheetName string, col int, row int, bucketMins int, buckets int) {
 	style, _ := f.NewStyle(`{"alignment":{"horizontal":"right"},"font":{"color":"0000ff","bold":true,"italic":true}}`)
@@ -0,0 +1,187 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/xuri/excelize/v2"
+)
+
+func TestSheetFallbackSummary(t *testing.T) {
+
+	// The running instances, after a deploy that changed the bucket size
+	ss := serviceSummary{
+		ServiceVersion:     "v2",
+		BucketSecs:         60,
+		ServiceInstanceIDs: []string{"new1:handler"},
+		VersionChanges:     []versionChange{{Version: "v2"}},
+	}
+
+	// What was saved by the previous version
+	hs := HostStats{
+		BucketMins: 5,
+		Stats: map[string][]StatsStat{
+			"old2:discovery": {{SnapshotTaken: 600, NodeStarted: 100}, {SnapshotTaken: 300, NodeStarted: 100}},
+			"old1:handler":   {{SnapshotTaken: 600, NodeStarted: 200}},
+			"old3:handler":   {},
+		},
+	}
+
+	fallbackSs, handlers := sheetFallbackSummary(ss, "v1", hs)
+	if fallbackSs.ServiceVersion != "v1" || fallbackSs.BucketSecs != 300 {
+		t.Errorf("version %s bucket secs %d, want v1 and 300", fallbackSs.ServiceVersion, fallbackSs.BucketSecs)
+	}
+	wantSiids := []string{"old1:handler", "old2:discovery", "old3:handler"}
+	if !reflect.DeepEqual(fallbackSs.ServiceInstanceIDs, wantSiids) {
+		t.Errorf("instances %v, want %v", fallbackSs.ServiceInstanceIDs, wantSiids)
+	}
+	if !reflect.DeepEqual(fallbackSs.VersionChanges, ss.VersionChanges) {
+		t.Errorf("version changes %v, want %v", fallbackSs.VersionChanges, ss.VersionChanges)
+	}
+	wantStarted := map[string]int64{"old1:handler": 200, "old2:discovery": 100, "old3:handler": 0}
+	for siid, started := range wantStarted {
+		if h := handlers[siid]; h.NodeID != siid || h.NodeStarted != started {
+			t.Errorf("%s: handler %+v, want started %d", siid, h, started)
+		}
+	}
+	if _, present := handlers["new1:handler"]; present {
+		t.Errorf("running instance described as one of the saved ones")
+	}
+
+}
+
+func TestSheetUnits(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved }()
+
+	// An instance with 8 GiB of memory
+	stats := []StatsStat{{SnapshotTaken: 1646092800, OSMemTotal: 8 * 1024 * 1024 * 1024, OSMemFree: 2 * 1024 * 1024 * 1024}}
+	ss := serviceSummary{ServiceVersion: "v1", BucketSecs: 300}
+
+	tests := []struct {
+		units  string
+		header string
+		value  string
+	}{
+		{"", "mtotal mb", "8192"},
+		{"mb", "mtotal mb", "8192"},
+		{"kib", "mtotal kb", "8388608"},
+		{"GB", "mtotal gb", "8"},
+	}
+	for _, tt := range tests {
+		Config.SheetUnits = tt.units
+		f := excelize.NewFile()
+		if errstr := sheetAddTab(f, "test", "summary", ss, AppHandler{}, stats); errstr != "" {
+			t.Fatalf("%q: %s", tt.units, errstr)
+		}
+		rows, err := f.GetRows("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, row := range rows {
+			if len(row) > 1 && row[0] == tt.header {
+				found = true
+				if row[1] != tt.value {
+					t.Errorf("%q: %s is %s, want %s", tt.units, tt.header, row[1], tt.value)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("%q: no %s row", tt.units, tt.header)
+		}
+	}
+}
+
+func TestSheetHandlerRejectsTraversal(t *testing.T) {
+	saved := configDataDirectory
+	defer func() { configDataDirectory = saved }()
+	configDataDirectory = t.TempDir() + "/"
+	os.WriteFile(configDataDirectory+"prod-20220301-120000.xlsx", []byte("sheet"), 0644)
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{sheetRoute + "prod-20220301-120000.xlsx", http.StatusOK},
+		{sheetRoute + "prod-20220302-120000.xlsx", http.StatusNotFound},
+		{sheetRoute + "../../etc/passwd", http.StatusBadRequest},
+		{sheetRoute + "..%2F..%2Fetc%2Fpasswd", http.StatusBadRequest},
+		{sheetRoute + "%2Fetc%2Fpasswd", http.StatusBadRequest},
+		{sheetRoute + "..\\..\\config.json", http.StatusBadRequest},
+		{sheetRoute + "..prod-20220301-120000.xlsx", http.StatusBadRequest},
+		{sheetRoute + "config.json", http.StatusBadRequest},
+		{sheetRoute, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		rsp := httptest.NewRecorder()
+		inboundWebSheetHandler(rsp, httptest.NewRequest("GET", tt.path, nil))
+		if rsp.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.path, rsp.Code, tt.status)
+		}
+	}
+}
+
+func TestSheetDecimate(t *testing.T) {
+
+	// Ten 5-minute buckets, newest first, each routing one more event than the one before it
+	stats := []StatsStat{}
+	for i := 0; i < 10; i++ {
+		stats = append(stats, StatsStat{
+			SnapshotTaken: int64(3000 - i*300),
+			OSMemTotal:    1,
+			OSMemFree:     uint64(100 - i),
+			EventsRouted:  int64(10 - i),
+			Databases:     map[string]StatsDatabase{"db": {Reads: 1, ReadMs: int64(10 - i)}},
+		})
+	}
+	stats[1].Databases = map[string]StatsDatabase{"db": {Reads: 3, ReadMs: 1}}
+
+	tests := []struct {
+		name       string
+		maxColumns int
+		every      int
+		times      []int64
+		routed     []int64
+	}{
+		{"within the limit", 10, 1, []int64{3000, 2700, 2400, 2100, 1800, 1500, 1200, 900, 600, 300}, []int64{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}},
+		{"pairs", 5, 2, []int64{3000, 2400, 1800, 1200, 600}, []int64{19, 15, 11, 7, 3}},
+		{"uneven spans", 4, 3, []int64{3000, 2100, 1200, 300}, []int64{27, 18, 9, 1}},
+	}
+	for _, tt := range tests {
+		decimated, every := sheetDecimate(stats, tt.maxColumns)
+		if every != tt.every || len(decimated) != len(tt.times) {
+			t.Errorf("%s: %d columns of every %d, want %d of every %d", tt.name, len(decimated), every, len(tt.times), tt.every)
+			continue
+		}
+		total := int64(0)
+		for i, stat := range decimated {
+			if stat.SnapshotTaken != tt.times[i] || stat.EventsRouted != tt.routed[i] {
+				t.Errorf("%s: column %d at %d routed %d, want at %d routed %d", tt.name, i, stat.SnapshotTaken, stat.EventsRouted, tt.times[i], tt.routed[i])
+			}
+			total += stat.EventsRouted
+		}
+		if total != 55 {
+			t.Errorf("%s: %d events routed in total, want 55", tt.name, total)
+		}
+	}
+
+	// Levels come from the newest bucket, and database times are weighted by operations
+	decimated, _ := sheetDecimate(stats, 5)
+	if decimated[0].OSMemFree != 100 {
+		t.Errorf("free memory %d, want the newest bucket's 100", decimated[0].OSMemFree)
+	}
+	if db := decimated[0].Databases["db"]; db.Reads != 4 || db.ReadMs != 3 {
+		t.Errorf("database %d reads averaging %d ms, want 4 averaging 3", db.Reads, db.ReadMs)
+	}
+	if stats[0].EventsRouted != 10 || stats[1].Databases["db"].Reads != 3 {
+		t.Errorf("the stats being decimated were modified")
+	}
+}
@@ -11,21 +11,88 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/slack-go/slack"
 )
 
-// Send a message to Slack.  See:
+// Severity of a Slack notification, which determines whether it may be held during quiet hours
+type slackSeverity int
+
+const (
+	// Notifications of changes and recoveries, which may be held during quiet hours
+	slackRoutine slackSeverity = iota
+	// Alerts that need attention, which are always sent immediately
+	slackCritical
+)
+
+// Send a routine message to Slack.  See:
 // https://api.slack.com/reference/messaging/payload
 // https://github.com/slack-go/slack
 func slackSendMessage(message string) (err error) {
+	return slackSendMessageVia(Config.SlackWebhookURL, slackRoutine, message)
+}
+
+// Send a critical alert to Slack, even during quiet hours
+func slackSendAlert(message string) (err error) {
+	return slackSendMessageVia(Config.SlackWebhookURL, slackCritical, message)
+}
+
+// Send a message to Slack via a specific webhook, such as to route it to a different channel
+func slackSendMessageVia(webhookURL string, severity slackSeverity, message string) (err error) {
+
+	// Hold routine notifications during quiet hours
+	if severity == slackRoutine && quietHold(webhookURL, message, time.Now()) {
+		return
+	}
+
+	return slackPostMessage(webhookURL, message)
+
+}
+
+// Post a message to Slack via a webhook, falling back to the standby webhook
+func slackPostMessage(webhookURL string, message string) (err error) {
 
 	payload := &slack.WebhookMessage{
 		Text: message,
 	}
 
-	return slack.PostWebhook(Config.SlackWebhookURL, payload)
+	// If the primary webhook fails, such as because of rate-limiting or misconfiguration,
+	// fall back to the standby webhook so that the alert isn't silently lost.
+	err = slack.PostWebhook(webhookURL, payload)
+	if err != nil && Config.SlackStandbyWebhookURL != "" {
+		fmt.Printf("slack: primary webhook failed (%s), sending via standby\n", err)
+		err = slack.PostWebhook(Config.SlackStandbyWebhookURL, payload)
+	}
+	if err != nil {
+		fmt.Printf("slack: error sending message: %s\n", err)
+	}
 
+	return
+
+}
+
+// Events whose notifications mention the channel unless configured otherwise
+const slackEventRestart = "restart"
+const slackEventHandlersChanged = "handlers_changed"
+const slackEventInstanceDrop = "instance_drop"
+const slackEventCrashLoop = "crash_loop"
+const slackEventFatalSpread = "fatal_spread"
+
+// Get the prefix with which to mention the channel in the notification of an event, which is
+// configured as "none", "here", or "channel" (the default).  The mention is only about who is
+// notified; whether it's sent during quiet hours depends upon the severity with which it's sent.
+func slackMention(event string) string {
+	switch strings.ToLower(strings.TrimPrefix(Config.SlackMentions[event], "@")) {
+	case "none":
+		return ""
+	case "here":
+		return "@here: "
+	case "", "channel":
+		return "@channel: "
+	}
+	fmt.Printf("slack: unrecognized mention '%s' for %s\n", Config.SlackMentions[event], event)
+	return "@channel: "
 }
 
 // Slack inbound 'slash command' request handler
@@ -39,8 +106,23 @@ func inboundWebSlackRequestHandler(w http.ResponseWriter, r *http.Request) {
 
 	switch s.Command {
 	case "/notehub":
-		responseMarkdown := slackCommandWatcher(s)
-		if len(responseMarkdown) > 0 && slackUsingBlocksForResponses() {
+		if hostname, bare := slackBareHostCommand(s.Text); bare && slackUsingBlocksForResponses() {
+			w.Header().Set("Content-type", "application/json")
+			slackResponse := slack.WebhookMessage{}
+			slackResponse.Blocks = slackHostActionBlocks(hostname)
+			slackResponseJSON, _ := json.Marshal(slackResponse)
+			w.Write(slackResponseJSON)
+			return
+		}
+		responseMarkdown, responseIsJSON := slackCommandWatcher(s)
+		if responseIsJSON {
+			// Slack only renders text or blocks, so the JSON is sent verbatim within text
+			w.Header().Set("Content-type", "application/json")
+			slackResponse := slack.WebhookMessage{}
+			slackResponse.Text = slackJSONCodeBlock(responseMarkdown)
+			slackResponseJSON, _ := json.Marshal(slackResponse)
+			w.Write(slackResponseJSON)
+		} else if len(responseMarkdown) > 0 && slackUsingBlocksForResponses() {
 			blocks := slack.Blocks{
 				BlockSet: []slack.Block{
 					slack.NewSectionBlock(
@@ -67,20 +149,150 @@ func inboundWebSlackRequestHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// The actions offered as buttons when just a host is specified, mapped to their button labels
+var slackHostActions = []struct {
+	actionID string
+	label    string
+}{
+	{"activity", "Activity"},
+	{"sheet", "Sheet"},
+	{"goroutines", "Goroutines"},
+	{"heap", "Heap"},
+}
+
+// Commands that aren't about a particular host, which take precedence over any host of the same name
+var slackFleetCommands = []string{"fleet", "internal", "hosts", "throughput", "total", "datadog"}
+
+// Determine whether the command text is just the name of a configured host, rather than a
+// command that isn't about a particular host
+func slackBareHostCommand(text string) (hostname string, bare bool) {
+	args := strings.Fields(text)
+	if len(args) != 1 || strings.HasPrefix(args[0], "-") {
+		return
+	}
+	for _, command := range slackFleetCommands {
+		if args[0] == command {
+			return
+		}
+	}
+	for _, host := range Config.MonitoredHosts {
+		if host.Name == args[0] {
+			return args[0], true
+		}
+	}
+	return
+}
+
+// Generate the blocks offering one-click actions for a host
+func slackHostActionBlocks(hostname string) *slack.Blocks {
+	elements := []slack.BlockElement{}
+	for _, a := range slackHostActions {
+		elements = append(elements, slack.NewButtonBlockElement(a.actionID, hostname,
+			slack.NewTextBlockObject(slack.PlainTextType, a.label, false, false)))
+	}
+	return &slack.Blocks{
+		BlockSet: []slack.Block{
+			slack.NewSectionBlock(
+				slack.NewTextBlockObject(slack.MarkdownType, "*"+hostname+"*", false, false),
+				nil,
+				nil,
+			),
+			slack.NewActionBlock("notehub-actions", elements...),
+		},
+	}
+}
+
+// Slack inbound interactive action handler, for buttons pressed within our blocks
+func inboundWebSlackActionHandler(w http.ResponseWriter, r *http.Request) {
+
+	var cb slack.InteractionCallback
+	err := json.Unmarshal([]byte(r.FormValue("payload")), &cb)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Slack requires a prompt acknowledgement, so results are all sent as messages
+	for _, action := range cb.ActionCallback.BlockActions {
+		hostname := action.Value
+		switch action.ActionID {
+		case "activity":
+			go watcherActivity(hostname, false)
+		case "sheet":
+			go func() { slackPostMessage(Config.SlackWebhookURL, watcherShow(hostname, "")) }()
+		case "goroutines", "heap":
+			showWhat := action.ActionID
+			go func() { slackPostMessage(Config.SlackWebhookURL, watcherShow(hostname, showWhat)) }()
+		default:
+			fmt.Printf("slack: unrecognized action '%s'\n", action.ActionID)
+		}
+	}
+
+}
+
 // True if we're using blocks, which have certain limitations
 func slackUsingBlocksForResponses() bool {
 	return true
 }
 
+// Generic JSON response for commands whose only result is a message
+type slackMessageResponse struct {
+	Host    string `json:"host,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Format a command's structured response for the --json option
+func slackJSONResponse(r interface{}) string {
+	rspJSON, err := json.MarshalIndent(r, "", "    ")
+	if err != nil {
+		rspJSON, _ = json.Marshal(slackMessageResponse{Message: err.Error()})
+	}
+	return string(rspJSON)
+}
+
+// Wrap a JSON response in a code block, so that Slack shows it verbatim
+func slackJSONCodeBlock(rspJSON string) string {
+	return "```" + rspJSON + "```"
+}
+
+// Determine whether the sender of a slash command may run state-changing commands, either
+// because they or the channel they're in is allowed, or because no allowlist is configured
+func slackAuthorized(s slack.SlashCommand) bool {
+	if len(Config.SlackAllowedUsers) == 0 && len(Config.SlackAllowedChannels) == 0 {
+		return true
+	}
+	for _, id := range Config.SlackAllowedUsers {
+		if id == s.UserID {
+			return true
+		}
+	}
+	for _, id := range Config.SlackAllowedChannels {
+		if id == s.ChannelID {
+			return true
+		}
+	}
+	return false
+}
+
+// Response to a caller who isn't permitted to run a state-changing command
+func slackUnauthorized(s slack.SlashCommand, command string) string {
+	fmt.Printf("slack: %s (%s) in %s is not permitted to run '%s'\n", s.UserName, s.UserID, s.ChannelID, command)
+	return fmt.Sprintf("sorry, you aren't permitted to run '%s' from here", command)
+}
+
 // Slack /notehub request handler
-func slackCommandWatcher(s slack.SlashCommand) (response string) {
+func slackCommandWatcher(s slack.SlashCommand) (response string, responseIsJSON bool) {
 
 	// Register flags
 	f := flag.NewFlagSet("/notehub", flag.ContinueOnError)
 
 	// Add options here
-	//	var fTest string
-	//	f.StringVar(&fTest, "test", "", "testing 1-2-3")
+	var fJSON bool
+	f.BoolVar(&fJSON, "json", false, "respond with JSON rather than text")
+	var fFull bool
+	f.BoolVar(&fFull, "full", false, "show the full load balancer JSON rather than a summary")
+	var fRefresh bool
+	f.BoolVar(&fRefresh, "refresh", false, "re-ping the host rather than using recently-discovered instances")
 
 	// Pre-generate error output
 	errOutput := bytes.NewBufferString("")
@@ -94,31 +306,180 @@ func slackCommandWatcher(s slack.SlashCommand) (response string) {
 
 	// Server arg is required
 	if f.Arg(0) == "" {
-		return "/notehub <server> [<action> [<args>]]"
+		response = "/notehub [--json] [--full] [--refresh] <server> [<action> [<args>]]"
+		if fJSON {
+			return slackJSONResponse(slackMessageResponse{Message: response}), true
+		}
+		return
 	}
 
-	// Dispatch based on primary arg
-	switch f.Arg(1) {
+	// Commands that aren't about a particular server
+	if f.Arg(0) == "fleet" {
+		go func() { slackPostMessage(Config.SlackWebhookURL, sheetGetFleetStats()) }()
+		response = "one moment, please"
+		if fJSON {
+			return slackJSONResponse(slackMessageResponse{Message: response}), true
+		}
+		return
+	}
+	if f.Arg(0) == "internal" {
+		if fJSON {
+			return slackJSONResponse(watcherGetInternal()), true
+		}
+		response = watcherInternal()
+		return
+	}
+	if f.Arg(0) == "hosts" {
+		if fJSON {
+			return slackJSONResponse(watcherGetHosts()), true
+		}
+		response = watcherHosts()
+		return
+	}
+	if f.Arg(0) == "throughput" {
+		if fJSON {
+			return slackJSONResponse(watcherGetThroughput(f.Arg(1))), true
+		}
+		response = watcherThroughput(f.Arg(1))
+		return
+	}
+	if f.Arg(0) == "total" {
+		if fJSON {
+			return slackJSONResponse(watcherGetTotal()), true
+		}
+		response = watcherTotal()
+		return
+	}
+	if f.Arg(0) == "datadog" {
+		if f.Arg(1) != "" && !slackAuthorized(s) {
+			response = slackUnauthorized(s, "datadog "+f.Arg(1))
+		} else {
+			response = datadogCommand(f.Arg(1))
+		}
+		if fJSON {
+			return slackJSONResponse(slackMessageResponse{Message: response}), true
+		}
+		return
+	}
+
+	// Force the host to be re-pinged if requested
+	if fRefresh {
+		watcherInvalidateServiceInstances(f.Arg(0))
+	}
+
+	// Commands that change the state of the host or of the watcher are restricted
+	// to allowed callers, while those that only report on it are available to all.
+	command := f.Arg(1)
+	if (command == "request" || command == "archive" || command == "resetcache") && !slackAuthorized(s) {
+		command = "unauthorized"
+	}
+
+	// Dispatch based on primary arg, with commands that have structured
+	// results returning them directly when JSON is requested.
+	switch command {
 
 	case "":
-		return watcherShow(f.Arg(0), "")
+		response = watcherShow(f.Arg(0), "")
+
+	case "sheet":
+		response = watcherShow(f.Arg(0), "")
 
 	case "stats":
 		statsMaintainNow.Signal()
-		return "stats maintenance update requested"
+		response = "stats maintenance update requested"
 
 	case "show":
-		return watcherShow(f.Arg(0), f.Arg(2))
+		showWhat := f.Arg(2)
+		if fFull && showWhat == "lb" {
+			showWhat = "lb-full"
+		}
+		if fJSON && showWhat != "" {
+			return slackJSONResponse(watcherGetShow(f.Arg(0), showWhat)), true
+		}
+		response = watcherShow(f.Arg(0), showWhat)
 
 	case "activity":
-		go watcherActivity(f.Arg(0))
-		return ""
+		if f.Arg(2) == "trend" {
+			if fJSON {
+				return slackJSONResponse(watcherGetActivityTrend(f.Arg(0))), true
+			}
+			response = watcherActivityTrend(f.Arg(0))
+			break
+		}
+		go watcherActivity(f.Arg(0), fJSON)
+		return "", false
 
 	case "request":
-		return watcherSendRequest(f.Arg(0), f.Arg(2))
+		if fJSON {
+			return slackJSONResponse(watcherGetSendRequest(f.Arg(0), f.Arg(2), f.Arg(3))), true
+		}
+		response = watcherSendRequest(f.Arg(0), f.Arg(2), f.Arg(3))
+
+	case "churn":
+		if fJSON {
+			return slackJSONResponse(watcherGetChurn(f.Arg(0), f.Arg(2))), true
+		}
+		response = watcherChurn(f.Arg(0), f.Arg(2))
+
+	case "dbgrowth":
+		if fJSON {
+			return slackJSONResponse(watcherGetDBGrowth(f.Arg(0), f.Arg(2))), true
+		}
+		response = watcherDBGrowth(f.Arg(0), f.Arg(2))
+
+	case "top":
+		if fJSON {
+			return slackJSONResponse(watcherGetTop(f.Arg(0))), true
+		}
+		response = watcherTop(f.Arg(0))
+
+	case "regression":
+		if fJSON {
+			return slackJSONResponse(watcherGetRegression(f.Arg(0))), true
+		}
+		response = watcherRegression(f.Arg(0))
+
+	case "dump":
+		if fJSON {
+			return slackJSONResponse(watcherGetDump(f.Arg(0), f.Arg(2))), true
+		}
+		response = watcherDump(f.Arg(0), f.Arg(2))
+
+	case "dumproutines":
+		if fJSON {
+			return slackJSONResponse(watcherGetDumpRoutines(f.Arg(0), f.Arg(2))), true
+		}
+		response = watcherDumpRoutines(f.Arg(0), f.Arg(2))
+
+	case "selftest":
+		if fJSON {
+			return slackJSONResponse(watcherGetSelftest(f.Arg(0))), true
+		}
+		response = watcherSelftest(f.Arg(0))
+
+	case "resetcache":
+		response = watcherResetCache(f.Arg(0))
+
+	case "archive":
+		filename, err := statsArchiveHost(f.Arg(0))
+		if err != nil {
+			response = fmt.Sprintf("error archiving %s: %s", f.Arg(0), err)
+		} else {
+			response = fmt.Sprintf("archived %s", filename)
+		}
+
+	case "unauthorized":
+		response = slackUnauthorized(s, f.Arg(1))
+
+	default:
+		response = fmt.Sprintf("request '%s' not recognized\n"+errOutput.String(), f.Arg(0))
 
 	}
 
-	return fmt.Sprintf("request '%s' not recognized\n"+errOutput.String(), f.Arg(0))
+	// Wrap the text response for commands without a structured response
+	if fJSON {
+		return slackJSONResponse(slackMessageResponse{Host: f.Arg(0), Message: response}), true
+	}
+	return
 
 }
@@ -0,0 +1,135 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/slack-go/slack"
+)
+
+// A webhook that records the messages posted to it, failing if specified
+func slackTestWebhook(t *testing.T, status int, received *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg slack.WebhookMessage
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Errorf("malformed webhook payload: %s", err)
+		}
+		*received = append(*received, msg.Text)
+		w.WriteHeader(status)
+	}))
+}
+
+func TestSlackFallsBackToStandbyWebhook(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved }()
+
+	tests := []struct {
+		name          string
+		primaryStatus int
+		standby       bool
+		wantPrimary   int
+		wantStandby   int
+		wantErr       bool
+	}{
+		{"primary succeeds", http.StatusOK, true, 1, 0, false},
+		{"primary rate-limited", http.StatusTooManyRequests, true, 1, 1, false},
+		{"primary fails without a standby", http.StatusInternalServerError, false, 1, 0, true},
+	}
+	for _, tt := range tests {
+		var primaryReceived, standbyReceived []string
+		primary := slackTestWebhook(t, tt.primaryStatus, &primaryReceived)
+		standby := slackTestWebhook(t, http.StatusOK, &standbyReceived)
+		Config.SlackStandbyWebhookURL = ""
+		if tt.standby {
+			Config.SlackStandbyWebhookURL = standby.URL
+		}
+
+		err := slackPostMessage(primary.URL, "host unreachable")
+		primary.Close()
+		standby.Close()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %t", tt.name, err, tt.wantErr)
+		}
+		if len(primaryReceived) != tt.wantPrimary || len(standbyReceived) != tt.wantStandby {
+			t.Errorf("%s: primary received %d, standby %d, want %d and %d", tt.name,
+				len(primaryReceived), len(standbyReceived), tt.wantPrimary, tt.wantStandby)
+		}
+		for _, text := range standbyReceived {
+			if text != "host unreachable" {
+				t.Errorf("%s: standby received %q", tt.name, text)
+			}
+		}
+	}
+}
+
+// Send a /notehub command to the slash command handler, returning the response body
+func slackTestCommand(t *testing.T, text string) string {
+	form := url.Values{"command": {"/notehub"}, "text": {text}}
+	req := httptest.NewRequest(http.MethodPost, "/slack", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rsp := httptest.NewRecorder()
+	inboundWebSlackRequestHandler(rsp, req)
+	return rsp.Body.String()
+}
+
+func TestSlackBareHostCommand(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved }()
+	Config.MonitoredHosts = []MonitoredHost{{Name: "prod", Addr: "prod.example.com"}}
+	Config.DatadogAPIKey = ""
+	statsInit()
+
+	tests := []struct {
+		text    string
+		buttons bool
+		want    string
+	}{
+		{"prod", true, "*prod*"},
+		{"hosts", false, "1 hosts configured"},
+		{"--json hosts", false, `\"address\": \"prod.example.com\"`},
+		{"staging", false, ""},
+		{"total", false, "prod         no stats loaded"},
+		{"internal", false, "hosts loaded: 0"},
+		{"datadog", false, "datadog uploads are not configured"},
+		{"throughput", false, "no events routed in the most recent buckets"},
+	}
+	for _, tt := range tests {
+		got := slackTestCommand(t, tt.text)
+		if strings.Contains(got, "notehub-actions") != tt.buttons {
+			t.Errorf("/notehub %s: buttons %t, want %t: %s", tt.text, !tt.buttons, tt.buttons, got)
+		}
+		if !strings.Contains(got, tt.want) {
+			t.Errorf("/notehub %s: response %s, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSlackFleetCommandsTakePrecedenceOverHosts(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved }()
+
+	// Even a host that happens to be named for a fleet command doesn't hide the command
+	Config.MonitoredHosts = []MonitoredHost{{Name: "prod"}, {Name: "fleet"}}
+	tests := []struct {
+		text string
+		bare bool
+	}{
+		{"prod", true},
+		{"fleet", false},
+		{"--json prod", false},
+		{"prod activity", false},
+	}
+	for _, tt := range tests {
+		if _, bare := slackBareHostCommand(tt.text); bare != tt.bare {
+			t.Errorf("%q: bare host %t, want %t", tt.text, bare, tt.bare)
+		}
+	}
+}
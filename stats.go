@@ -8,17 +8,23 @@ import (
 	"archive/zip"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Standard or zip file
 const zipType = ".zip"
 const jsonType = ".json"
+const textType = ".txt"
 const currentType = zipType
 
 // AggregatedStat is a structure used to aggregate stats across service instances
@@ -41,6 +47,8 @@ type AggregatedStat struct {
 	NewHandlersNotification int64                    `json:"handlers_notification_new,omitempty"`
 	EventsReceived          int64                    `json:"events_received,omitempty"`
 	EventsRouted            int64                    `json:"events_routed,omitempty"`
+	BoardsActive            int64                    `json:"boards_active,omitempty"`
+	WebsocketsActive        int64                    `json:"websockets_active,omitempty"`
 	DatabaseReads           int64                    `json:"database_reads,omitempty"`
 	DatabaseWrites          int64                    `json:"database_writes,omitempty"`
 	APITotal                int64                    `json:"api_total,omitempty"`
@@ -74,18 +82,39 @@ type HostStats struct {
 // Globals
 const secs1Day = (60 * 60 * 24)
 
+// The rolling window of stats kept in memory
+const statsWindowSecs = 2 * secs1Day
+
 var statsInitCompleted int64
 var statsMaintainNow *Event
 var statsLock sync.Mutex
 var stats map[string]HostStats
 var statsServiceVersions map[string]string
+var statsDiscoveryImbalanced map[string]bool
+var statsRestartsReported map[string]int64
+var statsStaleReported map[string]bool
+var statsMemoryLow map[string]bool
+var statsFatalSpreading map[string]bool
+var statsFatalSpreadThrough map[string]int64
+var statsDiskWriteSpikeAlerted map[string]int64
+var statsCacheHitRateLow map[string]bool
+var statsUploadedThrough map[string]int64
+
+// A summary of each host's in-memory stats, kept under its own lock so that it can be read
+// without waiting for statsLock, which is held throughout each poll of a host
+type statsSummary struct {
+	statsTime     int64
+	eventsPending int64
+}
+
+var statsSummaryLock sync.Mutex
+var statsSummaries map[string]statsSummary
 
 // Trace
 const addStatsTrace = true
 
 // Stats maintenance task
 func statsMaintainer() {
-	var err error
 
 	// Load past stats into the in-memory maps
 	statsInit()
@@ -96,19 +125,71 @@ func statsMaintainer() {
 
 		// Proceed if signalled, else do this several times per hour
 		// because stats are only maintained by services for an hour.
-		statsMaintainNow.Wait(time.Minute * time.Duration(Config.MonitorPeriodMins))
+		statsMaintainNow.Wait(time.Minute*time.Duration(Config.MonitorPeriodMins) + pollJitter())
 
 		// Maintain for every enabled host
-		for _, host := range Config.MonitoredHosts {
-			if !host.Disabled {
-				_, _, err = statsUpdateHost(host.Name, host.Addr, lastUpdatedDay != todayTime())
-				if err != nil {
-					fmt.Printf("%s: error updating stats: %s\n", host.Name, err)
-				}
+		statsUpdateAllHosts(lastUpdatedDay != todayTime())
+	}
+
+}
+
+// Update the stats for every enabled host, returning the number of hosts that failed
+func statsUpdateAllHosts(reload bool) (failed int) {
+	polled := 0
+	for _, host := range Config.MonitoredHosts {
+		if !host.Disabled {
+			// Spread the hosts' polls out rather than issuing them back-to-back
+			if polled > 0 {
+				time.Sleep(pollJitter())
+			}
+			polled++
+			_, _, err := statsUpdateHost(host.Name, host.Addr, reload)
+			if err != nil {
+				fmt.Printf("%s: error updating stats: %s\n", host.Name, err)
+				failed++
 			}
+			statsCheckAge(host.Name)
+		}
+	}
+	return
+}
+
+// Perform a single stats maintenance cycle across all hosts, such as when run from cron,
+// returning the number of hosts, saves, and uploads that failed
+func statsOnce() (failed int) {
+
+	statsInit()
+
+	// Because there's no later cycle, upload what we gather rather than treating it as the
+	// initial load.  What a prior run persisted was uploaded by it, so it isn't resubmitted.
+	statsInitCompleted = 0
+
+	failed = statsUpdateAllHosts(false)
+
+	// Give failed S3 uploads another chance, since there's no retrier to do so later
+	if !s3Disabled() {
+		pending := s3RetryUploads()
+		if pending > 0 {
+			fmt.Printf("stats: %d uploads to S3 failed\n", pending)
+			failed += pending
 		}
 	}
 
+	// Finish the notifications and uploads still in progress before we exit
+	backgroundWork.Wait()
+
+	saveFailures := int(statsSaveFailures.Load())
+	if saveFailures > 0 {
+		fmt.Printf("stats: %d stats files couldn't be written\n", saveFailures)
+		failed += saveFailures
+	}
+	if _, failures := datadogHealth(); failures > 0 {
+		fmt.Printf("stats: uploads to DataDog failed\n")
+		failed++
+	}
+
+	return
+
 }
 
 // Get the stats filename for a given UTC date
@@ -155,11 +236,47 @@ func uLoadStats(hostname string, hostaddr string, serviceVersion string, bucketS
 		}
 	}
 
+	// Files that overlap oddly could have left us with more than the rolling window
+	uStatsTrim(hostname)
+
 	// Done
 	return
 
 }
 
+// Cap each of the host's in-memory stats arrays to the rolling window, and then re-validate
+// them to confirm that they remain aligned.  Must be called with statsLock held.
+func uStatsTrim(hostname string) {
+
+	hs := stats[hostname]
+	if hs.BucketMins == 0 || len(hs.Stats) == 0 {
+		return
+	}
+	bucketSecs := hs.BucketMins * 60
+	maxEntries := int(statsWindowSecs / bucketSecs)
+
+	// Trim the oldest entries, copying so that the trimmed entries can be freed
+	trimmed := 0
+	for siid, sis := range hs.Stats {
+		if len(sis) > maxEntries {
+			trimmed += len(sis) - maxEntries
+			hs.Stats[siid] = append([]StatsStat{}, sis[:maxEntries]...)
+		}
+	}
+	if trimmed > 0 {
+		fmt.Printf("stats: trimmed %d entries beyond the %d-hour window from %s\n", trimmed, statsWindowSecs/3600, hostname)
+	}
+
+	// Confirm alignment
+	_, _, err := uValidateStats("trimmed", hs.Stats, hs.Time, bucketSecs)
+	if err != nil {
+		fmt.Printf("stats: %s: %s\n", hostname, err)
+	}
+
+	stats[hostname] = hs
+
+}
+
 // Load stats from the file system and initialize for processing
 func statsInit() {
 
@@ -170,6 +287,15 @@ func statsInit() {
 	// Initialize stats maps
 	stats = make(map[string]HostStats)
 	statsServiceVersions = make(map[string]string)
+	statsDiscoveryImbalanced = make(map[string]bool)
+	statsRestartsReported = make(map[string]int64)
+	statsStaleReported = make(map[string]bool)
+	statsMemoryLow = make(map[string]bool)
+	statsFatalSpreading = make(map[string]bool)
+	statsFatalSpreadThrough = make(map[string]int64)
+	statsDiskWriteSpikeAlerted = make(map[string]int64)
+	statsCacheHitRateLow = make(map[string]bool)
+	statsUploadedThrough = make(map[string]int64)
 
 	// Remember when we began initialization
 	statsInitCompleted = time.Now().UTC().Unix()
@@ -223,6 +349,15 @@ func statsAreUniform(s map[string][]StatsStat) (uniform bool, err error) {
 	return
 }
 
+// Floor a time to the boundary of the bucket containing it.  This is the single place that
+// defines bucket alignment, and since a boundary floors to itself it's safe to apply repeatedly.
+func statsBucketTime(t int64, bucketSecs int64) int64 {
+	if bucketSecs <= 0 {
+		return t
+	}
+	return (t / bucketSecs) * bucketSecs
+}
+
 // Validate the continuity of the specified stats array, to correct any possible corruption
 // Note that they must have the same start time but they can be of varying lengths, because
 // handlers start at different times.
@@ -251,6 +386,14 @@ func uValidateStats(fixupType string, s map[string][]StatsStat, normalizedTime i
 	// Iterate over each stats array, normalizing to normalizedTime and normalizedLength
 	for siid, sis := range s {
 
+		// Remove any entries that duplicate another's time, which would skew aggregation
+		var duplicates int
+		sis, duplicates = removeDuplicateStats(sis)
+		if duplicates > 0 {
+			fmt.Printf("fixup %s: %s removed %d entries with duplicate times\n", fixupType, siid, duplicates)
+			s[siid] = sis
+		}
+
 		// Do a pre-check to see if the entire array is fine
 		bad := false
 		for i := 0; i < len(sis); i++ {
@@ -307,6 +450,28 @@ func uValidateStats(fixupType string, s map[string][]StatsStat, normalizedTime i
 
 }
 
+// Remove entries sharing the same SnapshotTaken, keeping the one with data over a blank one
+// (or the first one if neither is blank) while otherwise preserving the array's order.
+func removeDuplicateStats(sis []StatsStat) (out []StatsStat, removed int) {
+	index := map[int64]int{}
+	for _, stat := range sis {
+		i, present := index[stat.SnapshotTaken]
+		if !present {
+			index[stat.SnapshotTaken] = len(out)
+			out = append(out, stat)
+			continue
+		}
+		if out[i].OSMemTotal == 0 && stat.OSMemTotal != 0 {
+			out[i] = stat
+		}
+		removed++
+	}
+	if removed == 0 {
+		out = sis
+	}
+	return
+}
+
 // Add stats to the in-memory vector of stats.
 func uStatsAdd(hostname string, hostaddr string, s map[string][]StatsStat) (added int, addedStats map[string][]StatsStat, err error) {
 
@@ -336,6 +501,14 @@ func uStatsAdd(hostname string, hostaddr string, s map[string][]StatsStat) (adde
 		return
 	}
 
+	// Floor the times of the stats being added to their bucket boundaries, exactly as when
+	// they were converted, because the arrays are expected to be precisely aligned
+	for _, sis := range s {
+		for i := range sis {
+			sis[i].SnapshotTaken = statsBucketTime(sis[i].SnapshotTaken, bucketSecs)
+		}
+	}
+
 	// Validate both existing stats arrays and the ones being added, just as a sanity check
 	if len(s) > 0 {
 		var totalEntries, blankEntries int
@@ -616,28 +789,500 @@ func yesterdayTime() int64 {
 	return todayTime() - secs1Day
 }
 
-// Update the files with the data currently in-memory
-func uSaveStats(hostname string, serviceVersion string) (err error) {
+// Number of times that the stats couldn't be written locally, so that a single cycle can report it
+var statsSaveFailures atomic.Int64
+
+// Update the files with the data currently in-memory, uploading them to the host's S3 target
+func uSaveStats(hostname string, serviceVersion string, target S3Target) (err error) {
 
-	// Update today's stats into the file system and S3
+	// Update today's stats into the file system and, unless disabled, S3, queueing the upload for retry if S3 fails
+	filename := statsFilename(hostname, serviceVersion, todayTime(), currentType)
 	contents, err := writeFileLocally(hostname, serviceVersion, todayTime(), secs1Day)
 	if err != nil {
-		fmt.Printf("stats: error writing %s: %s\n", statsFilename(hostname, serviceVersion, todayTime(), currentType), err)
-	} else {
-		err = s3UploadStats(statsFilename(hostname, serviceVersion, todayTime(), currentType), contents)
+		statsSaveFailures.Add(1)
+		fmt.Printf("stats: error writing %s: %s\n", filename, err)
+	} else if !s3Disabled() {
+		err = s3UploadStats(target, filename, contents)
+		if err != nil {
+			fmt.Printf("stats: error uploading %s to S3: %s\n", filename, err)
+			err2 := s3QueueUpload(hostname, filename, contents)
+			if err2 != nil {
+				fmt.Printf("stats: error queueing %s for S3 retry: %s\n", filename, err2)
+			}
+		} else {
+			s3DequeueUpload(hostname, filename)
+		}
+	}
+	return
+}
+
+// Default number of days that local stats files for prior service versions are retained
+const statsRetentionDaysDefault = 30
+
+// Remove local stats files for the host's prior service versions once they're older than the
+// retention period.  These will have been uploaded to S3 as they were written, so once the
+// service version has moved on they are no longer needed locally.
+func statsRemoveStaleVersions(hostname string, serviceVersion string, now time.Time) {
+
+	retentionDays := Config.StatsRetentionDays
+	if retentionDays <= 0 {
+		retentionDays = statsRetentionDaysDefault
+	}
+	cutoff := now.AddDate(0, 0, -retentionDays)
+
+	entries, err := os.ReadDir(configDataDirectory)
+	if err != nil {
+		fmt.Printf("stats: error reading data directory: %s\n", err)
+		return
+	}
+	for _, entry := range entries {
+		filename := entry.Name()
+		if entry.IsDir() || statsFileOfOtherHost(hostname, filename) {
+			continue
+		}
+		fileVersion, day, ok := rollupParseDailyFilename(hostname, filename)
+		if !ok || fileVersion == serviceVersion || !day.Before(cutoff) {
+			continue
+		}
+		err = os.Remove(configDataDirectory + "/" + filename)
 		if err != nil {
-			fmt.Printf("stats: error uploading %s to S3: %s\n", statsFilename(hostname, serviceVersion, todayTime(), currentType), err)
+			fmt.Printf("stats: error removing stale %s: %s\n", filename, err)
+			continue
+		}
+		fmt.Printf("stats: removed %s from prior service version\n", filename)
+	}
+
+}
+
+// See whether a file that appears to be the host's actually belongs to another host whose
+// name has this host's name as its prefix
+func statsFileOfOtherHost(hostname string, filename string) bool {
+	for _, host := range Config.MonitoredHosts {
+		if host.Name != hostname && strings.HasPrefix(host.Name, hostname) && strings.HasPrefix(filename, host.Name+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// Immediately save the host's stats for the current day locally and to S3, returning the filename
+func statsArchiveHost(hostname string) (filename string, err error) {
+
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	if !uStatsLoaded(hostname) {
+		err = fmt.Errorf("no stats loaded for %s", hostname)
+		return
+	}
+
+	serviceVersion := statsServiceVersions[hostname]
+	filename = statsFilename(hostname, serviceVersion, todayTime(), currentType)
+	err = uSaveStats(hostname, serviceVersion, s3TargetForHost(hostname))
+	return
+
+}
+
+// Default number of buckets forming the baseline for disk write spikes, and the default minimum
+// MiB above the mean of that baseline for a bucket to be considered a spike
+const defaultDiskWriteSpikeWindow = 24
+const defaultDiskWriteSpikeMinMiB = 16
+
+// Warn about newly-added buckets in which an instance's disk writes are above the band formed
+// by the mean plus the configured number of standard deviations of its preceding buckets
+func uCheckDiskWriteSpikes(hostname string, addedStats map[string][]StatsStat) {
+	for _, alert := range uDiskWriteSpikeAlerts(hostname, addedStats) {
+		slackSendAlert(alert)
+	}
+}
+
+// Get the alerts for disk write spikes in the added buckets.  Because each poll re-delivers the
+// buckets that the host retains, the newest bucket alerted for each instance is remembered so
+// that a spike is only alerted once.
+func uDiskWriteSpikeAlerts(hostname string, addedStats map[string][]StatsStat) (alerts []string) {
+
+	k := Config.DiskWriteSpikeStddevs
+	if k <= 0 {
+		return
+	}
+	window := Config.DiskWriteSpikeWindow
+	if window <= 0 {
+		window = defaultDiskWriteSpikeWindow
+	}
+	minMiB := Config.DiskWriteSpikeMinMiB
+	if minMiB <= 0 {
+		minMiB = defaultDiskWriteSpikeMinMiB
+	}
+	const mib = 1024 * 1024
+
+	siids := make([]string, 0, len(addedStats))
+	for siid := range addedStats {
+		siids = append(siids, siid)
+	}
+	sort.Strings(siids)
+
+	for _, siid := range siids {
+		sis := stats[hostname].Stats[siid]
+		key := hostname + "/" + siid
+		alertedThrough := statsDiskWriteSpikeAlerted[key]
+		for _, added := range addedStats[siid] {
+			if added.SnapshotTaken <= alertedThrough {
+				continue
+			}
+
+			// Gather the baseline from the buckets preceding this one, which are ordered newest first
+			baseline := []float64{}
+			for _, s := range sis {
+				if s.SnapshotTaken >= added.SnapshotTaken || s.OSMemTotal == 0 {
+					continue
+				}
+				baseline = append(baseline, float64(s.OSDiskWrite))
+				if len(baseline) == window {
+					break
+				}
+			}
+			if len(baseline) < window/2 || len(baseline) < 2 {
+				continue
+			}
+			spike, band, mean := diskWriteSpike(baseline, float64(added.OSDiskWrite), k, minMiB*mib)
+			if spike {
+				alerts = append(alerts, fmt.Sprintf("%s: %s disk write spike of %.1f MiB in bucket at %s (band %.1f MiB, mean %.1f MiB over %d buckets)",
+					hostname, siid, float64(added.OSDiskWrite)/mib, time.Unix(added.SnapshotTaken, 0).UTC().Format("01-02 15:04:05"),
+					band/mib, mean/mib, len(baseline)))
+				if added.SnapshotTaken > statsDiskWriteSpikeAlerted[key] {
+					statsDiskWriteSpikeAlerted[key] = added.SnapshotTaken
+				}
+			}
+		}
+	}
+
+	return
+
+}
+
+// See whether a bucket's disk writes are above the band of k standard deviations over the mean of
+// the baseline, and at least the minimum delta above that mean
+func diskWriteSpike(baseline []float64, value float64, k float64, minDelta float64) (spike bool, band float64, mean float64) {
+	var variance float64
+	for _, v := range baseline {
+		mean += v
+	}
+	mean /= float64(len(baseline))
+	for _, v := range baseline {
+		variance += (v - mean) * (v - mean)
+	}
+	stddev := math.Sqrt(variance / float64(len(baseline)))
+	band = math.Max(mean+k*stddev, mean+minDelta)
+	spike = value > band
+	return
+}
+
+// Get the stats of buckets newer than any that have been uploaded for the host, advancing the
+// high-water mark so that no bucket's points are ever submitted more than once
+func uStatsNotYetUploaded(hostname string, addedStats map[string][]StatsStat) (newStats map[string][]StatsStat) {
+
+	uploadedThrough := statsUploadedThrough[hostname]
+	newest := uploadedThrough
+	newStats = map[string][]StatsStat{}
+	for siid, sis := range addedStats {
+		for _, s := range sis {
+			if s.SnapshotTaken <= uploadedThrough {
+				continue
+			}
+			newStats[siid] = append(newStats[siid], s)
+			if s.SnapshotTaken > newest {
+				newest = s.SnapshotTaken
+			}
+		}
+	}
+	statsUploadedThrough[hostname] = newest
+
+	return
+
+}
+
+// Default fraction of a host's instances reporting the same fatal that is considered an incident
+const defaultFatalSpreadFraction = 0.5
+
+// For each newly-added bucket, count the distinct instances reporting each fatal, escalating
+// those reported by at least the configured fraction of the host's instances as they begin to
+// spread and just logging those that are isolated
+func uCheckFatalSpread(hostname string, instances int, addedStats map[string][]StatsStat) {
+	for _, alert := range uFatalSpreadAlerts(hostname, instances, addedStats) {
+		slackSendAlert(alert)
+	}
+}
+
+// Get the alerts for fatals that began to spread within the newly-added buckets
+func uFatalSpreadAlerts(hostname string, instances int, addedStats map[string][]StatsStat) (alerts []string) {
+
+	if instances == 0 {
+		return
+	}
+	fraction := Config.FatalSpreadFraction
+	if fraction <= 0 {
+		fraction = defaultFatalSpreadFraction
+	}
+
+	// Gather the instances reporting each fatal, by bucket, including buckets without fatals
+	// so that we notice when a fatal stops spreading.  Because the buckets that are added overlap
+	// those of prior polls, those that have already been evaluated are skipped, so that they
+	// aren't replayed into escalating again.
+	evaluatedThrough := statsFatalSpreadThrough[hostname]
+	reporters := map[int64]map[string][]string{}
+	for siid, sis := range addedStats {
+		for _, s := range sis {
+			if s.SnapshotTaken <= evaluatedThrough {
+				continue
+			}
+			if reporters[s.SnapshotTaken] == nil {
+				reporters[s.SnapshotTaken] = map[string][]string{}
+			}
+			for fatal, count := range s.Fatals {
+				if count <= 0 {
+					continue
+				}
+				reporters[s.SnapshotTaken][fatal] = append(reporters[s.SnapshotTaken][fatal], siid)
+			}
+		}
+	}
+
+	buckets := make([]int64, 0, len(reporters))
+	for t := range reporters {
+		buckets = append(buckets, t)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+	if len(buckets) > 0 {
+		statsFatalSpreadThrough[hostname] = buckets[len(buckets)-1]
+	}
+	for _, t := range buckets {
+		fatals := make([]string, 0, len(reporters[t]))
+		for fatal := range reporters[t] {
+			fatals = append(fatals, fatal)
+		}
+		sort.Strings(fatals)
+		when := time.Unix(t, 0).UTC().Format("01-02 15:04:05")
+		spreading := map[string]bool{}
+		for _, fatal := range fatals {
+			siids := reporters[t][fatal]
+			sort.Strings(siids)
+			key := hostname + "/" + fatal
+			spreading[key] = len(siids) >= 2 && float64(len(siids)) >= fraction*float64(instances)
+
+			// Escalate only as the fatal begins to spread, rather than in every bucket while it does
+			if spreading[key] && !statsFatalSpreading[key] {
+				alerts = append(alerts, fmt.Sprintf("%s%s fatal '%s' on %d of %d instances in bucket at %s:\n    %s",
+					slackMention(slackEventFatalSpread), hostname, fatal, len(siids), instances, when, strings.Join(siids, "\n    ")))
+			} else {
+				fmt.Printf("%s: fatal '%s' on %d of %d instances in bucket at %s: %s\n",
+					hostname, fatal, len(siids), instances, when, strings.Join(siids, " "))
+			}
+		}
+
+		// Note those that are no longer spreading, so that they're escalated again if they recur
+		for key := range statsFatalSpreading {
+			if strings.HasPrefix(key, hostname+"/") && !spreading[key] {
+				fmt.Printf("%s: fatal '%s' is no longer spreading as of bucket at %s\n", hostname, strings.TrimPrefix(key, hostname+"/"), when)
+				delete(statsFatalSpreading, key)
+			}
+		}
+		for key, spread := range spreading {
+			if spread {
+				statsFatalSpreading[key] = true
+			}
+		}
+	}
+
+	return
+
+}
+
+// Defaults for the fraction of free memory considered low, and for how long it must be low
+const defaultMemoryFreeFraction = 0.1
+const defaultMemoryLowBuckets = 3
+
+// Warn when an instance's free memory has been below the configured fraction of its total for
+// a sustained number of buckets, which often precedes it being OOM-killed, and note when it has
+// recovered.  The free fraction of each instance's newest bucket is also sent to DataDog.
+func uCheckLowMemory(hostname string, addedStats map[string][]StatsStat) {
+
+	fraction := Config.MemoryFreeFraction
+	if fraction <= 0 {
+		fraction = defaultMemoryFreeFraction
+	}
+	sustained := Config.MemoryLowBuckets
+	if sustained <= 0 {
+		sustained = defaultMemoryLowBuckets
+	}
+
+	siids := make([]string, 0, len(addedStats))
+	for siid := range addedStats {
+		siids = append(siids, siid)
+	}
+	sort.Strings(siids)
+
+	const mib = 1024 * 1024
+	for _, siid := range siids {
+
+		// Look at the most recent buckets, which are ordered newest first, skipping blank ones
+		recent := []StatsStat{}
+		for _, s := range stats[hostname].Stats[siid] {
+			if s.OSMemTotal == 0 {
+				continue
+			}
+			recent = append(recent, s)
+			if len(recent) == sustained {
+				break
+			}
+		}
+		if len(recent) == 0 {
+			continue
+		}
+		newest := recent[0]
+		free := float64(newest.OSMemFree) / float64(newest.OSMemTotal)
+		datadogSubmitGaugeAsync("notehub."+hostname+".mem.free_fraction", free, []string{"instance:" + siid})
+
+		low := len(recent) == sustained
+		for _, s := range recent {
+			if float64(s.OSMemFree)/float64(s.OSMemTotal) >= fraction {
+				low = false
+			}
+		}
+
+		key := hostname + "/" + siid
+		if low && !statsMemoryLow[key] {
+			slackSendAlert(fmt.Sprintf("%s: %s free memory has been below %.0f%% for %d buckets (%.1f MiB free of %.1f MiB)",
+				hostname, siid, fraction*100, sustained, float64(newest.OSMemFree)/mib, float64(newest.OSMemTotal)/mib))
+		} else if !low && statsMemoryLow[key] && free >= fraction {
+			slackSendMessage(fmt.Sprintf("%s: %s free memory has recovered (%.1f MiB free of %.1f MiB)",
+				hostname, siid, float64(newest.OSMemFree)/mib, float64(newest.OSMemTotal)/mib))
+		} else {
+			continue
+		}
+		statsMemoryLow[key] = low
+
+	}
+
+}
+
+// Default age of a host's newest stats bucket above which we warn
+const defaultStatsStaleMins = 120
+
+// Report the age of the host's newest stats bucket, warning when it's stale, which happens
+// when the host is reachable but its stats aren't advancing or our polling has stalled
+func statsCheckAge(hostname string) {
+
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	if !uStatsLoaded(hostname) || stats[hostname].Time == 0 {
+		return
+	}
+	age := time.Now().UTC().Unix() - stats[hostname].Time
+	datadogSubmitGaugeAsync("notehub.stats.age_seconds", float64(age), []string{"host:" + hostname})
+
+	staleMins := Config.StatsStaleMins
+	if staleMins <= 0 {
+		staleMins = defaultStatsStaleMins
+	}
+	stale := age > int64(staleMins)*60
+	if stale && !statsStaleReported[hostname] {
+		slackSendAlert(fmt.Sprintf("%s: newest stats are %s old (above %d minutes)", hostname, uptimeStr(0, age), staleMins))
+	} else if !stale && statsStaleReported[hostname] {
+		slackSendMessage(fmt.Sprintf("%s: stats are current again", hostname))
+	}
+	statsStaleReported[hostname] = stale
+
+}
+
+// Get the time of the most recent bucket having data across all of a host's instances
+func uStatsNewestDataTime(hostname string) (newest int64) {
+	for _, sis := range stats[hostname].Stats {
+		for _, stat := range sis {
+			if stat.OSMemTotal != 0 {
+				if stat.SnapshotTaken > newest {
+					newest = stat.SnapshotTaken
+				}
+				break
+			}
+		}
+	}
+	return
+}
+
+// Get the times of the buckets since the most recently persisted bucket for which each instance
+// has no data, omitting those before the instance started.  Must be called with statsLock held.
+func uStatsMissingBuckets(hostname string, persistedTime int64, instanceStarted map[string]int64) (missing map[string][]int64) {
+	missing = map[string][]int64{}
+	newest := uStatsNewestDataTime(hostname)
+	for siid, sis := range stats[hostname].Stats {
+		for _, stat := range sis {
+			if stat.SnapshotTaken <= persistedTime {
+				break
+			}
+			if stat.SnapshotTaken >= newest || stat.OSMemTotal != 0 || stat.SnapshotTaken < instanceStarted[siid] {
+				continue
+			}
+			missing[siid] = append(missing[siid], stat.SnapshotTaken)
 		}
 	}
 	return
 }
 
+// Log the gap between the most recently persisted bucket and the buckets the host retains, such as
+// after we were down, returning the most buckets missing on any instance.  Because each poll merges
+// every bucket that the host retains, those still missing have aged out of the host and can't be
+// recovered.  Must be called with statsLock held.
+func uStatsReportGap(hostname string, persistedTime int64, instanceStarted map[string]int64) (gapBuckets int) {
+	missing := uStatsMissingBuckets(hostname, persistedTime, instanceStarted)
+	for _, times := range missing {
+		if len(times) > gapBuckets {
+			gapBuckets = len(times)
+		}
+	}
+	if gapBuckets > 0 {
+		fmt.Printf("stats: %s is missing up to %d buckets since %s on %d instances, which the host no longer retains\n", hostname, gapBuckets,
+			time.Unix(persistedTime, 0).UTC().Format("01-02 15:04:05"), len(missing))
+	}
+	return
+}
+
 // Return true if stats are loaded
 func uStatsLoaded(hostname string) bool {
 	_, statsExist := stats[hostname]
 	return statsServiceVersions[hostname] != "" && statsExist
 }
 
+// Record the summary of the host's in-memory stats, as of its most recent bucket
+func uStatsSummarize(hostname string) {
+
+	summary := statsSummary{}
+	hs, exists := stats[hostname]
+	if !exists {
+		return
+	}
+	summary.statsTime = hs.Time
+	for _, sis := range hs.Stats {
+		if len(sis) > 0 && sis[0].SnapshotTaken == hs.Time {
+			summary.eventsPending += sis[0].EventsPending
+		}
+	}
+
+	statsSummaryLock.Lock()
+	if statsSummaries == nil {
+		statsSummaries = map[string]statsSummary{}
+	}
+	statsSummaries[hostname] = summary
+	statsSummaryLock.Unlock()
+
+}
+
+// Get the summary of the host's in-memory stats, if they've been loaded
+func statsGetSummary(hostname string) (summary statsSummary, exists bool) {
+	statsSummaryLock.Lock()
+	defer statsSummaryLock.Unlock()
+	summary, exists = statsSummaries[hostname]
+	return
+}
+
 // Update the host's data structures both in-memory and on-disk
 func statsUpdateHost(hostname string, hostaddr string, reload bool) (ss serviceSummary, handlers map[string]AppHandler, err error) {
 
@@ -645,19 +1290,25 @@ func statsUpdateHost(hostname string, hostaddr string, reload bool) (ss serviceS
 	statsLock.Lock()
 	defer statsLock.Unlock()
 
+	// Where the host's stats are archived
+	s3Target := s3TargetForHost(hostname)
+
 	// Get a set of uniform stats across the devices.  If we ping at the wrong time we may get inconsisten stats
-	// across the instances, so just retry
+	// across the instances, or catch an instance mid-way through a deploy, so just retry
 	var serviceVersionChanged bool
 	var statsLastHour map[string][]StatsStat
+	warnWhenPendingEventsPerHandlerExceed := pendingEventsPerHandlerWarning(hostname)
 	for retries := 0; ; retries++ {
-		serviceVersionChanged, ss, handlers, statsLastHour, err = watcherGetStats(hostname, hostaddr)
-		if err != nil {
+		serviceVersionChanged, ss, handlers, statsLastHour, err = watcherGetStats(hostname, hostaddr, warnWhenPendingEventsPerHandlerExceed)
+		if err != nil && !errors.Is(err, errVersionMismatch) {
 			return
 		}
-		var uniform bool
-		uniform, err = statsAreUniform(statsLastHour)
-		if uniform {
-			break
+		if err == nil {
+			var uniform bool
+			uniform, err = statsAreUniform(statsLastHour)
+			if uniform {
+				break
+			}
 		}
 		if retries > 10 {
 			return
@@ -666,7 +1317,12 @@ func statsUpdateHost(hostname string, hostaddr string, reload bool) (ss serviceS
 		time.Sleep(10 * time.Second)
 	}
 
-	// If the stats for that service version were never yet loaded, load them
+	// Look for instances that restarted on their own, rather than because of a deploy
+	uCheckInstanceRestarts(hostname, ss, serviceVersionChanged)
+
+	// If the stats for that service version were never yet loaded, load them, remembering
+	// the most recent persisted bucket so we can see whether we're catching up after downtime
+	persistedTime := int64(0)
 	if !uStatsLoaded(hostname) {
 		err = uLoadStats(hostname, hostaddr, ss.ServiceVersion, ss.BucketSecs)
 		if err != nil {
@@ -674,6 +1330,12 @@ func statsUpdateHost(hostname string, hostaddr string, reload bool) (ss serviceS
 			return
 		}
 		serviceVersionChanged = false
+		persistedTime = uStatsNewestDataTime(hostname)
+
+		// What was persisted was uploaded by whoever persisted it
+		if persistedTime > statsUploadedThrough[hostname] {
+			statsUploadedThrough[hostname] = persistedTime
+		}
 	}
 
 	// If the service version changed, make sure that we write and re-load the stats
@@ -681,9 +1343,11 @@ func statsUpdateHost(hostname string, hostaddr string, reload bool) (ss serviceS
 	// changes, all the node IDs change and thus spreadsheets would be unusable.
 	if reload || serviceVersionChanged {
 		fmt.Printf("stats: %s service version changed\n", hostname)
-		err = uSaveStats(hostname, ss.ServiceVersion)
+		err = uSaveStats(hostname, ss.ServiceVersion, s3Target)
 		if err != nil {
 			fmt.Printf("stats: error saving %s stats: %s\n", hostname, err)
+		} else {
+			statsRemoveStaleVersions(hostname, ss.ServiceVersion, time.Now().UTC())
 		}
 		err = uLoadStats(hostname, hostaddr, ss.ServiceVersion, ss.BucketSecs)
 		if err != nil {
@@ -703,15 +1367,43 @@ func statsUpdateHost(hostname string, hostaddr string, reload bool) (ss serviceS
 		fmt.Printf("stats: added %d new stats for %s\n", added, hostname)
 	}
 
+	// If we were down for a while, note the gap since the buckets that were persisted
+	if persistedTime != 0 && ss.BucketSecs != 0 {
+		uStatsReportGap(hostname, persistedTime, ss.InstanceStarted)
+	}
+
+	// Look for instances writing to disk far more than usual
+	uCheckDiskWriteSpikes(hostname, addedStats)
+
+	// Look for the same fatal occurring on many instances at once
+	uCheckFatalSpread(hostname, len(ss.ServiceInstanceIDs), addedStats)
+
+	// Look for instances running out of memory
+	uCheckLowMemory(hostname, addedStats)
+
+	// Check the distribution of discovery handlers across instances
+	uCheckDiscoveryBalance(hostname, ss)
+
 	// Save the stats in case we crash
-	uSaveStats(hostname, ss.ServiceVersion)
+	uSaveStats(hostname, ss.ServiceVersion, s3Target)
+	uStatsSummarize(hostname)
 
 	// If this is just the initial set of stats that were being loaded from the file system, ignore it,
-	// else write the stats to datadog
+	// else write the stats to whichever of datadog, influx, and otlp are configured
 	if len(addedStats) > 0 && time.Now().UTC().Unix() > statsInitCompleted+60 {
-		datadogUploadStats(hostname, ss.BucketSecs, addedStats)
+		newStats := uStatsNotYetUploaded(hostname, addedStats)
+		if len(newStats) > 0 {
+			datadogUploadStats(hostname, ss.BucketSecs, newStats)
+			influxUploadStats(hostname, ss.BucketSecs, newStats)
+			otlpUploadStats(hostname, ss.BucketSecs, newStats)
+		}
+		statsCheckCacheHitRates(hostname, ss.BucketSecs, addedStats)
+		statsCheckThresholds(hostname, ss.BucketSecs, addedStats)
 	}
 
+	// Record how many instances the host currently has, so that autoscaling can be graphed
+	datadogUploadInstances(hostname, ss.ServiceInstanceIDs)
+
 	// Done
 	return
 
@@ -799,7 +1491,7 @@ func writeFileLocally(hostname string, serviceVersion string, beginTime int64, d
 	}
 
 	// Write the file
-	err = os.WriteFile(statsFilepath(hostname, serviceVersion, beginTime, currentType), contents, 0644)
+	err = writeFileAtomically(statsFilepath(hostname, serviceVersion, beginTime, currentType), contents, 0644)
 	if err != nil {
 		return
 	}
@@ -808,6 +1500,43 @@ func writeFileLocally(hostname string, serviceVersion string, beginTime int64, d
 	return
 }
 
+// Write a file by writing a temporary file alongside it and renaming it into place, so that
+// concurrent writers can't interleave and readers never see a partially-written file.  The
+// temporary file is hidden so that it isn't mistaken for a stats file when scanning the directory.
+func writeFileAtomically(path string, contents []byte, perm os.FileMode) (err error) {
+
+	dir, base := filepath.Split(path)
+	f, err := os.CreateTemp(dir, "."+base+".tmp-*")
+	if err != nil {
+		return
+	}
+	tmpPath := f.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	_, err = f.Write(contents)
+	if err == nil {
+		err = f.Sync()
+	}
+	err2 := f.Close()
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		return
+	}
+	err = os.Chmod(tmpPath, perm)
+	if err != nil {
+		return
+	}
+
+	return os.Rename(tmpPath, path)
+
+}
+
 // Sort new-to-old
 type statRecency []AggregatedStat
 
@@ -834,6 +1563,8 @@ func statsAggregateAsStatsStat(allStats map[string][]StatsStat, bucketSecs int64
 		lbs.OSNetSent = s.NetSent
 		lbs.HttpConnTotal = s.HttpConnTotal
 		lbs.HttpConnReused = s.HttpConnReused
+		lbs.BoardsActive = s.BoardsActive
+		lbs.WebsocketsActive = s.WebsocketsActive
 		lbs.DiscoveryHandlersActivated = s.NewHandlersDiscovery
 		lbs.EphemeralHandlersActivated = s.NewHandlersEphemeral
 		lbs.ContinuousHandlersActivated = s.NewHandlersContinuous
@@ -856,6 +1587,40 @@ func statsAggregateAsStatsStat(allStats map[string][]StatsStat, bucketSecs int64
 
 // Aggregate a notehub stats structure across service instances
 func statsAggregate(allStats map[string][]StatsStat, bucketSecs int64) (aggregatedStats []AggregatedStat) {
+	return statsAggregateBy(allStats, bucketSecs, nil)[""]
+}
+
+// Get the service type of a service instance, which is the suffix of its SIID
+func statsServiceType(siid string) string {
+	if i := strings.LastIndex(siid, ":"); i != -1 {
+		return siid[i+1:]
+	}
+	return "unknown"
+}
+
+// Aggregate stats separately for each group of service instances, such as by service type,
+// with all instances aggregated together in a single group if no grouping is specified
+func statsAggregateBy(allStats map[string][]StatsStat, bucketSecs int64, group func(siid string) string) (aggregatedStats map[string][]AggregatedStat) {
+	aggregatedStats = map[string][]AggregatedStat{}
+	groups := map[string]map[string][]StatsStat{}
+	for siid, sis := range allStats {
+		g := ""
+		if group != nil {
+			g = group(siid)
+		}
+		if groups[g] == nil {
+			groups[g] = map[string][]StatsStat{}
+		}
+		groups[g][siid] = sis
+	}
+	for g, groupStats := range groups {
+		aggregatedStats[g] = statsAggregateGroup(groupStats, bucketSecs)
+	}
+	return
+}
+
+// Aggregate the stats of a group of service instances
+func statsAggregateGroup(allStats map[string][]StatsStat, bucketSecs int64) (aggregatedStats []AggregatedStat) {
 
 	// Assuming that all stats are on the same aligned timebase, fetch it
 	if len(allStats) == 0 {
@@ -869,7 +1634,7 @@ func statsAggregate(allStats map[string][]StatsStat, bucketSecs int64) (aggregat
 		for _, s := range sis {
 			bucketID := int(s.SnapshotTaken / bucketSecs)
 			as := aggregatedStatsByBucket[bucketID]
-			as.Time = int64(bucketID) * bucketSecs
+			as.Time = statsBucketTime(s.SnapshotTaken, bucketSecs)
 
 			// Aggregate a common stat across instances
 			as.DiskReads += s.OSDiskRead
@@ -893,6 +1658,11 @@ func statsAggregate(allStats map[string][]StatsStat, bucketSecs int64) (aggregat
 			as.EventsReceived += s.EventsEnqueued
 			as.EventsRouted += s.EventsRouted
 
+			// Noteboard, whose counts are levels rather than counters and are
+			// only reported by noteboard instances of versions that support them
+			as.BoardsActive += s.BoardsActive
+			as.WebsocketsActive += s.WebsocketsActive
+
 			// Databases
 			if as.Databases == nil {
 				as.Databases = map[string]StatsDatabase{}
@@ -927,6 +1697,9 @@ func statsAggregate(allStats map[string][]StatsStat, bucketSecs int64) (aggregat
 					if cache.EntriesHWM > v.EntriesHWM {
 						v.EntriesHWM = cache.EntriesHWM
 					}
+					v.Hits += cache.Hits
+					v.Misses += cache.Misses
+					v.Resets += cache.Resets
 					as.Caches[key] = v
 				}
 			}
@@ -970,3 +1743,181 @@ func statsAggregate(allStats map[string][]StatsStat, bucketSecs int64) (aggregat
 	return
 
 }
+
+// Compute a cache's hit rate as a percentage, if the host reports hits and misses
+func cacheHitRate(c StatsCache) (rate float64, ok bool) {
+	if c.Hits+c.Misses <= 0 {
+		return
+	}
+	return float64(c.Hits) * 100 / float64(c.Hits+c.Misses), true
+}
+
+// Warn when the hit rate of a cache in the most recent new bucket falls below its configured floor
+func statsCheckCacheHitRates(hostname string, bucketSecs int64, addedStats map[string][]StatsStat) {
+	for _, alert := range uCacheHitRateAlerts(hostname, statsAggregate(addedStats, bucketSecs)) {
+		slackSendAlert(alert)
+	}
+}
+
+// Get the alerts for caches whose hit rate has dropped below the floor as of the most recent
+// bucket, alerting only as a cache drops below it rather than on every poll while it stays there
+func uCacheHitRateAlerts(hostname string, aggregatedStats []AggregatedStat) (alerts []string) {
+
+	// Exit if nothing to check
+	if len(Config.CacheHitRateFloors) == 0 || len(aggregatedStats) == 0 {
+		return
+	}
+
+	// Check the most recent bucket
+	latest := aggregatedStats[0]
+	keys := make([]string, 0, len(latest.Caches))
+	for k := range latest.Caches {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		floor, present := Config.CacheHitRateFloors[k]
+		if !present {
+			continue
+		}
+		rate, ok := cacheHitRate(latest.Caches[k])
+		if !ok {
+			continue
+		}
+		key := hostname + "/" + k
+		low := rate < floor
+		if low && !statsCacheHitRateLow[key] {
+			alerts = append(alerts, fmt.Sprintf("%s: %s cache hit rate is %.1f%% (below %.1f%%)", hostname, k, rate, floor))
+		} else if !low && statsCacheHitRateLow[key] {
+			fmt.Printf("%s: %s cache hit rate has recovered to %.1f%%\n", hostname, k, rate)
+		}
+		statsCacheHitRateLow[key] = low
+	}
+
+	return
+
+}
+
+// Default ratio of an instance's discovery handlers to the mean across its siblings
+// above which the distribution is considered to be imbalanced
+const defaultDiscoveryImbalanceRatio = 3.0
+
+// Don't consider an instance to be overloaded unless it has at least this many discovery handlers
+const discoveryImbalanceMinHandlers = 10
+
+// Warn when one instance carries a disproportionate share of the discovery handlers relative to
+// other instances of the same service type, which usually indicates a load-balancing problem.
+// We only warn upon becoming imbalanced, so as not to repeat the warning on every poll.
+func uCheckDiscoveryBalance(hostname string, ss serviceSummary) {
+
+	ratio := Config.DiscoveryImbalanceRatio
+	if ratio == 0 {
+		ratio = defaultDiscoveryImbalanceRatio
+	}
+
+	// Group instances by service type
+	byServiceType := map[string][]string{}
+	for siid := range ss.InstanceDiscoveryHandlers {
+		serviceType := statsServiceType(siid)
+		byServiceType[serviceType] = append(byServiceType[serviceType], siid)
+	}
+
+	// Look for an instance well above the mean of the others of its service type
+	imbalanced := false
+	message := ""
+	for _, siids := range byServiceType {
+		if len(siids) < 2 {
+			continue
+		}
+		sort.Strings(siids)
+		counts := []int64{}
+		for _, siid := range siids {
+			counts = append(counts, ss.InstanceDiscoveryHandlers[siid])
+		}
+		if !discoveryOverloaded(counts, ratio) {
+			continue
+		}
+		imbalanced = true
+		for _, siid := range siids {
+			message += fmt.Sprintf("    %s %d\n", siid, ss.InstanceDiscoveryHandlers[siid])
+		}
+	}
+
+	if imbalanced && !statsDiscoveryImbalanced[hostname] {
+		slackSendAlert(fmt.Sprintf("%s discovery handlers are imbalanced (above %.1fx the mean of the other instances):\n%s", hostname, ratio, message))
+	}
+	statsDiscoveryImbalanced[hostname] = imbalanced
+
+}
+
+// See whether any instance's count of discovery handlers is above the ratio to the mean of the
+// other instances' counts.  Comparing against the others rather than the overall mean, which
+// includes the instance itself, keeps a single overloaded instance from raising the bar.
+func discoveryOverloaded(counts []int64, ratio float64) bool {
+	total := int64(0)
+	for _, count := range counts {
+		total += count
+	}
+	for _, count := range counts {
+		if count < discoveryImbalanceMinHandlers {
+			continue
+		}
+		othersMean := float64(total-count) / float64(len(counts)-1)
+		if float64(count) > othersMean*ratio {
+			return true
+		}
+	}
+	return false
+}
+
+// Default uptime below which an instance is considered to have recently restarted
+const defaultRestartUptimeMins = 15
+
+// Look for instances whose uptime is suspiciously low relative to their siblings while the
+// service version is unchanged, which indicates a crash-restart rather than a deploy.  Each
+// restart is reported only once.
+func uCheckInstanceRestarts(hostname string, ss serviceSummary, serviceVersionChanged bool) {
+
+	// A deploy restarts everything, so there's nothing to detect
+	if serviceVersionChanged || len(ss.InstanceStarted) < 2 {
+		return
+	}
+
+	thresholdMins := Config.RestartUptimeMins
+	if thresholdMins == 0 {
+		thresholdMins = defaultRestartUptimeMins
+	}
+	threshold := int64(thresholdMins) * 60
+	now := time.Now().UTC().Unix()
+
+	siids := make([]string, 0, len(ss.InstanceStarted))
+	for siid := range ss.InstanceStarted {
+		siids = append(siids, siid)
+	}
+	sort.Strings(siids)
+
+	for _, siid := range siids {
+		started := ss.InstanceStarted[siid]
+		if now-started >= threshold || statsRestartsReported[hostname+"/"+siid] == started {
+			continue
+		}
+
+		// Compare against the median uptime of its siblings
+		siblingUptimes := []int64{}
+		for _, sibling := range siids {
+			if sibling != siid {
+				siblingUptimes = append(siblingUptimes, now-ss.InstanceStarted[sibling])
+			}
+		}
+		sort.Slice(siblingUptimes, func(i, j int) bool { return siblingUptimes[i] < siblingUptimes[j] })
+		median := siblingUptimes[len(siblingUptimes)/2]
+		if median < threshold {
+			continue
+		}
+
+		statsRestartsReported[hostname+"/"+siid] = started
+		slackSendAlert(fmt.Sprintf("%s: %s appears to have crashed and restarted: up %s while its siblings have been up %s (median) on unchanged version %s",
+			hostname, siid, uptimeStr(started, now), uptimeStr(now-median, now), ss.ServiceVersion))
+	}
+
+}
@@ -0,0 +1,427 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiscoveryOverloaded(t *testing.T) {
+	tests := []struct {
+		name   string
+		counts []int64
+		want   bool
+	}{
+		{"balanced", []int64{20, 22, 19}, false},
+		{"one of two overloaded", []int64{40, 10}, true},
+		{"one of many overloaded", []int64{100, 10, 10, 10}, true},
+		{"all on one instance", []int64{50, 0}, true},
+		{"too few handlers to matter", []int64{9, 0}, false},
+		{"within the ratio", []int64{29, 10, 10}, false},
+	}
+	for _, tt := range tests {
+		got := discoveryOverloaded(tt.counts, defaultDiscoveryImbalanceRatio)
+		if got != tt.want {
+			t.Errorf("%s: overloaded %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFatalSpreadEscalatesOnce(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved; statsFatalSpreading = nil; statsFatalSpreadThrough = nil }()
+	Config.FatalSpreadFraction = 0.5
+	statsFatalSpreading = map[string]bool{}
+	statsFatalSpreadThrough = map[string]int64{}
+
+	// A bucket in which the specified instances, of four, report a fatal
+	bucket := func(t int64, reporting ...string) map[string][]StatsStat {
+		addedStats := map[string][]StatsStat{}
+		for _, siid := range []string{"a:handler", "b:handler", "c:handler", "d:handler"} {
+			addedStats[siid] = []StatsStat{{SnapshotTaken: t}}
+		}
+		for _, siid := range reporting {
+			addedStats[siid][0].Fatals = map[string]int64{"db": 1}
+		}
+		return addedStats
+	}
+	steps := []struct {
+		name      string
+		reporting []string
+		alert     bool
+	}{
+		{"isolated", []string{"a:handler"}, false},
+		{"begins to spread", []string{"a:handler", "b:handler", "c:handler"}, true},
+		{"still spreading", []string{"a:handler", "b:handler"}, false},
+		{"gone", nil, false},
+		{"spreads again", []string{"c:handler", "d:handler"}, true},
+	}
+	for i, s := range steps {
+		alerts := uFatalSpreadAlerts("host", 4, bucket(int64(1646092800+i*300), s.reporting...))
+		if (len(alerts) > 0) != s.alert {
+			t.Errorf("%s: alerts %v, want alert %t", s.name, alerts, s.alert)
+		}
+	}
+}
+
+func TestFatalSpreadIgnoresReplayedBuckets(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved; statsFatalSpreading = nil; statsFatalSpreadThrough = nil }()
+	Config.FatalSpreadFraction = 0.5
+	statsFatalSpreading = map[string]bool{}
+	statsFatalSpreadThrough = map[string]int64{}
+
+	// Each poll re-delivers the retained buckets, new-to-old, in which the fatal spread in
+	// the older bucket and then cleared in the newer one
+	const spread = 1646092800
+	const clear = spread + 300
+	addedStats := map[string][]StatsStat{}
+	for _, siid := range []string{"a:handler", "b:handler", "c:handler", "d:handler"} {
+		addedStats[siid] = []StatsStat{{SnapshotTaken: clear}, {SnapshotTaken: spread, Fatals: map[string]int64{"db": 1}}}
+	}
+	alerts := 0
+	for poll := 0; poll < 3; poll++ {
+		alerts += len(uFatalSpreadAlerts("host", 4, addedStats))
+	}
+	if alerts != 1 {
+		t.Errorf("%d alerts over repeated polls of the same buckets, want 1", alerts)
+	}
+}
+
+func TestCacheHitRateAlertsOnceBelowFloor(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved; statsCacheHitRateLow = nil }()
+	Config.CacheHitRateFloors = map[string]float64{"device": 90}
+	statsCacheHitRateLow = map[string]bool{}
+
+	steps := []struct {
+		name   string
+		hits   int64
+		misses int64
+		alert  bool
+	}{
+		{"above the floor", 95, 5, false},
+		{"drops below", 80, 20, true},
+		{"stays below", 70, 30, false},
+		{"recovers", 99, 1, false},
+		{"drops again", 50, 50, true},
+	}
+	for _, s := range steps {
+		latest := AggregatedStat{Caches: map[string]StatsCache{"device": {Hits: s.hits, Misses: s.misses}}}
+		alerts := uCacheHitRateAlerts("host", []AggregatedStat{latest})
+		if (len(alerts) > 0) != s.alert {
+			t.Errorf("%s: alerts %v, want alert %t", s.name, alerts, s.alert)
+		}
+	}
+}
+
+func TestDiskWriteSpike(t *testing.T) {
+	const mib = 1024 * 1024
+	steady := []float64{10 * mib, 10 * mib, 10 * mib, 10 * mib}
+	varied := []float64{10 * mib, 30 * mib, 10 * mib, 30 * mib}
+	tests := []struct {
+		name     string
+		baseline []float64
+		value    float64
+		want     bool
+	}{
+		{"steady baseline, trivial increase", steady, 10*mib + 1, false},
+		{"steady baseline, below the minimum delta", steady, 25 * mib, false},
+		{"steady baseline, beyond the minimum delta", steady, 27 * mib, true},
+		{"varied baseline, within the band", varied, 45 * mib, false},
+		{"varied baseline, beyond the band", varied, 60 * mib, true},
+	}
+	for _, tt := range tests {
+		spike, band, mean := diskWriteSpike(tt.baseline, tt.value, 3, 16*mib)
+		if spike != tt.want {
+			t.Errorf("%s: spike %t (band %.1f MiB, mean %.1f MiB), want %t", tt.name, spike, band/mib, mean/mib, tt.want)
+		}
+	}
+}
+
+func TestDiskWriteSpikeAlertsOnce(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved }()
+	Config.DiskWriteSpikeStddevs = 3
+	Config.DiskWriteSpikeWindow = 6
+	Config.DiskWriteSpikeMinMiB = 1
+	statsInit()
+
+	// An instance with a steady baseline and then a spike, followed by a quiet bucket
+	const mib = 1024 * 1024
+	const newest = 1646092800
+	sis := []StatsStat{}
+	for i := 0; i < 10; i++ {
+		s := StatsStat{SnapshotTaken: newest - int64(i)*300, OSMemTotal: 1, OSDiskWrite: mib}
+		if i == 1 {
+			s.OSDiskWrite = 100 * mib
+		}
+		sis = append(sis, s)
+	}
+	stats["prod"] = HostStats{Name: "prod", Time: newest, BucketMins: 5, Stats: map[string][]StatsStat{"a:handler": sis}}
+
+	// Each poll re-delivers the retained buckets
+	alerts := 0
+	for poll := 0; poll < 3; poll++ {
+		alerts += len(uDiskWriteSpikeAlerts("prod", map[string][]StatsStat{"a:handler": sis[:4]}))
+	}
+	if alerts != 1 {
+		t.Errorf("%d alerts over repeated polls of the same buckets, want 1", alerts)
+	}
+}
+
+func TestValidateStatsRemovesDuplicateTimes(t *testing.T) {
+	const bucketSecs = 300
+	tests := []struct {
+		name string
+		sis  []StatsStat
+	}{
+		{"blank duplicate after", []StatsStat{
+			{SnapshotTaken: 900, OSMemTotal: 1},
+			{SnapshotTaken: 600, OSMemTotal: 1, EventsRouted: 7},
+			{SnapshotTaken: 600},
+			{SnapshotTaken: 300, OSMemTotal: 1},
+		}},
+		{"blank duplicate before", []StatsStat{
+			{SnapshotTaken: 900, OSMemTotal: 1},
+			{SnapshotTaken: 600},
+			{SnapshotTaken: 600, OSMemTotal: 1, EventsRouted: 7},
+			{SnapshotTaken: 300, OSMemTotal: 1},
+		}},
+	}
+	for _, tt := range tests {
+		s := map[string][]StatsStat{"siid": tt.sis}
+		_, blank, err := uValidateStats("test", s, 0, bucketSecs)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		sis := s["siid"]
+		if len(sis) != 3 || blank != 0 {
+			t.Fatalf("%s: %d entries (%d blank), want 3 (0 blank)", tt.name, len(sis), blank)
+		}
+		for i, want := range []int64{900, 600, 300} {
+			if sis[i].SnapshotTaken != want {
+				t.Errorf("%s: entry %d at %d, want %d", tt.name, i, sis[i].SnapshotTaken, want)
+			}
+		}
+		if sis[1].EventsRouted != 7 {
+			t.Errorf("%s: kept the blank duplicate rather than the one with data", tt.name)
+		}
+	}
+}
+
+// Write a daily stats file for the host whose buckets run back contiguously from the specified time
+func statsTestDailyFile(t *testing.T, hostname string, serviceVersion string, fileTime int64, newest int64, entries int, bucketSecs int64) {
+	sis := make([]StatsStat, entries)
+	for i := range sis {
+		sis[i].SnapshotTaken = newest - int64(i)*bucketSecs
+		sis[i].OSMemTotal = 1
+	}
+	hs := HostStats{Name: hostname, Time: newest, BucketMins: bucketSecs / 60, Stats: map[string][]StatsStat{"siid": sis}}
+	contents, err := json.Marshal(hs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+	f, err := w.Create(statsFilename(hostname, serviceVersion, fileTime, jsonType))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(contents)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(statsFilepath(hostname, serviceVersion, fileTime, zipType), buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadStatsOverlappingFilesCapsAndAligns(t *testing.T) {
+	saved := configDataDirectory
+	defer func() { configDataDirectory = saved }()
+	configDataDirectory = t.TempDir() + "/"
+	statsInit()
+
+	// Today's file reaches well back into yesterday, and yesterday's file reaches back
+	// further still, so that together they overlap and exceed the rolling window
+	const bucketSecs = 300
+	newest := statsBucketTime(time.Now().UTC().Unix(), bucketSecs)
+	statsTestDailyFile(t, "prod", "v1", todayTime(), newest, int(40*60*60/bucketSecs), bucketSecs)
+	statsTestDailyFile(t, "prod", "v1", yesterdayTime(), todayTime()-bucketSecs, int(60*60*60/bucketSecs), bucketSecs)
+
+	statsLock.Lock()
+	err := uLoadStats("prod", "prod.example.com", "v1", bucketSecs)
+	hs := stats["prod"]
+	statsLock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sis := hs.Stats["siid"]
+	if want := int(statsWindowSecs / bucketSecs); len(sis) != want {
+		t.Fatalf("loaded %d entries, want %d", len(sis), want)
+	}
+	if hs.Time != newest {
+		t.Errorf("host time %d, want %d", hs.Time, newest)
+	}
+	for i := range sis {
+		if want := newest - int64(i)*bucketSecs; sis[i].SnapshotTaken != want {
+			t.Fatalf("entry %d at %d, want %d", i, sis[i].SnapshotTaken, want)
+		}
+		if sis[i].OSMemTotal != 1 {
+			t.Fatalf("entry %d at %d is blank", i, sis[i].SnapshotTaken)
+		}
+	}
+}
+
+func TestStatsBucketTimeIdempotent(t *testing.T) {
+	tests := []struct {
+		name       string
+		t          int64
+		bucketSecs int64
+		want       int64
+	}{
+		{"on a boundary", 1800, 300, 1800},
+		{"just after a boundary", 1801, 300, 1800},
+		{"just before a boundary", 2099, 300, 1800},
+		{"hour buckets", 7199, 3600, 3600},
+		{"no bucket size", 1801, 0, 1801},
+	}
+	for _, tt := range tests {
+		got := statsBucketTime(tt.t, tt.bucketSecs)
+		if got != tt.want {
+			t.Errorf("%s: floored to %d, want %d", tt.name, got, tt.want)
+		}
+		if again := statsBucketTime(got, tt.bucketSecs); again != got {
+			t.Errorf("%s: re-flooring moved %d to %d", tt.name, got, again)
+		}
+	}
+}
+
+func TestStatsNotYetUploadedNeverResubmits(t *testing.T) {
+	statsInit()
+
+	// Buckets through 1200 were loaded from files, and so were uploaded when first seen
+	statsUploadedThrough["prod"] = 1200
+
+	// Each cycle's added stats overlap those of the previous cycle, as when a cycle is re-run
+	cycles := []map[string][]StatsStat{
+		{"a": {{SnapshotTaken: 1500}, {SnapshotTaken: 1200}, {SnapshotTaken: 900}}},
+		{"a": {{SnapshotTaken: 1500}, {SnapshotTaken: 1200}}},
+		{"a": {{SnapshotTaken: 1800}, {SnapshotTaken: 1500}}, "b": {{SnapshotTaken: 1800}}},
+		{"a": {{SnapshotTaken: 1800}}, "b": {{SnapshotTaken: 1800}, {SnapshotTaken: 1500}}},
+	}
+	submitted := map[string][]int64{}
+	seen := map[string]bool{}
+	for i, addedStats := range cycles {
+		for siid, sis := range uStatsNotYetUploaded("prod", addedStats) {
+			for _, s := range sis {
+				key := fmt.Sprintf("%s/%d", siid, s.SnapshotTaken)
+				if seen[key] {
+					t.Errorf("cycle %d: resubmitted %s", i, key)
+				}
+				seen[key] = true
+				submitted[siid] = append(submitted[siid], s.SnapshotTaken)
+			}
+		}
+	}
+	want := map[string][]int64{"a": {1500, 1800}, "b": {1800}}
+	if !reflect.DeepEqual(submitted, want) {
+		t.Errorf("submitted %v, want %v", submitted, want)
+	}
+	if statsUploadedThrough["prod"] != 1800 {
+		t.Errorf("uploaded through %d, want 1800", statsUploadedThrough["prod"])
+	}
+}
+
+func TestWriteFileAtomicallyUnderInterleavedWrites(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "prod-v1-20220301.zip")
+
+	// Writers of differently-sized contents race with readers, which must only ever see
+	// one writer's contents in their entirety
+	versions := map[string]bool{}
+	contents := [][]byte{}
+	for i := 0; i < 4; i++ {
+		b := bytes.Repeat([]byte{byte('a' + i)}, (i+1)*64*1024)
+		contents = append(contents, b)
+		versions[string(b)] = true
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 1000)
+	for _, b := range contents {
+		b := b
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				if err := writeFileAtomically(path, b, 0644); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				got, err := os.ReadFile(path)
+				if err != nil {
+					if !os.IsNotExist(err) {
+						errs <- err
+					}
+					continue
+				}
+				if !versions[string(got)] {
+					errs <- fmt.Errorf("read a partial write of %d bytes", len(got))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// Nothing but the file itself should remain
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files left in the directory, want 1", len(entries))
+	}
+}
+
+func TestStatsReportGap(t *testing.T) {
+	statsInit()
+
+	// Buckets through 600 were persisted, and an instance has no data for two buckets since,
+	// one of them from before the other instance started
+	stats["prod"] = HostStats{Name: "prod", Time: 1800, BucketMins: 5, Stats: map[string][]StatsStat{
+		"a:handler": {{SnapshotTaken: 1800, OSMemTotal: 1}, {SnapshotTaken: 1500}, {SnapshotTaken: 1200}, {SnapshotTaken: 900, OSMemTotal: 1}, {SnapshotTaken: 600, OSMemTotal: 1}},
+		"b:handler": {{SnapshotTaken: 1800, OSMemTotal: 1}, {SnapshotTaken: 1500, OSMemTotal: 1}, {SnapshotTaken: 1200}, {SnapshotTaken: 900}},
+	}}
+	started := map[string]int64{"b:handler": 1500}
+	if gap := uStatsReportGap("prod", 600, started); gap != 2 {
+		t.Errorf("gap of %d buckets, want 2", gap)
+	}
+	if gap := uStatsReportGap("prod", 1500, started); gap != 0 {
+		t.Errorf("gap of %d buckets after the persisted bucket, want 0", gap)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Determine whether backlog alerts are suppressed at the specified time, and if so, why.  Only
+// alerts about expected backlogs should be checked against this; hard failures always alert.
+func alertSuppressed(now time.Time) (suppressed bool, reason string) {
+	for _, w := range Config.SuppressionWindows {
+		if !suppressionWindowActive(w, now) {
+			continue
+		}
+		reason = w.Reason
+		if reason == "" {
+			reason = w.Begin + "-" + w.End + " UTC"
+		}
+		return true, reason
+	}
+	return
+}
+
+// Determine whether we're within a daily window at the specified time
+func suppressionWindowActive(w SuppressionWindow, now time.Time) bool {
+	now = now.UTC()
+	minuteOfDay := now.Hour()*60 + now.Minute()
+	begin, err := suppressionMinuteOfDay(w.Begin)
+	if err != nil {
+		fmt.Printf("suppression window: begin: %s\n", err)
+		return false
+	}
+	end, err := suppressionMinuteOfDay(w.End)
+	if err != nil {
+		fmt.Printf("suppression window: end: %s\n", err)
+		return false
+	}
+
+	// Determine the day on which the window that we might be within began
+	day := now
+	if begin <= end {
+		if minuteOfDay < begin || minuteOfDay >= end {
+			return false
+		}
+	} else {
+		if minuteOfDay < begin && minuteOfDay >= end {
+			return false
+		}
+		if minuteOfDay < end {
+			day = now.AddDate(0, 0, -1)
+		}
+	}
+	return suppressionOnDay(w.Days, day.Weekday())
+}
+
+// Parse an "HH:MM" time into minutes past midnight
+func suppressionMinuteOfDay(hhmm string) (minutes int, err error) {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return
+	}
+	minutes = t.Hour()*60 + t.Minute()
+	return
+}
+
+// See if a window's days include the specified day, with no days meaning every day
+func suppressionOnDay(days []string, weekday time.Weekday) bool {
+	if len(days) == 0 {
+		return true
+	}
+	for _, d := range days {
+		if len(d) >= 3 && strings.HasPrefix(strings.ToLower(weekday.String()), strings.ToLower(d)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,192 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Severity of a threshold alert
+const (
+	thresholdOK = iota
+	thresholdWarning
+	thresholdCritical
+)
+
+var thresholdLevelNames = []string{"OK", "WARNING", "CRITICAL"}
+
+// The state of a metric's alert on a host, including the number of consecutive buckets below its
+// level and the newest of them, so that a bucket that is seen again on a later poll isn't recounted,
+// and the newest bucket evaluated, so that older buckets that are re-delivered aren't replayed
+type thresholdState struct {
+	level           int
+	clearBuckets    int
+	lastClearBucket int64
+	lastBucket      int64
+}
+
+// Alert state by host and then by metric
+var thresholdLock sync.Mutex
+var thresholdStates map[string]map[string]thresholdState
+
+// Get the value of a metric, by its DataDog suffix, from an aggregated stat
+func statsMetricValue(stat AggregatedStat, metric string) (value float64, ok bool) {
+	for _, m := range datadogMetrics {
+		if m.suffix == metric {
+			return m.value(stat), true
+		}
+	}
+	if strings.HasPrefix(metric, "cache.") && strings.HasSuffix(metric, ".hitrate") {
+		k := strings.TrimSuffix(strings.TrimPrefix(metric, "cache."), ".hitrate")
+		return cacheHitRate(stat.Caches[k])
+	}
+	return
+}
+
+// See whether a metric measures the flow of events, whose thresholds are expected to be breached
+// by the traffic spikes during suppression windows
+func thresholdIsThroughput(metric string) bool {
+	return strings.HasPrefix(metric, "events.")
+}
+
+// See whether a value breaches a threshold
+func thresholdBreached(value float64, operator string, threshold *float64) bool {
+	if threshold == nil {
+		return false
+	}
+	switch operator {
+	case ">=":
+		return value >= *threshold
+	case "<":
+		return value < *threshold
+	case "<=":
+		return value <= *threshold
+	}
+	return value > *threshold
+}
+
+// Advance a metric's state given its level in a bucket, raising it immediately but only lowering it
+// once it has been lower for the required number of consecutive buckets, returning whether it changed.
+// Buckets older than the newest evaluated are ignored, because each poll re-delivers those retained.
+func thresholdStep(state *thresholdState, level int, bucketTime int64, clearBuckets int) (changed bool) {
+	if bucketTime < state.lastBucket {
+		return false
+	}
+	state.lastBucket = bucketTime
+	if level >= state.level {
+		state.clearBuckets = 0
+		state.lastClearBucket = 0
+		changed = level != state.level
+		state.level = level
+		return
+	}
+	if bucketTime > state.lastClearBucket {
+		state.clearBuckets++
+		state.lastClearBucket = bucketTime
+	}
+	if clearBuckets < 1 {
+		clearBuckets = 1
+	}
+	if state.clearBuckets < clearBuckets {
+		return false
+	}
+	state.clearBuckets = 0
+	state.lastClearBucket = 0
+	state.level = level
+	return true
+}
+
+// Evaluate the configured metric thresholds against each new bucket, oldest first, alerting when a
+// metric's level rises and, only once it has stayed lower for enough buckets, when it falls.
+func statsCheckThresholds(hostname string, bucketSecs int64, addedStats map[string][]StatsStat) {
+
+	// Exit if nothing to check
+	if len(Config.MetricThresholds) == 0 {
+		return
+	}
+	aggregatedStats := statsAggregate(addedStats, bucketSecs)
+	if len(aggregatedStats) == 0 {
+		return
+	}
+	sort.Sort(statOccurrence(aggregatedStats))
+
+	thresholdLock.Lock()
+	defer thresholdLock.Unlock()
+	if thresholdStates == nil {
+		thresholdStates = map[string]map[string]thresholdState{}
+	}
+	if thresholdStates[hostname] == nil {
+		thresholdStates[hostname] = map[string]thresholdState{}
+	}
+
+	// Check the metrics in a stable order
+	metrics := make([]string, 0, len(Config.MetricThresholds))
+	for metric := range Config.MetricThresholds {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+	for _, metric := range metrics {
+		for _, stat := range aggregatedStats {
+			uThresholdCheckBucket(hostname, metric, stat)
+		}
+	}
+
+}
+
+// Evaluate a metric's threshold against a bucket, alerting if its level changed
+func uThresholdCheckBucket(hostname string, metric string, stat AggregatedStat) {
+
+	t := Config.MetricThresholds[metric]
+	value, ok := statsMetricValue(stat, metric)
+	if !ok {
+		return
+	}
+
+	level := thresholdOK
+	if thresholdBreached(value, t.Operator, t.Critical) {
+		level = thresholdCritical
+	} else if thresholdBreached(value, t.Operator, t.Warning) {
+		level = thresholdWarning
+	}
+
+	// Raise immediately, but only lower after enough consecutive buckets
+	state := thresholdStates[hostname][metric]
+	previous := state.level
+	changed := thresholdStep(&state, level, stat.Time, t.ClearBuckets)
+	thresholdStates[hostname][metric] = state
+	if !changed {
+		return
+	}
+
+	// Alert
+	var message string
+	if level == thresholdOK {
+		message = fmt.Sprintf("%s: %s resolved (now %.2f, was %s)", hostname, metric, value, thresholdLevelNames[previous])
+	} else {
+		threshold := t.Warning
+		if level == thresholdCritical {
+			threshold = t.Critical
+		}
+		operator := t.Operator
+		if operator == "" {
+			operator = ">"
+		}
+		message = fmt.Sprintf("%s: %s %s at %.2f (%s %.2f)", hostname, metric, thresholdLevelNames[level], value, operator, *threshold)
+	}
+	if level == thresholdOK {
+		slackSendMessage(message)
+	} else if suppressed, reason := alertSuppressed(time.Now()); suppressed && thresholdIsThroughput(metric) {
+		slackSendMessage(message + " (suppressed: " + reason + ")")
+	} else {
+		slackSendAlert(message)
+	}
+	datadogPostEventAsync(message, message,
+		[]string{"host:" + hostname, "metric:" + metric, "level:" + strings.ToLower(thresholdLevelNames[level])})
+
+}
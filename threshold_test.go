@@ -0,0 +1,44 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestThresholdClearsAfterConsecutiveBuckets(t *testing.T) {
+
+	// Successive polls, in which the in-progress bucket is often seen more than once
+	steps := []struct {
+		name    string
+		bucket  int64
+		level   int
+		changed bool
+		want    int
+	}{
+		{"breached", 300, thresholdCritical, true, thresholdCritical},
+		{"first bucket below", 600, thresholdOK, false, thresholdCritical},
+		{"same bucket seen again", 600, thresholdOK, false, thresholdCritical},
+		{"and again", 600, thresholdOK, false, thresholdCritical},
+		{"second bucket below", 900, thresholdOK, false, thresholdCritical},
+		{"breached again", 1200, thresholdCritical, false, thresholdCritical},
+		{"below anew", 1500, thresholdOK, false, thresholdCritical},
+		{"second below anew", 1800, thresholdOK, false, thresholdCritical},
+		{"third bucket below", 2100, thresholdOK, true, thresholdOK},
+		{"old breached bucket re-delivered", 1200, thresholdCritical, false, thresholdOK},
+		{"old bucket below re-delivered", 1800, thresholdOK, false, thresholdOK},
+		{"newest bucket seen again", 2100, thresholdOK, false, thresholdOK},
+		{"warning", 2400, thresholdWarning, true, thresholdWarning},
+	}
+	state := thresholdState{}
+	for _, s := range steps {
+		changed := thresholdStep(&state, s.level, s.bucket, 3)
+		if changed != s.changed || state.level != s.want {
+			t.Errorf("%s: changed %t level %s, want changed %t level %s", s.name, changed,
+				thresholdLevelNames[state.level], s.changed, thresholdLevelNames[s.want])
+		}
+	}
+
+}
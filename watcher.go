@@ -5,11 +5,19 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
+	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
@@ -34,6 +42,15 @@ type serviceSummary struct {
 	DiscoveryHandlers    int64
 	ServiceInstanceIDs   []string
 	ServiceInstanceAddrs []string
+
+	// Discovery handlers currently active on each service instance
+	InstanceDiscoveryHandlers map[string]int64
+
+	// When each service instance started, if known
+	InstanceStarted map[string]int64
+
+	// Service version changes within the stats window, oldest first, for marking deploys
+	VersionChanges []versionChange
 }
 
 // Service instances the last time we looked
@@ -41,6 +58,161 @@ var serviceLock sync.Mutex
 var lastServiceVersions map[string]string
 var lastServiceHandlers map[string][]AppHandler
 
+// A valid ping from a host that has no handlers, such as mid-way through a rolling restart,
+// which is only alerted when it persists for this many consecutive polls
+var errNoHandlers = errors.New("host has no handlers")
+
+// Failures of the watcher, distinguished so that callers can tell transient connectivity
+// problems (which are worth retrying) from an instance caught mid-way through a deploy.
+// Changes to a host's version or handlers aren't failures, and are only posted as notices.
+var errHostUnreachable = errors.New("error pinging host")
+var errInstanceUnreachable = errors.New("error pinging instance")
+var errVersionMismatch = errors.New("node service version is incorrect")
+
+const noHandlersPollsBeforeAlert = 3
+
+var lastServiceNoHandlers map[string]int
+
+// The result of the most recent ping of each host
+type servicePing struct {
+	time time.Time
+	err  error
+}
+
+var lastServicePings map[string]servicePing
+
+// Hosts that we've warned have too many pending events per handler, and those whose backlog
+// we've noted at routine severity because it began during a suppression window
+var lastPendingEventsWarned map[string]bool
+var lastPendingEventsNoted map[string]bool
+
+// When instances of each host were first seen to disagree with the host's service version, and
+// whether that has been alerted
+const versionMismatchAlertMinsDefault = 30
+
+var versionMismatchSince map[string]int64
+var versionMismatchAlerted map[string]bool
+
+// Unexpected bucket size most recently warned about for each host, so that we warn once per change
+var lastBucketMinsWarned map[string]int64
+
+// Get the threshold of pending events per handler at which we warn about a host, which is
+// either its own or else the global one
+func pendingEventsPerHandlerWarning(hostname string) int64 {
+	for _, host := range Config.MonitoredHosts {
+		if host.Name == hostname && host.PendingEventsPerHandlerWarning > 0 {
+			return host.PendingEventsPerHandlerWarning
+		}
+	}
+	return Config.PendingEventsPerHandlerWarning
+}
+
+// Determine whether an instance's backlog, as of the specified absolute stats, is high relative to
+// the number of handlers working it off
+func pendingEventsExceeded(stat StatsStat, warnWhenPendingEventsPerHandlerExceed int64) (pending int64, active int64, exceeded bool) {
+	if warnWhenPendingEventsPerHandlerExceed <= 0 {
+		return
+	}
+	pending = stat.EventsEnqueued - stat.EventsDequeued
+	active = stat.ContinuousHandlersActivated - stat.ContinuousHandlersDeactivated +
+		stat.NotificationHandlersActivated - stat.NotificationHandlersDeactivated +
+		stat.EphemeralHandlersActivated - stat.EphemeralHandlersDeactivated +
+		stat.DiscoveryHandlersActivated - stat.DiscoveryHandlersDeactivated
+	exceeded = active > 0 && pending/active > warnWhenPendingEventsPerHandlerExceed
+	return
+}
+
+// Get the warning to send, if any, about a host's backlogged instances.  We only warn as instances
+// first become backlogged, and during suppression windows the backlog is instead noted once at
+// routine severity, so that we warn once the window ends if it persists.  Must be called with
+// serviceLock held.
+func uPendingEventsWarning(hostname string, warnWhenPendingEventsPerHandlerExceed int64, pendingMessage string, now time.Time) (warning string, info string) {
+	if lastPendingEventsWarned == nil {
+		lastPendingEventsWarned = map[string]bool{}
+	}
+	if lastPendingEventsNoted == nil {
+		lastPendingEventsNoted = map[string]bool{}
+	}
+	if pendingMessage == "" {
+		lastPendingEventsWarned[hostname] = false
+		lastPendingEventsNoted[hostname] = false
+		return
+	}
+	if lastPendingEventsWarned[hostname] {
+		return
+	}
+	message := fmt.Sprintf("%s has more than %d pending events per handler:\n%s", hostname, warnWhenPendingEventsPerHandlerExceed, pendingMessage)
+	if suppressed, reason := alertSuppressed(now); suppressed {
+		fmt.Printf("%s(suppressed: %s)\n", message, reason)
+		if !lastPendingEventsNoted[hostname] {
+			lastPendingEventsNoted[hostname] = true
+			info = message + "(suppressed: " + reason + ")"
+		}
+		return
+	}
+	lastPendingEventsWarned[hostname] = true
+	warning = message
+	return
+}
+
+// Recently-discovered service instances by host, so that closely-spaced commands needn't each
+// re-ping the host.  This is only a read-through cache; the diffing and alerting on changes to
+// the instances happens whenever the host is actually pinged.
+type cachedServiceInstances struct {
+	time                 time.Time
+	serviceVersion       string
+	serviceInstanceIDs   []string
+	serviceInstanceAddrs []string
+	handlers             map[string]AppHandler
+}
+
+const serviceInstanceCacheSecsDefault = 5
+
+var serviceInstanceCache map[string]cachedServiceInstances
+
+// Recent service version changes by host, used to detect crash-looping hosts so that we
+// escalate once rather than announcing each of the restarts
+type versionChange struct {
+	Time    int64
+	Version string
+}
+
+const restartLoopCountDefault = 3
+const restartLoopWindowMinsDefault = 30
+
+var lastServiceVersionChanges map[string][]versionChange
+var lastServiceLooping map[string]bool
+
+// Service version changes by host over the stats window, retained so that deploys can be marked
+var serviceVersionHistory map[string][]versionChange
+
+// A handler birth or death observed when diffing a host's service instances
+type handlerChange struct {
+	Time   int64  `json:"time,omitempty"`
+	NodeID string `json:"node_id,omitempty"`
+	Born   bool   `json:"born,omitempty"`
+}
+
+// Bounded log of handler changes per host, most recent last
+const handlerChangeLogMax = 1000
+
+var lastServiceChanges map[string][]handlerChange
+
+// Response to the show command
+type showResponse struct {
+	Host  string             `json:"host,omitempty"`
+	What  string             `json:"what,omitempty"`
+	Nodes []showNodeResponse `json:"nodes,omitempty"`
+	Error string             `json:"error,omitempty"`
+}
+
+// A single service instance's response to the show command
+type showNodeResponse struct {
+	NodeID string `json:"node_id,omitempty"`
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
 // Watcher show command
 func watcherShow(hostname string, showWhat string) (result string) {
 
@@ -64,7 +236,7 @@ func watcherShow(hostname string, showWhat string) (result string) {
 			"/notehub <host>\n" +
 			"/notehub <host> show <what>\n" +
 			"<host> is " + validHosts + "\n" +
-			"<what> is goroutines, heap, handlers\n"
+			"<what> is goroutines, heap, handlers, errors, lb (or lb with --full for JSON)\n"
 	}
 
 	// Show the host
@@ -72,10 +244,35 @@ func watcherShow(hostname string, showWhat string) (result string) {
 
 }
 
+// Watcher show command, returning structured results
+func watcherGetShow(hostname string, showWhat string) (r showResponse) {
+
+	// Map name to address
+	hostaddr := ""
+	for _, v := range Config.MonitoredHosts {
+		if !v.Disabled {
+			if hostname == v.Name {
+				hostaddr = v.Addr
+				break
+			}
+		}
+	}
+	if hostaddr == "" {
+		r.Host = hostname
+		r.What = showWhat
+		r.Error = "host not found"
+		return
+	}
+
+	// Show the host
+	return watcherGetShowHost(hostname, hostaddr, showWhat)
+
+}
+
 // An async version of the sheet host stats procedure
 func asyncSheetGetHostStats(hostname string, hostaddr string) {
 	time.Sleep(1 * time.Second)
-	slackSendMessage(sheetGetHostStats(hostname, hostaddr))
+	slackPostMessage(Config.SlackWebhookURL, sheetGetHostStats(hostname, hostaddr))
 }
 
 // Show something about the host
@@ -90,21 +287,20 @@ func watcherShowHost(hostname string, hostaddr string, showWhat string) (respons
 		return sheetGetHostStats(hostname, hostaddr)
 	}
 
-	// Get the list of handlers on the host
-	_, _, serviceInstanceIDs, serviceInstanceAddrs, _, err := watcherGetServiceInstances(hostname, hostaddr)
-	if err != nil {
-		return err.Error()
+	// Get the info from the host
+	r := watcherGetShowHost(hostname, hostaddr, showWhat)
+	if r.Error != "" {
+		return r.Error
 	}
 
 	// Show the handlers
-	for i, addr := range serviceInstanceAddrs {
+	for _, n := range r.Nodes {
 		response += "\n"
-		response += fmt.Sprintf("*NODE %s*\n", serviceInstanceIDs[i])
-		r, errstr := watcherShowServiceInstance(addr, serviceInstanceIDs[i], showWhat)
-		if errstr != "" {
-			response += "  " + errstr + "\n"
+		response += fmt.Sprintf("*NODE %s*\n", n.NodeID)
+		if n.Error != "" {
+			response += "  " + n.Error + "\n"
 		} else {
-			response += r
+			response += n.Result
 		}
 	}
 
@@ -112,6 +308,33 @@ func watcherShowHost(hostname string, hostaddr string, showWhat string) (respons
 	return response
 }
 
+// Show something about each service instance on the host, returning structured results
+func watcherGetShowHost(hostname string, hostaddr string, showWhat string) (r showResponse) {
+	r.Host = hostname
+	r.What = showWhat
+	if showWhat == "" {
+		r.Error = "nothing to show"
+		return
+	}
+
+	// Get the list of handlers on the host
+	_, serviceInstanceIDs, serviceInstanceAddrs, _, err := watcherGetServiceInstancesCached(hostname, hostaddr)
+	if err != nil {
+		r.Error = err.Error()
+		return
+	}
+
+	// Show the handlers
+	for i, addr := range serviceInstanceAddrs {
+		n := showNodeResponse{NodeID: serviceInstanceIDs[i]}
+		n.Result, n.Error = watcherShowServiceInstance(addr, serviceInstanceIDs[i], showWhat)
+		r.Nodes = append(r.Nodes, n)
+	}
+
+	// Done
+	return
+}
+
 // This is the central method to get the list of handlers, diff'ing them against the prior versions returned, and
 // sending a message to the service if we've detected that the list has changed.
 func watcherGetServiceInstances(hostname string, hostaddr string) (serviceVersionChanged bool, serviceVersion string, serviceInstanceIDs []string, serviceInstanceAddrs []string, handlers map[string]AppHandler, err error) {
@@ -129,9 +352,40 @@ func watcherGetServiceInstances(hostname string, hostaddr string) (serviceVersio
 		lastServiceHandlers = map[string][]AppHandler{}
 		refreshCache = true
 	}
+	if lastServiceChanges == nil {
+		lastServiceChanges = map[string][]handlerChange{}
+	}
+	if lastServiceNoHandlers == nil {
+		lastServiceNoHandlers = map[string]int{}
+	}
+	if lastServiceVersionChanges == nil {
+		lastServiceVersionChanges = map[string][]versionChange{}
+		lastServiceLooping = map[string]bool{}
+	}
+	if lastServicePings == nil {
+		lastServicePings = map[string]servicePing{}
+	}
 
 	// Get the latest service instances, and exit if error
-	serviceVersion, serviceInstanceIDs, serviceInstanceAddrs, handlers, err = getServiceInstances(hostaddr)
+	serviceVersion, serviceInstanceIDs, serviceInstanceAddrs, handlers, err = getServiceInstances(shutdownContext, hostaddr)
+	if err == nil {
+		uCacheServiceInstances(hostname, serviceVersion, serviceInstanceIDs, serviceInstanceAddrs, handlers)
+	}
+	lastServicePings[hostname] = servicePing{time: time.Now().UTC(), err: err}
+
+	// A host that is up but has no handlers is transient unless it persists, and since there
+	// is nothing to compare we leave the cached service info as it was.
+	if errors.Is(err, errNoHandlers) {
+		lastServiceNoHandlers[hostname]++
+		polls := lastServiceNoHandlers[hostname]
+		err = fmt.Errorf("%s: %w (%d consecutive polls)", hostname, err, polls)
+		if polls == noHandlersPollsBeforeAlert {
+			slackSendAlert(err.Error())
+		}
+		serviceLock.Unlock()
+		return
+	}
+	lastServiceNoHandlers[hostname] = 0
 
 	// Substitute very common errors
 	if err != nil {
@@ -140,14 +394,23 @@ func watcherGetServiceInstances(hostname string, hostaddr string) (serviceVersio
 		}
 	}
 	if err != nil {
-		err = fmt.Errorf("%s: error pinging host: %s", hostname, err)
+		err = fmt.Errorf("%s: %w: %s", hostname, errHostUnreachable, err)
 	}
 
 	// Check to see if the service version is the same
+	quiet := false
+	notice := ""
+	noticeSeverity := slackRoutine
 	if err == nil && lastServiceVersions[hostname] != serviceVersion {
 		if lastServiceVersions[hostname] != "" {
-			err = fmt.Errorf("@channel: %s restarted from %s to %s", hostname, lastServiceVersions[hostname], serviceVersion)
+			notice = fmt.Sprintf("%s%s restarted from %s to %s", slackMention(slackEventRestart), hostname, lastServiceVersions[hostname], serviceVersion)
+			noticeSeverity = slackCritical
+			quiet = uCheckRestartLoop(hostname, lastServiceVersions[hostname], serviceVersion)
+			uRecordVersionChange(hostname, serviceVersion)
 			serviceVersionChanged = true
+			datadogPostEventAsync(fmt.Sprintf("%s deployed %s", hostname, serviceVersion),
+				fmt.Sprintf("%s restarted from %s to %s", hostname, lastServiceVersions[hostname], serviceVersion),
+				[]string{"host:" + hostname, "service_version:" + serviceVersion})
 		}
 		refreshCache = true
 	}
@@ -156,7 +419,7 @@ func watcherGetServiceInstances(hostname string, hostaddr string) (serviceVersio
 	lastHandlers, exists := lastServiceHandlers[hostname]
 	if !exists {
 		refreshCache = true
-	} else if err == nil {
+	} else if err == nil && notice == "" {
 
 		// Generate a list of differences
 		addedHandlers := map[string]AppHandler{}
@@ -177,7 +440,8 @@ func watcherGetServiceInstances(hostname string, hostaddr string) (serviceVersio
 			}
 		}
 		if len(addedHandlers) > 0 || len(removedHandlers) > 0 {
-			s := "@channel: " + hostname + " handlers changed:\n"
+			uLogHandlerChanges(hostname, addedHandlers, removedHandlers)
+			s := slackMention(slackEventHandlersChanged) + hostname + " handlers changed:\n"
 			if len(addedHandlers) > 0 {
 				s += "  BORN:\n"
 				for k := range addedHandlers {
@@ -190,19 +454,37 @@ func watcherGetServiceInstances(hostname string, hostaddr string) (serviceVersio
 					s += "    " + k + "\n"
 				}
 			}
-			err = fmt.Errorf("%s", s)
+			if instanceCountDroppedSharply(len(lastHandlers), len(handlers)) {
+				lost := ""
+				if nodeIDs := handlersLostNodes(removedHandlers, handlers); len(nodeIDs) > 0 {
+					lost = ", losing nodes " + strings.Join(nodeIDs, ", ")
+				}
+				s = fmt.Sprintf("%s%s instance count dropped sharply from %d to %d%s\n", slackMention(slackEventInstanceDrop), hostname, len(lastHandlers), len(handlers), lost) + s
+				noticeSeverity = slackCritical
+				datadogPostEventAsync(fmt.Sprintf("%s lost %d instances", hostname, len(lastHandlers)-len(handlers)), s,
+					[]string{"host:" + hostname})
+			}
+			notice = s
 			refreshCache = true
 		}
 	}
 
-	// If an error, post it
+	// Post any error, and any notice of a change unless it's a restart that's part of a crash
+	// loop that we've already escalated
 	if err != nil {
-		slackSendMessage(err.Error())
+		slackSendAlert(err.Error())
+	}
+	if notice != "" && !quiet {
+		slackSendMessageVia(Config.SlackWebhookURL, noticeSeverity, notice)
+	}
+
+	// Note when a crash-looping host has stabilized
+	if err == nil && notice == "" {
+		uCheckRestartLoopEnded(hostname, serviceVersion)
 	}
 
-	// If we need to re-cache service info, do it.  If this was successful, it means that no error actually occurred
-	if refreshCache {
-		err = nil
+	// If we need to re-cache service info, do it, but only from a successful ping
+	if refreshCache && err == nil {
 		lastServiceVersions[hostname] = serviceVersion
 		newHandlers := []AppHandler{}
 		for _, v := range handlers {
@@ -217,17 +499,395 @@ func watcherGetServiceInstances(hostname string, hostaddr string) (serviceVersio
 
 }
 
+// Get the nodes of which no instances remain, by their NodeID rather than by the SIIDs of their
+// instances, because a node may host an instance of each of several service types
+func handlersLostNodes(removedHandlers map[string]AppHandler, handlers map[string]AppHandler) (nodeIDs []string) {
+	remaining := map[string]bool{}
+	for siid, h := range handlers {
+		remaining[strings.TrimSuffix(siid, ":"+h.PrimaryService)] = true
+	}
+	lost := map[string]bool{}
+	for siid, h := range removedHandlers {
+		nodeID := strings.TrimSuffix(siid, ":"+h.PrimaryService)
+		if !remaining[nodeID] && !lost[nodeID] {
+			lost[nodeID] = true
+			nodeIDs = append(nodeIDs, nodeID)
+		}
+	}
+	sort.Strings(nodeIDs)
+	return
+}
+
+// Default fraction of instances whose loss between polls is considered a sharp drop
+const instanceDropFractionDefault = 0.25
+
+// See whether a host has lost a sharp fraction of its instances between polls.  A host with
+// no instances at all is an outage, which the failure to ping already reports.
+func instanceCountDroppedSharply(before int, after int) bool {
+	if before == 0 || after == 0 || after >= before {
+		return false
+	}
+	fraction := Config.InstanceDropFraction
+	if fraction <= 0 {
+		fraction = instanceDropFractionDefault
+	}
+	return float64(before-after)/float64(before) > fraction
+}
+
+// Warn when a host's bucket size differs from what's expected, because a misconfigured host
+// silently changes both the size of our in-memory stats and the granularity of its metrics.
+// The host's buckets are used regardless.  Must be called with serviceLock held.
+func uCheckBucketMins(hostname string, bucketMins int64) {
+	if lastBucketMinsWarned == nil {
+		lastBucketMinsWarned = map[string]int64{}
+	}
+	expected := int64(Config.ExpectedBucketMins)
+	if expected <= 0 || bucketMins == 0 || bucketMins == expected {
+		delete(lastBucketMinsWarned, hostname)
+		return
+	}
+	if lastBucketMinsWarned[hostname] == bucketMins {
+		return
+	}
+	lastBucketMinsWarned[hostname] = bucketMins
+	slackSendMessage(fmt.Sprintf("%s reports %d-minute stats buckets rather than the expected %d minutes", hostname, bucketMins, expected))
+}
+
+// Alert when instances have disagreed with the host's service version for longer than a rolling
+// deploy should take, and say so once they agree again.  Must be called with serviceLock held.
+func uCheckVersionMismatch(hostname string, serviceVersion string, mismatched []string) {
+	if versionMismatchSince == nil {
+		versionMismatchSince = map[string]int64{}
+		versionMismatchAlerted = map[string]bool{}
+	}
+	if len(mismatched) == 0 {
+		if versionMismatchAlerted[hostname] {
+			slackSendMessage(fmt.Sprintf("%s instances all agree on service version %s", hostname, serviceVersion))
+		}
+		delete(versionMismatchSince, hostname)
+		delete(versionMismatchAlerted, hostname)
+		return
+	}
+
+	now := time.Now().UTC().Unix()
+	if versionMismatchSince[hostname] == 0 {
+		versionMismatchSince[hostname] = now
+	}
+	alertMins := Config.VersionMismatchAlertMins
+	if alertMins == 0 {
+		alertMins = versionMismatchAlertMinsDefault
+	}
+	if alertMins < 0 || versionMismatchAlerted[hostname] || now-versionMismatchSince[hostname] < int64(alertMins)*60 {
+		return
+	}
+	versionMismatchAlerted[hostname] = true
+	slackSendAlert(fmt.Sprintf("%s instances have disagreed with service version %s for %d minutes:\n    %s",
+		hostname, serviceVersion, (now-versionMismatchSince[hostname])/60, strings.Join(mismatched, "\n    ")))
+}
+
+// Layouts in which instances have reported when they started, most common first
+var nodeStartedLayouts = []string{
+	"2006-01-02T15:04:05Z",
+	time.RFC3339,
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02T15:04:05.999999999-0700",
+}
+
+// Parse the time at which an instance says that it started, in any of the layouts it may use
+func parseNodeStarted(s string) (started time.Time, err error) {
+	for _, layout := range nodeStartedLayouts {
+		started, err = time.Parse(layout, s)
+		if err == nil {
+			return
+		}
+	}
+	err = fmt.Errorf("can't parse node_started '%s'", s)
+	return
+}
+
+// Get when an instance started, falling back to the legacy service version's epoch if its
+// node_started is absent or can't be parsed, or zero if neither is known
+func nodeStartedTime(siid string, nodeStarted string, legacyServiceVersion int64) (started int64) {
+	started = legacyServiceVersion
+	if nodeStarted == "" {
+		return
+	}
+	t, err := parseNodeStarted(nodeStarted)
+	if err != nil {
+		fmt.Printf("%s: %s\n", siid, err)
+		return
+	}
+	return t.Unix()
+}
+
+// Get the crash loop thresholds
+func restartLoopThresholds() (count int, windowSecs int64) {
+	count = Config.RestartLoopCount
+	if count <= 0 {
+		count = restartLoopCountDefault
+	}
+	windowMins := Config.RestartLoopWindowMins
+	if windowMins <= 0 {
+		windowMins = restartLoopWindowMinsDefault
+	}
+	return count, int64(windowMins) * 60
+}
+
+// Record a service version change, returning true if the host is crash-looping and that has
+// already been escalated, so the individual restart needn't be announced.  Must be called
+// with serviceLock held.
+func uCheckRestartLoop(hostname string, fromVersion string, toVersion string) (quiet bool) {
+	count, windowSecs := restartLoopThresholds()
+	now := time.Now().UTC().Unix()
+
+	// Record the change, discarding those that have fallen out of the window
+	changes := []versionChange{}
+	for _, c := range lastServiceVersionChanges[hostname] {
+		if now-c.Time < windowSecs {
+			changes = append(changes, c)
+		}
+	}
+	if len(changes) == 0 {
+		changes = append(changes, versionChange{Time: now, Version: fromVersion})
+	}
+	changes = append(changes, versionChange{Time: now, Version: toVersion})
+	lastServiceVersionChanges[hostname] = changes
+
+	// Exit if not looping, or if we've already said so
+	if len(changes)-1 < count {
+		return false
+	}
+	if lastServiceLooping[hostname] {
+		fmt.Printf("%s: restarted from %s to %s while crash-looping\n", hostname, fromVersion, toVersion)
+		return true
+	}
+	lastServiceLooping[hostname] = true
+
+	versions := []string{}
+	for _, c := range changes {
+		versions = append(versions, c.Version)
+	}
+	slackSendAlert(fmt.Sprintf("%s%s is crash-looping, having changed service version %d times in %d minutes:\n%s",
+		slackMention(slackEventCrashLoop), hostname, len(changes)-1, windowSecs/60, strings.Join(versions, " -> ")))
+	datadogPostEventAsync(fmt.Sprintf("%s is crash-looping", hostname), strings.Join(versions, " -> "),
+		[]string{"host:" + hostname})
+	return true
+}
+
+// Record a service version change in the host's history, discarding those that are older than
+// the in-memory stats.  Must be called with serviceLock held.
+func uRecordVersionChange(hostname string, toVersion string) {
+	if serviceVersionHistory == nil {
+		serviceVersionHistory = map[string][]versionChange{}
+	}
+	now := time.Now().UTC().Unix()
+	history := []versionChange{}
+	for _, c := range serviceVersionHistory[hostname] {
+		if now-c.Time < statsWindowSecs {
+			history = append(history, c)
+		}
+	}
+	serviceVersionHistory[hostname] = append(history, versionChange{Time: now, Version: toVersion})
+}
+
+// Get the host's recent service version changes, oldest first
+func watcherVersionHistory(hostname string) (changes []versionChange) {
+	serviceLock.Lock()
+	changes = append(changes, serviceVersionHistory[hostname]...)
+	serviceLock.Unlock()
+	return
+}
+
+// Once a crash-looping host has gone a full window without a version change, say so and
+// reset.  Must be called with serviceLock held.
+func uCheckRestartLoopEnded(hostname string, serviceVersion string) {
+	if !lastServiceLooping[hostname] {
+		return
+	}
+	_, windowSecs := restartLoopThresholds()
+	changes := lastServiceVersionChanges[hostname]
+	if len(changes) > 0 && time.Now().UTC().Unix()-changes[len(changes)-1].Time < windowSecs {
+		return
+	}
+	lastServiceLooping[hostname] = false
+	lastServiceVersionChanges[hostname] = nil
+	slackSendMessage(fmt.Sprintf("%s is no longer crash-looping, stable for %d minutes on %s", hostname, windowSecs/60, serviceVersion))
+}
+
+// Cache the service instances just discovered on a host.  Must be called with serviceLock held.
+// The cache holds its own copies, because callers go on to modify what they were returned.
+func uCacheServiceInstances(hostname string, serviceVersion string, serviceInstanceIDs []string, serviceInstanceAddrs []string, handlers map[string]AppHandler) {
+	if serviceInstanceCache == nil {
+		serviceInstanceCache = map[string]cachedServiceInstances{}
+	}
+	serviceInstanceCache[hostname] = cachedServiceInstances{
+		time:                 time.Now(),
+		serviceVersion:       serviceVersion,
+		serviceInstanceIDs:   append([]string{}, serviceInstanceIDs...),
+		serviceInstanceAddrs: append([]string{}, serviceInstanceAddrs...),
+		handlers:             copyHandlers(handlers),
+	}
+}
+
+// Copy a map of handlers, so that the copy may be modified without locking
+func copyHandlers(handlers map[string]AppHandler) (out map[string]AppHandler) {
+	out = make(map[string]AppHandler, len(handlers))
+	for siid, h := range handlers {
+		out[siid] = h
+	}
+	return
+}
+
+// Discard the cached service instances of a host, so that the next request re-pings it
+func watcherInvalidateServiceInstances(hostname string) {
+	serviceLock.Lock()
+	delete(serviceInstanceCache, hostname)
+	serviceLock.Unlock()
+}
+
+// Get the service instances of a host, using those recently discovered if still fresh
+func watcherGetServiceInstancesCached(hostname string, hostaddr string) (serviceVersion string, serviceInstanceIDs []string, serviceInstanceAddrs []string, handlers map[string]AppHandler, err error) {
+
+	ttlSecs := Config.InstanceCacheSecs
+	if ttlSecs <= 0 {
+		ttlSecs = serviceInstanceCacheSecsDefault
+	}
+	serviceLock.Lock()
+	c, present := serviceInstanceCache[hostname]
+	if present && time.Since(c.time) < time.Duration(ttlSecs)*time.Second {
+		serviceVersion = c.serviceVersion
+		serviceInstanceIDs = append([]string{}, c.serviceInstanceIDs...)
+		serviceInstanceAddrs = append([]string{}, c.serviceInstanceAddrs...)
+		handlers = copyHandlers(c.handlers)
+		serviceLock.Unlock()
+		return
+	}
+	serviceLock.Unlock()
+
+	_, serviceVersion, serviceInstanceIDs, serviceInstanceAddrs, handlers, err = watcherGetServiceInstances(hostname, hostaddr)
+	return
+
+}
+
+// Append handler births and deaths to the host's change log, discarding the oldest entries
+// once the log is full.  Must be called with serviceLock held.
+func uLogHandlerChanges(hostname string, addedHandlers map[string]AppHandler, removedHandlers map[string]AppHandler) {
+	now := time.Now().UTC().Unix()
+	changes := lastServiceChanges[hostname]
+	for k := range addedHandlers {
+		changes = append(changes, handlerChange{Time: now, NodeID: k, Born: true})
+	}
+	for k := range removedHandlers {
+		changes = append(changes, handlerChange{Time: now, NodeID: k, Born: false})
+	}
+	if len(changes) > handlerChangeLogMax {
+		changes = changes[len(changes)-handlerChangeLogMax:]
+	}
+	lastServiceChanges[hostname] = changes
+}
+
+// Response to the churn command
+type churnResponse struct {
+	Host    string          `json:"host,omitempty"`
+	Window  string          `json:"window,omitempty"`
+	Born    int             `json:"born"`
+	Died    int             `json:"died"`
+	Net     int             `json:"net"`
+	Gross   int             `json:"gross"`
+	Changes []handlerChange `json:"changes,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// Show the handler births and deaths on a host within a recent window
+func watcherChurn(hostname string, window string) (response string) {
+
+	r := watcherGetChurn(hostname, window)
+	if r.Error != "" {
+		return r.Error
+	}
+
+	detail := ""
+	for _, c := range r.Changes {
+		what := "DIED"
+		if c.Born {
+			what = "BORN"
+		}
+		detail += fmt.Sprintf("%s %s %s\n", time.Unix(c.Time, 0).UTC().Format("01-02 15:04:05"), what, c.NodeID)
+	}
+	response = fmt.Sprintf("%s handlers in the last %s: %d born, %d died (net %+d, gross %d)\n",
+		hostname, r.Window, r.Born, r.Died, r.Net, r.Gross)
+	if detail != "" {
+		response += "```" + detail + "```"
+	}
+	return
+
+}
+
+// Get the handler births and deaths on a host within a recent window
+func watcherGetChurn(hostname string, window string) (r churnResponse) {
+	r.Host = hostname
+
+	// Validate the host
+	found := false
+	for _, v := range Config.MonitoredHosts {
+		if !v.Disabled && hostname == v.Name {
+			found = true
+			break
+		}
+	}
+	if !found {
+		r.Error = "host not found"
+		return
+	}
+
+	// Parse the window
+	duration, err := time.ParseDuration(window)
+	if err != nil || duration <= 0 {
+		r.Error = "/notehub <host> churn <duration> (such as 30m or 2h)"
+		return
+	}
+	r.Window = duration.String()
+	since := time.Now().UTC().Add(-duration).Unix()
+
+	// Gather the changes in the window
+	serviceLock.Lock()
+	for _, c := range lastServiceChanges[hostname] {
+		if c.Time >= since {
+			r.Changes = append(r.Changes, c)
+		}
+	}
+	serviceLock.Unlock()
+
+	// Summarize
+	for _, c := range r.Changes {
+		if c.Born {
+			r.Born++
+		} else {
+			r.Died++
+		}
+	}
+	r.Net = r.Born - r.Died
+	r.Gross = r.Born + r.Died
+	return
+
+}
+
 // Get the list of handlers
-func getServiceInstances(hostaddr string) (serviceVersion string, serviceInstanceIDs []string, serviceInstanceAddrs []string, handlers map[string]AppHandler, err error) {
+func getServiceInstances(ctx context.Context, hostaddr string) (serviceVersion string, serviceInstanceIDs []string, serviceInstanceAddrs []string, handlers map[string]AppHandler, err error) {
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(30))
+	defer cancel()
 
-	url := "https://" + hostaddr + "/ping?show=\"handlers\""
-	req, err2 := http.NewRequest("GET", url, nil)
+	url := "https://" + hostaddr + "/ping?show=\"handlers\"" + pingParamsForHost(hostaddr)
+	req, err2 := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err2 != nil {
 		err = err2
 		return
 	}
-	httpclient := &http.Client{
-		Timeout: time.Second * time.Duration(30),
+	httpclient, err := watcherHTTPClient(hostaddr)
+	if err != nil {
+		return
 	}
 	if watcherHttpTrace {
 		fmt.Printf("getServiceInstances: %s\n", url)
@@ -262,8 +922,13 @@ func getServiceInstances(hostaddr string) (serviceVersion string, serviceInstanc
 		pb.Body.ServiceVersion = time.Unix(pb.Body.LegacyServiceVersion, 0).Format("20060102-150405")
 	}
 
+	// A ping with a service version but no handlers is valid, whereas one with neither is malformed
 	if pb.Body.AppHandlers == nil {
-		err = fmt.Errorf("no handlers in " + string(rspJSON))
+		if pb.Body.ServiceVersion == "" {
+			err = fmt.Errorf("malformed ping response: %s", string(rspJSON))
+		} else {
+			err = errNoHandlers
+		}
 		return
 	}
 
@@ -277,9 +942,17 @@ func getServiceInstances(hostaddr string) (serviceVersion string, serviceInstanc
 		// different services that collect stats within their own process address spaces.  Note that
 		// we replace the NodeID in the structure so that the caller can make that assumption.
 		h.NodeID = h.NodeID + ":" + h.PrimaryService
+
+		// Two handlers with the same NodeID and primary service can't be addressed separately, because
+		// the SIID is how notehub routes our requests to an instance, so rather than having the latter
+		// silently replace the former we keep the first and say so.
+		if prev, present := handlers[h.NodeID]; present {
+			fmt.Printf("getServiceInstances: %s: ignoring duplicate instance %s (%s %s %v), keeping (%s %s %v)\n",
+				hostaddr, h.NodeID, h.NodeName, h.Ipv4, h.NodeTags, prev.NodeName, prev.Ipv4, prev.NodeTags)
+			continue
+		}
 		serviceInstanceIDs = append(serviceInstanceIDs, h.NodeID)
-		addr := fmt.Sprintf("http://%s", hostaddr)
-		serviceInstanceAddrs = append(serviceInstanceAddrs, addr)
+		serviceInstanceAddrs = append(serviceInstanceAddrs, watcherInstanceAddr(hostaddr))
 		handlers[h.NodeID] = h
 	}
 
@@ -290,16 +963,109 @@ func getServiceInstances(hostaddr string) (serviceVersion string, serviceInstanc
 
 }
 
-// Retrieve the ping info from a handler
-func getServiceInstanceInfo(addr string, siid string, requestWhat string, showWhat string) (pb PingBody, err error) {
+// Clients used to reach each host, by address, which are reused so that connections are too.
+// Because we query all of a host's instances through the same address, more idle connections
+// are kept to each host than the default, so that polling a large host doesn't re-handshake.
+const watcherIdleConnsPerHost = 32
 
-	// Prefix in case it's missing
-	if !strings.Contains(addr, "://") {
-		addr = "https://" + addr
-	}
+var watcherHTTPClientsLock sync.Mutex
+var watcherHTTPClients map[string]*http.Client
 
-	// Get the data
-	Url := ""
+// Get the client for requests to a host, which presents the host's client certificate and
+// verifies the host against its CA if they're configured
+func watcherHTTPClient(hostaddr string) (httpclient *http.Client, err error) {
+
+	watcherHTTPClientsLock.Lock()
+	defer watcherHTTPClientsLock.Unlock()
+	if watcherHTTPClients == nil {
+		watcherHTTPClients = map[string]*http.Client{}
+	}
+	httpclient, present := watcherHTTPClients[hostaddr]
+	if present {
+		return
+	}
+
+	// Find the host's TLS config, if any
+	var host MonitoredHost
+	for _, h := range Config.MonitoredHosts {
+		if h.Addr == hostaddr {
+			host = h
+			break
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = watcherIdleConnsPerHost
+	httpclient = &http.Client{Transport: transport}
+	if host.TLSClientCert != "" || host.TLSCA != "" {
+		tlsConfig := &tls.Config{}
+		if host.TLSClientCert != "" {
+			cert, err2 := tls.LoadX509KeyPair(host.TLSClientCert, host.TLSClientKey)
+			if err2 != nil {
+				err = fmt.Errorf("%s: can't load client certificate: %s", hostaddr, err2)
+				return
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		if host.TLSCA != "" {
+			pem, err2 := os.ReadFile(host.TLSCA)
+			if err2 != nil {
+				err = fmt.Errorf("%s: can't load CA: %s", hostaddr, err2)
+				return
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				err = fmt.Errorf("%s: no certificates found in %s", hostaddr, host.TLSCA)
+				return
+			}
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	watcherHTTPClients[hostaddr] = httpclient
+
+	return
+
+}
+
+// Get the address by which a host's service instances are reached, which is over TLS for hosts
+// configured for mutual TLS because that's the only way to present the client certificate
+func watcherInstanceAddr(hostaddr string) (addr string) {
+	for _, host := range Config.MonitoredHosts {
+		if host.Addr == hostaddr && (host.TLSClientCert != "" || host.TLSCA != "") {
+			return "https://" + hostaddr
+		}
+	}
+	return "http://" + hostaddr
+}
+
+// Get the host's additional ping query parameters, escaped and in a stable order, each preceded by '&'
+func pingParamsForHost(hostaddr string) (params string) {
+	for _, host := range Config.MonitoredHosts {
+		if host.Addr != hostaddr {
+			continue
+		}
+		keys := make([]string, 0, len(host.PingParams))
+		for k := range host.PingParams {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			params += "&" + url.QueryEscape(k) + "=" + url.QueryEscape(host.PingParams[k])
+		}
+		break
+	}
+	return
+}
+
+// Retrieve the ping info from a handler
+func getServiceInstanceInfo(ctx context.Context, addr string, siid string, requestWhat string, showWhat string) (pb PingBody, err error) {
+
+	// Prefix in case it's missing
+	if !strings.Contains(addr, "://") {
+		addr = "https://" + addr
+	}
+
+	// Get the data
+	Url := ""
 	if siid != "" {
 		Url = fmt.Sprintf("%s/ping?node=\"%s\"&", addr, siid)
 	} else {
@@ -312,14 +1078,21 @@ func getServiceInstanceInfo(addr string, siid string, requestWhat string, showWh
 	} else {
 		Url += fmt.Sprintf("show=\"%s\"&req=\"%s\"", url.QueryEscape(showWhat), url.QueryEscape(requestWhat))
 	}
+	Url += pingParamsForHost(strings.TrimPrefix(strings.TrimPrefix(addr, "https://"), "http://"))
 
-	req, err2 := http.NewRequest("GET", Url, nil)
+	ctx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(60))
+	defer cancel()
+	req, err2 := http.NewRequestWithContext(ctx, "GET", Url, nil)
 	if err2 != nil {
 		err = err2
 		return
 	}
-	httpclient := &http.Client{
-		Timeout: time.Second * time.Duration(60),
+	// Ask for the large status payloads to be compressed.  Because we set this ourselves the
+	// transport won't transparently decompress, so that is done below.
+	req.Header.Set("Accept-Encoding", "gzip")
+	httpclient, err := watcherHTTPClient(strings.TrimPrefix(strings.TrimPrefix(addr, "https://"), "http://"))
+	if err != nil {
+		return
 	}
 	if watcherHttpTrace {
 		fmt.Printf("getServiceInstanceInfo: %s\n", Url)
@@ -338,8 +1111,18 @@ func getServiceInstanceInfo(addr string, siid string, requestWhat string, showWh
 	}
 	defer rsp.Body.Close()
 
-	// Read the body
-	rspJSON, err2 := io.ReadAll(rsp.Body)
+	// Read the body, decompressing it if the host supports compression
+	var body io.Reader = rsp.Body
+	if rsp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err2 := gzip.NewReader(rsp.Body)
+		if err2 != nil {
+			err = fmt.Errorf("%s: %s", Url, err2)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	rspJSON, err2 := io.ReadAll(body)
 	if err2 != nil {
 		err = err2
 		return
@@ -363,8 +1146,14 @@ func getServiceInstanceInfo(addr string, siid string, requestWhat string, showWh
 // Show something about a service instance
 func watcherShowServiceInstance(addr string, siid string, showWhat string) (response string, errstr string) {
 
-	// Get the info from the service instance
-	pb, err := getServiceInstanceInfo(addr, siid, "", showWhat)
+	// The ping error rate is tracked by us rather than by the instance
+	if showWhat == "errors" {
+		response = pingErrorRateStr(siid)
+		return
+	}
+
+	// Get the info from the service instance, with the full form of "lb" requested as "lb"
+	pb, err := getServiceInstanceInfo(shutdownContext, addr, siid, "", strings.TrimSuffix(showWhat, "-full"))
 	if err != nil {
 		errstr = err.Error()
 		return
@@ -386,15 +1175,18 @@ func watcherShowServiceInstance(addr string, siid string, showWhat string) (resp
 			response = "no handler information available"
 			return
 		}
-		rspJSON, err := json.MarshalIndent(*pb.Body.AppHandlers, "", "    ")
-		if err != nil {
-			errstr = err.Error()
-		} else {
-			response = string(rspJSON)
-		}
+		response, errstr = watcherShowHandlers(siid, *pb.Body.AppHandlers)
 		return
 
 	case "lb":
+		if pb.Body.LBStatus == nil || len(*pb.Body.LBStatus) == 0 {
+			response = "no load balancer information available"
+			return
+		}
+		response = watcherSummarizeLB(*pb.Body.LBStatus)
+		return
+
+	case "lb-full":
 		if pb.Body.LBStatus == nil {
 			response = "no load balancer information available"
 			return
@@ -414,6 +1206,130 @@ func watcherShowServiceInstance(addr string, siid string, showWhat string) (resp
 	return
 }
 
+// Default maximum number of handlers shown, most heavily loaded first
+const showHandlersMaxDefault = 25
+
+// Show the most heavily loaded handlers, with a link to the full list if there are too many
+func watcherShowHandlers(siid string, handlers []AppHandler) (response string, errstr string) {
+
+	limit := Config.ShowHandlersMax
+	if limit <= 0 {
+		limit = showHandlersMaxDefault
+	}
+	sort.SliceStable(handlers, func(i, j int) bool {
+		return handlers[i].LoadLevel > handlers[j].LoadLevel
+	})
+	shown := handlers
+	if len(shown) > limit {
+		shown = shown[:limit]
+	}
+
+	rspJSON, err := json.MarshalIndent(shown, "", "    ")
+	if err != nil {
+		return "", err.Error()
+	}
+	response = string(rspJSON)
+	if len(shown) == len(handlers) {
+		return
+	}
+
+	// Save the full list for download
+	rspJSON, err = json.MarshalIndent(handlers, "", "    ")
+	if err != nil {
+		return "", err.Error()
+	}
+	filename, err := sheetSaveFile("handlers-"+siid, jsonType, rspJSON)
+	if err != nil {
+		return "", err.Error()
+	}
+	response += fmt.Sprintf("\nshowing %d of %d handlers by load: <%s%s%s|%s>\n",
+		len(shown), len(handlers), Config.HostURL, sheetRoute, filename, filename)
+	return
+
+}
+
+// Number of databases shown in the load balancer summary
+const lbSummaryDatabases = 5
+
+// Summarize the key figures of a service instance's most recent load balancer stats bucket
+func watcherSummarizeLB(sistats []StatsStat) (response string) {
+	live := sistats[0]
+	bucketSecs := live.BucketMins * 60
+	if bucketSecs == 0 {
+		return "no load balancer buckets available"
+	}
+
+	// Convert the buckets to be relative, from which the most recent complete bucket is used
+	bucket := live
+	if len(sistats) > 2 {
+		bucket = ConvertStatsFromAbsoluteToRelative(sistats[1:], bucketSecs)[0]
+	}
+
+	response += "```"
+	response += fmt.Sprintf("bucket    %s (%d mins)\n", time.Unix(bucket.SnapshotTaken, 0).UTC().Format("01-02 15:04:05"), live.BucketMins)
+	response += fmt.Sprintf("mem       total %dMB free %dMB\n", live.OSMemTotal/(1024*1024), live.OSMemFree/(1024*1024))
+	response += fmt.Sprintf("handlers  continuous %d notification %d ephemeral %d discovery %d\n",
+		live.ContinuousHandlersActivated-live.ContinuousHandlersDeactivated,
+		live.NotificationHandlersActivated-live.NotificationHandlersDeactivated,
+		live.EphemeralHandlersActivated-live.EphemeralHandlersDeactivated,
+		live.DiscoveryHandlersActivated-live.DiscoveryHandlersDeactivated)
+	response += fmt.Sprintf("events    received %d routed %d pending %d\n",
+		bucket.EventsEnqueued, bucket.EventsRouted, live.EventsEnqueued-live.EventsDequeued)
+
+	// Show the busiest databases
+	keys := make([]string, 0, len(bucket.Databases))
+	for k := range bucket.Databases {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		di := bucket.Databases[keys[i]]
+		dj := bucket.Databases[keys[j]]
+		if di.Reads+di.Writes != dj.Reads+dj.Writes {
+			return di.Reads+di.Writes > dj.Reads+dj.Writes
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > lbSummaryDatabases {
+		keys = keys[:lbSummaryDatabases]
+	}
+	for _, k := range keys {
+		d := bucket.Databases[k]
+		response += fmt.Sprintf("database  %-20s %6d reads %4dms %6d writes %4dms\n", k, d.Reads, d.ReadMs, d.Writes, d.WriteMs)
+	}
+	response += "```"
+
+	return
+}
+
+// A cache's high-water mark only goes down when the cache is flushed or its instance restarts,
+// so a drop to well below the prior bucket's is treated as a reset
+const cacheHWMResetFraction = 0.5
+
+// See whether a cache's high-water mark indicates that it was reset since the prior bucket
+func cacheHWMReset(hwm int64, prevHWM int64) bool {
+	return hwm < prevHWM && float64(hwm) < float64(prevHWM)*cacheHWMResetFraction
+}
+
+// Get the high-water mark of a cache within a bucket, and whether the cache was reset during it,
+// from the instance's high-water marks as of the end of this bucket and the prior one.  Because
+// the instance's mark is the highest since it (or its cache) started, it's only the bucket's own
+// peak if it was reached during the bucket; otherwise the peak is long past, so the bucket's
+// peak is taken to be the larger of its entries at the start and the end of the bucket.  This
+// keeps a peak from before a reset, or from long ago, from being reported for every bucket.
+func cacheBucketHWM(cur StatsCache, prev StatsCache) (hwm int64, resets int64) {
+	if cacheHWMReset(cur.EntriesHWM, prev.EntriesHWM) {
+		return cur.EntriesHWM, 1
+	}
+	if cur.EntriesHWM > prev.EntriesHWM {
+		return cur.EntriesHWM, 0
+	}
+	hwm = cur.Entries
+	if prev.Entries > hwm && prev.Entries <= cur.EntriesHWM {
+		hwm = prev.Entries
+	}
+	return hwm, 0
+}
+
 // Convert N absolute buckets to N-1 relative buckets by subtracting values
 // from the next bucket from the value in each bucket.
 func ConvertStatsFromAbsoluteToRelative(stats []StatsStat, bucketSecs int64) (out []StatsStat) {
@@ -435,7 +1351,7 @@ func ConvertStatsFromAbsoluteToRelative(stats []StatsStat, bucketSecs int64) (ou
 	if stats[0].Fatals == nil {
 		stats[0].Fatals = make(map[string]int64)
 	}
-	stats[0].SnapshotTaken = (stats[0].SnapshotTaken / bucketSecs) * bucketSecs
+	stats[0].SnapshotTaken = statsBucketTime(stats[0].SnapshotTaken, bucketSecs)
 
 	// Special-case returning a single stat just after server reboot
 	if len(stats) == 1 {
@@ -455,39 +1371,35 @@ func ConvertStatsFromAbsoluteToRelative(stats []StatsStat, bucketSecs int64) (ou
 	// to numbers that are bucket-scoped relative to the prior bucket
 	for i := 0; i < len(stats)-1; i++ {
 
-		stats[i].SnapshotTaken = (stats[i].SnapshotTaken / bucketSecs) * bucketSecs
+		stats[i].SnapshotTaken = statsBucketTime(stats[i].SnapshotTaken, bucketSecs)
 		stats[i].BucketMins = 0
 
-		stats[i].OSDiskRead -= stats[i+1].OSDiskRead
-		stats[i].OSDiskWrite -= stats[i+1].OSDiskWrite
-		stats[i].HttpConnTotal -= stats[i+1].HttpConnTotal
-		stats[i].HttpConnReused -= stats[i+1].HttpConnReused
-
-		// Special handling for these two stats, which seem odd because
-		// occasionally the OS will return numbers lower than the previous ones
-		if stats[i+1].OSNetReceived > stats[i].OSNetReceived {
-			stats[i].OSNetReceived = stats[i+1].OSNetReceived
-		}
-		stats[i].OSNetReceived -= stats[i+1].OSNetReceived
-		if stats[i+1].OSNetSent > stats[i].OSNetSent {
-			stats[i].OSNetSent = stats[i+1].OSNetSent
-		}
-		stats[i].OSNetSent -= stats[i+1].OSNetSent
+		// Counters can reset if the server restarts mid-window (or, for the network
+		// stats, because occasionally the OS will return numbers lower than the previous
+		// ones), so all of these are clamped at zero rather than going negative.
+		stats[i].OSDiskRead = relativeCounterU(stats[i].OSDiskRead, stats[i+1].OSDiskRead)
+		stats[i].OSDiskWrite = relativeCounterU(stats[i].OSDiskWrite, stats[i+1].OSDiskWrite)
+		stats[i].HttpConnTotal = relativeCounterU(stats[i].HttpConnTotal, stats[i+1].HttpConnTotal)
+		stats[i].HttpConnReused = relativeCounterU(stats[i].HttpConnReused, stats[i+1].HttpConnReused)
+		stats[i].OSNetReceived = relativeCounterU(stats[i].OSNetReceived, stats[i+1].OSNetReceived)
+		stats[i].OSNetSent = relativeCounterU(stats[i].OSNetSent, stats[i+1].OSNetSent)
 
 		// For Handlers, Activated is the 'new activations' whereas Deactivated is 'currently active' count
 		stats[i].DiscoveryHandlersDeactivated = stats[i].DiscoveryHandlersActivated - stats[i].DiscoveryHandlersDeactivated
-		stats[i].DiscoveryHandlersActivated -= stats[i+1].DiscoveryHandlersActivated
+		stats[i].DiscoveryHandlersActivated = relativeCounter(stats[i].DiscoveryHandlersActivated, stats[i+1].DiscoveryHandlersActivated)
 		stats[i].ContinuousHandlersDeactivated = stats[i].ContinuousHandlersActivated - stats[i].ContinuousHandlersDeactivated
-		stats[i].ContinuousHandlersActivated -= stats[i+1].ContinuousHandlersActivated
+		stats[i].ContinuousHandlersActivated = relativeCounter(stats[i].ContinuousHandlersActivated, stats[i+1].ContinuousHandlersActivated)
 		stats[i].NotificationHandlersDeactivated = stats[i].NotificationHandlersActivated - stats[i].NotificationHandlersDeactivated
-		stats[i].NotificationHandlersActivated -= stats[i+1].NotificationHandlersActivated
+		stats[i].NotificationHandlersActivated = relativeCounter(stats[i].NotificationHandlersActivated, stats[i+1].NotificationHandlersActivated)
 		stats[i].EphemeralHandlersDeactivated = stats[i].EphemeralHandlersActivated - stats[i].EphemeralHandlersDeactivated
-		stats[i].EphemeralHandlersActivated -= stats[i+1].EphemeralHandlersActivated
+		stats[i].EphemeralHandlersActivated = relativeCounter(stats[i].EphemeralHandlersActivated, stats[i+1].EphemeralHandlersActivated)
 
-		stats[i].EventsEnqueued -= stats[i+1].EventsEnqueued
+		// For Events, Enqueued is 'new events', and what was enqueued but not yet dequeued is pending
+		stats[i].EventsPending = stats[i].EventsEnqueued - stats[i].EventsDequeued
+		stats[i].EventsEnqueued = relativeCounter(stats[i].EventsEnqueued, stats[i+1].EventsEnqueued)
 		stats[i].EventsDequeued = 0
 
-		stats[i].EventsRouted -= stats[i+1].EventsRouted
+		stats[i].EventsRouted = relativeCounter(stats[i].EventsRouted, stats[i+1].EventsRouted)
 
 		if stats[i+1].Databases == nil {
 			stats[i+1].Databases = make(map[string]StatsDatabase)
@@ -495,13 +1407,13 @@ func ConvertStatsFromAbsoluteToRelative(stats []StatsStat, bucketSecs int64) (ou
 		for k, vcur := range stats[i].Databases {
 			vprev, present := stats[i+1].Databases[k]
 			if present {
-				vcur.Reads -= vprev.Reads
-				vcur.ReadMs -= vprev.ReadMs
+				vcur.Reads = relativeCounter(vcur.Reads, vprev.Reads)
+				vcur.ReadMs = relativeCounter(vcur.ReadMs, vprev.ReadMs)
 				if vcur.Reads > 0 {
 					vcur.ReadMs = vcur.ReadMs / vcur.Reads
 				}
-				vcur.Writes -= vprev.Writes
-				vcur.WriteMs -= vprev.WriteMs
+				vcur.Writes = relativeCounter(vcur.Writes, vprev.Writes)
+				vcur.WriteMs = relativeCounter(vcur.WriteMs, vprev.WriteMs)
 				if vcur.Writes > 0 {
 					vcur.WriteMs = vcur.WriteMs / vcur.Writes
 				}
@@ -515,7 +1427,10 @@ func ConvertStatsFromAbsoluteToRelative(stats []StatsStat, bucketSecs int64) (ou
 		for k, vcur := range stats[i].Caches {
 			vprev, present := stats[i+1].Caches[k]
 			if present {
-				vcur.Invalidations -= vprev.Invalidations
+				vcur.Invalidations = relativeCounter(vcur.Invalidations, vprev.Invalidations)
+				vcur.Hits = relativeCounter(vcur.Hits, vprev.Hits)
+				vcur.Misses = relativeCounter(vcur.Misses, vprev.Misses)
+				vcur.EntriesHWM, vcur.Resets = cacheBucketHWM(vcur, vprev)
 				stats[i].Caches[k] = vcur
 			}
 		}
@@ -526,7 +1441,7 @@ func ConvertStatsFromAbsoluteToRelative(stats []StatsStat, bucketSecs int64) (ou
 		for k, vcur := range stats[i].API {
 			vprev, present := stats[i+1].API[k]
 			if present {
-				vcur -= vprev
+				vcur = relativeCounter(vcur, vprev)
 				stats[i].API[k] = vcur
 			}
 		}
@@ -537,7 +1452,7 @@ func ConvertStatsFromAbsoluteToRelative(stats []StatsStat, bucketSecs int64) (ou
 		for k, vcur := range stats[i].Fatals {
 			vprev, present := stats[i+1].Fatals[k]
 			if present {
-				vcur -= vprev
+				vcur = relativeCounter(vcur, vprev)
 				stats[i].Fatals[k] = vcur
 			}
 		}
@@ -548,8 +1463,25 @@ func ConvertStatsFromAbsoluteToRelative(stats []StatsStat, bucketSecs int64) (ou
 
 }
 
+// Compute the relative value of a counter between two buckets, treating a counter
+// that has gone backward (because it was reset) as having had no activity.
+func relativeCounter(cur int64, next int64) int64 {
+	if next > cur {
+		return 0
+	}
+	return cur - next
+}
+
+// Compute the relative value of an unsigned counter between two buckets
+func relativeCounterU(cur uint64, next uint64) uint64 {
+	if next > cur {
+		return 0
+	}
+	return cur - next
+}
+
 // Retrieve a sample of data from the specified host, returning a vector of available stats indexed by SIID
-func watcherGetStats(hostname string, hostaddr string) (serviceVersionChanged bool, ss serviceSummary, handlers map[string]AppHandler, stats map[string][]StatsStat, err error) {
+func watcherGetStats(hostname string, hostaddr string, warnWhenPendingEventsPerHandlerExceed int64) (serviceVersionChanged bool, ss serviceSummary, handlers map[string]AppHandler, stats map[string][]StatsStat, err error) {
 
 	if watcherTrace {
 		fmt.Printf("watcherGetStats: fetching stats for %s\n", hostaddr)
@@ -565,24 +1497,42 @@ func watcherGetStats(hostname string, hostaddr string) (serviceVersionChanged bo
 		return
 	}
 
-	// Iterate over each service instance, gathering its stats
+	// Track the success of each of the pings below, checking the error rates when done
+	defer pingCheckErrorRates(hostname, ss.ServiceInstanceIDs)
+
+	// Iterate over each service instance, gathering its stats, abandoning the request in
+	// progress if we're shutting down
+	ctx := shutdownContext
+	pendingMessage := ""
+	mismatched := []string{}
+	matched := 0
+	var unreachable error
 	for i, siid := range ss.ServiceInstanceIDs {
 
-		// Get the info
-		var pb PingBody
-		pb, err = getServiceInstanceInfo(ss.ServiceInstanceAddrs[i], siid, "", "lb")
-		if err != nil {
-			return
+		// Get the info.  Once an instance is unreachable the stats are unusable, but we continue
+		// to ping the rest so that each instance's error rate reflects every poll.
+		pb, err2 := getServiceInstanceInfo(ctx, ss.ServiceInstanceAddrs[i], siid, "", "lb")
+		pingRecordResult(siid, err2 == nil)
+		if err2 != nil {
+			if unreachable == nil {
+				unreachable = fmt.Errorf("%s: %w: %s", siid, errInstanceUnreachable, err2)
+			}
+			continue
+		}
+		if unreachable != nil {
+			continue
 		}
 
 		// Update the handler with info only contained in the ping body
 		h := handlers[siid]
-		if pb.Body.LegacyServiceVersion != 0 {
-			h.NodeStarted = pb.Body.LegacyServiceVersion
+		if started := nodeStartedTime(siid, pb.Body.NodeStarted, pb.Body.LegacyServiceVersion); started != 0 {
+			h.NodeStarted = started
 		}
-		if pb.Body.NodeStarted != "" {
-			started, _ := time.Parse("2006-01-02T15:04:05Z", pb.Body.NodeStarted)
-			h.NodeStarted = started.Unix()
+		if h.NodeStarted != 0 {
+			if ss.InstanceStarted == nil {
+				ss.InstanceStarted = map[string]int64{}
+			}
+			ss.InstanceStarted[siid] = h.NodeStarted
 		}
 
 		// Sanity check for format of stats
@@ -591,10 +1541,15 @@ func watcherGetStats(hostname string, hostaddr string) (serviceVersionChanged bo
 			continue
 		}
 		sistats := *pb.Body.LBStatus
+
+		// During a rolling deploy instances legitimately disagree about the service version, so
+		// rather than failing we set aside those not on the host's version
 		if pb.Body.ServiceVersion != ss.ServiceVersion {
-			err = fmt.Errorf("%s: node service version is incorrect: %s", siid, pb.Body.ServiceVersion)
-			return
+			fmt.Printf("%s: %s: %s rather than %s\n", hostname, siid, pb.Body.ServiceVersion, ss.ServiceVersion)
+			mismatched = append(mismatched, siid+" "+pb.Body.ServiceVersion)
+			continue
 		}
+		matched++
 
 		// Update service summary
 		ss.BucketSecs = sistats[0].BucketMins * 60
@@ -602,6 +1557,15 @@ func watcherGetStats(hostname string, hostaddr string) (serviceVersionChanged bo
 		ss.NotificationHandlers += sistats[0].NotificationHandlersActivated - sistats[0].NotificationHandlersDeactivated
 		ss.EphemeralHandlers += sistats[0].EphemeralHandlersActivated - sistats[0].EphemeralHandlersDeactivated
 		ss.DiscoveryHandlers += sistats[0].DiscoveryHandlersActivated - sistats[0].DiscoveryHandlersDeactivated
+		if ss.InstanceDiscoveryHandlers == nil {
+			ss.InstanceDiscoveryHandlers = map[string]int64{}
+		}
+		ss.InstanceDiscoveryHandlers[siid] = sistats[0].DiscoveryHandlersActivated - sistats[0].DiscoveryHandlersDeactivated
+
+		// Note instances whose backlog is high relative to the handlers working it off
+		if pending, active, exceeded := pendingEventsExceeded(sistats[0], warnWhenPendingEventsPerHandlerExceed); exceeded {
+			pendingMessage += fmt.Sprintf("    %s %d pending for %d handlers\n", siid, pending, active)
+		}
 
 		// If the server hasn't been up long enough to have stats.  Note that [0] is the
 		// current stats, and we need at least two more to compute relative stats.
@@ -610,21 +1574,162 @@ func watcherGetStats(hostname string, hostaddr string) (serviceVersionChanged bo
 			continue
 		}
 
-		// Extract all available stats, and convert them from absolute to per-bucket relative.
+		// Extract all available stats, and convert them from absolute to per-bucket relative,
+		// recording the instance's boot time with each so that restarts can be counted later
 		stats[siid] = ConvertStatsFromAbsoluteToRelative(sistats[1:], ss.BucketSecs)
+		for j := range stats[siid] {
+			stats[siid][j].NodeStarted = h.NodeStarted
+		}
 
 		// Now that we have valid stats, include the handler
 		handlers[siid] = h
 
 	}
+	if unreachable != nil {
+		err = unreachable
+		return
+	}
+
+	// Warn when instances first become backlogged
+	serviceLock.Lock()
+	pendingWarning, pendingInfo := uPendingEventsWarning(hostname, warnWhenPendingEventsPerHandlerExceed, pendingMessage, time.Now())
+	uCheckBucketMins(hostname, ss.BucketSecs/60)
+	uCheckVersionMismatch(hostname, ss.ServiceVersion, mismatched)
+	serviceLock.Unlock()
+	if pendingWarning != "" {
+		slackSendAlert(pendingWarning)
+	}
+	if pendingInfo != "" {
+		slackSendMessage(pendingInfo)
+	}
+
+	// If no instance is on the host's version, it's the host's version that's out of date
+	if matched == 0 && len(mismatched) > 0 {
+		err = fmt.Errorf("%s: %w: %s", hostname, errVersionMismatch, strings.Join(mismatched, ", "))
+	}
 
 	// Done
 	return
 
 }
 
+// Response to the activity command
+type activityResponse struct {
+	Host           string                 `json:"host,omitempty"`
+	Instances      int64                  `json:"instances"`
+	SessionsActive int64                  `json:"sessions_active"`
+	EventsPending  int64                  `json:"events_pending"`
+	Nodes          []activityNodeResponse `json:"nodes,omitempty"`
+	Error          string                 `json:"error,omitempty"`
+}
+
+// A single busy service instance within the activity command's response
+type activityNodeResponse struct {
+	NodeID   string `json:"node_id,omitempty"`
+	NodeName string `json:"node_name,omitempty"`
+	NodeTags string `json:"node_tags,omitempty"`
+	Sessions int64  `json:"sessions"`
+	Events   int64  `json:"events"`
+}
+
 // Show activity about the host
-func watcherActivity(hostname string) (response string) {
+func watcherActivity(hostname string, asJSON bool) (response string) {
+
+	r := watcherGetActivity(hostname)
+
+	// Send it as a slack message to all, rather than a response, because it times out for prod
+	if asJSON {
+		slackPostMessage(Config.SlackWebhookURL, slackJSONCodeBlock(slackJSONResponse(r)))
+		return ""
+	}
+	if r.Error != "" {
+		return r.Error
+	}
+
+	pendingMessage := activityTable(r.Nodes)
+
+	message := fmt.Sprintf("%s has %d instances hosting %d active sessions with %d events waiting to be processed\n",
+		hostname, r.Instances, r.SessionsActive, r.EventsPending)
+	if len(pendingMessage) > 0 {
+		message += "```"
+		message += pendingMessage
+		message += "```"
+	}
+	slackPostMessage(Config.SlackWebhookURL, message)
+	return ""
+
+}
+
+// Text removed from node IDs and from node tags in the activity command when not configured
+var activityNodeIDRemovalsDefault = []string{":" + DcServiceNameNotehandlerTCP}
+var activityTagRemovalsDefault = []string{"_igress"}
+
+// Remove each of the configured strings (or the defaults if none are configured) from a column's text
+func activityTrim(s string, removals []string, removalsDefault []string) string {
+	if len(removals) == 0 {
+		removals = removalsDefault
+	}
+	for _, r := range removals {
+		s = strings.ReplaceAll(s, r, "")
+	}
+	return s
+}
+
+// Format the busy nodes as a table whose columns are as wide as their widest value, so that
+// it stays aligned regardless of the lengths of names, truncating any text beyond the configured
+// maximum column width
+func activityTable(nodes []activityNodeResponse) (table string) {
+
+	rows := [][]string{}
+	for _, n := range nodes {
+		sessions := ""
+		if n.Sessions != 0 {
+			sessions = fmt.Sprintf("%d", n.Sessions)
+		}
+		events := ""
+		if n.Events > 0 {
+			events = fmt.Sprintf("%d", n.Events)
+		}
+		rows = append(rows, []string{activityTrim(n.NodeID, Config.ActivityNodeIDRemovals, activityNodeIDRemovalsDefault),
+			n.NodeName, n.NodeTags, sessions, events})
+	}
+
+	// Compute the widths
+	widths := make([]int, 5)
+	for _, row := range rows {
+		for i := range row {
+			if Config.ActivityColumnMaxWidth > 0 && len(row[i]) > Config.ActivityColumnMaxWidth {
+				row[i] = row[i][:Config.ActivityColumnMaxWidth]
+			}
+			if len(row[i]) > widths[i] {
+				widths[i] = len(row[i])
+			}
+		}
+	}
+
+	// Text is left-aligned and counts are right-aligned, with their units omitted when there are none
+	for _, row := range rows {
+		line := fmt.Sprintf("%-*s %-*s %-*s", widths[0], row[0], widths[1], row[1], widths[2], row[2])
+		if widths[3] > 0 {
+			if row[3] == "" {
+				line += fmt.Sprintf(" %*s%9s", widths[3], "", "")
+			} else {
+				line += fmt.Sprintf(" %*s sessions", widths[3], row[3])
+			}
+		}
+		if row[4] != "" {
+			line += fmt.Sprintf(" %*s events", widths[4], row[4])
+		}
+		table += strings.TrimRight(line, " ") + "\n"
+	}
+
+	return
+
+}
+
+// Get the activity on the host
+func watcherGetActivity(hostname string) (r activityResponse) {
+	r.Host = hostname
 
 	// Map name to address
 	hostaddr := ""
@@ -637,30 +1742,29 @@ func watcherActivity(hostname string) (response string) {
 		}
 	}
 	if hostaddr == "" {
-		return "host not found"
+		r.Error = "host not found"
+		return
 	}
 
 	// Get the list of handlers on the host
-	_, _, serviceInstanceIDs, serviceInstanceAddrs, handlers, err := watcherGetServiceInstances(hostname, hostaddr)
+	_, serviceInstanceIDs, serviceInstanceAddrs, handlers, err := watcherGetServiceInstancesCached(hostname, hostaddr)
 	if err != nil {
-		return err.Error()
+		r.Error = err.Error()
+		return
 	}
 	if len(serviceInstanceAddrs) == 0 {
-		return "no instances found for host"
+		r.Error = "no instances found for host"
+		return
 	}
 
 	// Grab the activity from all the handlers
-	instances := int64(0)
-	sessionsActive := int64(0)
-	eventsPending := int64(0)
-	pendingMessage := ""
 	for i, addr := range serviceInstanceAddrs {
 
 		// Get the handler
 		h := handlers[serviceInstanceIDs[i]]
 
 		// Get the info from the service instance
-		pb, err := getServiceInstanceInfo(addr, serviceInstanceIDs[i], "", "lb")
+		pb, err := getServiceInstanceInfo(shutdownContext, addr, serviceInstanceIDs[i], "", "lb")
 		if err != nil {
 			fmt.Printf("getServiceInstanceInfo(%s, %s): %s\n", addr, serviceInstanceIDs[i], err)
 			continue
@@ -669,51 +1773,189 @@ func watcherActivity(hostname string) (response string) {
 			fmt.Printf("no lb info for (%s, %s)\n", addr, serviceInstanceIDs[i])
 			continue
 		}
-		instances++
+		r.Instances++
 		sistats := *pb.Body.LBStatus
 		sessions := sistats[0].ContinuousHandlersActivated - sistats[0].ContinuousHandlersDeactivated
 		sessions += sistats[0].EphemeralHandlersActivated - sistats[0].EphemeralHandlersDeactivated
 		events := sistats[0].EventsEnqueued - sistats[0].EventsDequeued
-		sessionsActive += sessions
-		eventsPending += events
+		r.SessionsActive += sessions
+		r.EventsPending += events
 		if sessions > 0 || events > 0 {
-			handlerTags := strings.Join(h.NodeTags, " ")
-			handlerTags = strings.ReplaceAll(handlerTags, "_igress", "")
-			handlerID := fmt.Sprintf("%s %s %-7s", strings.TrimSuffix(serviceInstanceIDs[i], ":notehandler-tcp"), h.NodeName, handlerTags)
-			pendingMessage += handlerID + " "
-			if sessions == 0 {
-				pendingMessage += "               "
-			} else {
-				pendingMessage += fmt.Sprintf("%5d sessions ", sessions)
-			}
-			if events > 0 {
-				pendingMessage += fmt.Sprintf("%3d events ", events)
-			}
-			pendingMessage += "\n"
+			handlerTags := activityTrim(strings.Join(h.NodeTags, " "), Config.ActivityTagRemovals, activityTagRemovalsDefault)
+			r.Nodes = append(r.Nodes, activityNodeResponse{
+				NodeID:   serviceInstanceIDs[i],
+				NodeName: h.NodeName,
+				NodeTags: handlerTags,
+				Sessions: sessions,
+				Events:   events,
+			})
 		}
 	}
 
-	// Send it as a slack message to all, rather than a response, because it times out for prod
-	message := fmt.Sprintf("%s has %d instances hosting %d active sessions with %d events waiting to be processed\n",
-		hostname, instances, sessionsActive, eventsPending)
-	if len(pendingMessage) > 0 {
-		message += "```"
-		message += pendingMessage
-		message += "```"
+	return
+
+}
+
+// Number of buckets shown by the activity trend
+const activityTrendBuckets = 48
+
+// Characters used to render the sparkline, from no events pending to the most pending
+const activityTrendSparks = "_.:-=+*#%@"
+
+// Response to the activity trend command
+type activityTrendResponse struct {
+	Host       string                      `json:"host,omitempty"`
+	Time       int64                       `json:"time,omitempty"`
+	BucketSecs int64                       `json:"bucket_secs,omitempty"`
+	Pending    []int64                     `json:"pending,omitempty"`
+	Nodes      []activityTrendNodeResponse `json:"nodes,omitempty"`
+	Error      string                      `json:"error,omitempty"`
+}
+
+// The pending events trend of a single service instance, oldest bucket first
+type activityTrendNodeResponse struct {
+	NodeID  string  `json:"node_id,omitempty"`
+	Pending []int64 `json:"pending,omitempty"`
+}
+
+// Show the trend of pending events on the host as a sparkline
+func watcherActivityTrend(hostname string) (response string) {
+
+	r := watcherGetActivityTrend(hostname)
+	if r.Error != "" {
+		return r.Error
 	}
-	slackSendMessage(message)
-	return ""
 
+	response = fmt.Sprintf("%s events pending over %d %d-minute buckets ending %s\n", hostname,
+		len(r.Pending), r.BucketSecs/60, time.Unix(r.Time, 0).UTC().Format("01-02 15:04:05"))
+	response += "```"
+	response += watcherSparkline("total", r.Pending)
+	for _, n := range r.Nodes {
+		response += watcherSparkline(n.NodeID, n.Pending)
+	}
+	response += "```"
+	return
+
+}
+
+// Render a labeled sparkline scaled to its own maximum, with the range and latest value
+func watcherSparkline(label string, values []int64) (line string) {
+	var min, max int64
+	for i, v := range values {
+		if i == 0 || v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	steps := int64(len(activityTrendSparks) - 1)
+	for _, v := range values {
+		i := int64(0)
+		if v > 0 && max > 0 {
+			i = (v*steps + max - 1) / max
+		}
+		line += string(activityTrendSparks[i])
+	}
+	latest := int64(0)
+	if len(values) > 0 {
+		latest = values[len(values)-1]
+	}
+	return fmt.Sprintf("%-12s %s min:%d max:%d now:%d\n", label, line, min, max, latest)
+}
+
+// Get the trend of pending events on the host from the in-memory stats
+func watcherGetActivityTrend(hostname string) (r activityTrendResponse) {
+	r.Host = hostname
+
+	hs, exists := statsExtract(hostname, 0, 0)
+	if !exists {
+		r.Error = "no stats loaded for host"
+		return
+	}
+	if hs.BucketMins == 0 {
+		r.Error = "no stats buckets for host"
+		return
+	}
+	r.Time = hs.Time
+	r.BucketSecs = hs.BucketMins * 60
+
+	// Order the instances for a stable display
+	siids := make([]string, 0, len(hs.Stats))
+	for siid := range hs.Stats {
+		siids = append(siids, siid)
+	}
+	sort.Strings(siids)
+
+	// Gather the pending events by bucket, oldest first
+	r.Pending = make([]int64, activityTrendBuckets)
+	for _, siid := range siids {
+		pendingByTime := map[int64]int64{}
+		for _, stat := range hs.Stats[siid] {
+			pendingByTime[stat.SnapshotTaken] = stat.EventsPending
+		}
+		n := activityTrendNodeResponse{NodeID: strings.TrimSuffix(siid, ":notehandler-tcp")}
+		n.Pending = make([]int64, activityTrendBuckets)
+		for i := range n.Pending {
+			t := r.Time - int64(activityTrendBuckets-1-i)*r.BucketSecs
+			n.Pending[i] = pendingByTime[t]
+			r.Pending[i] += n.Pending[i]
+		}
+		r.Nodes = append(r.Nodes, n)
+	}
+
+	return
+
+}
+
+// Response to the request command
+type requestResponse struct {
+	Host        string `json:"host,omitempty"`
+	Request     string `json:"request,omitempty"`
+	ServiceType string `json:"service_type,omitempty"`
+	Matched     int64  `json:"matched"`
+	Instances   int64  `json:"instances"`
+	Error       string `json:"error,omitempty"`
 }
 
+// The service types to which a request may be limited
+var requestServiceTypes = []string{DcServiceNameNotehandlerTCP, DcServiceNameNoteDiscovery, DcServiceNameNoteboard}
+
 // Tell the instance to process a request
-func watcherSendRequest(hostname string, request string) (response string) {
+func watcherSendRequest(hostname string, request string, serviceType string) (response string) {
+	r := watcherGetSendRequest(hostname, request, serviceType)
+	if r.Error != "" {
+		return r.Error
+	}
+	if serviceType != "" {
+		return fmt.Sprintf("sent request to %d of %d %s instances on %s\n", r.Instances, r.Matched, serviceType, hostname)
+	}
+	return fmt.Sprintf("sent request to %d instances on %s\n", r.Instances, hostname)
+}
+
+// Tell the instance to process a request, returning structured results
+func watcherGetSendRequest(hostname string, request string, serviceType string) (r requestResponse) {
 
 	// Unquote if quoted
 	s, err := strconv.Unquote(request)
 	if err == nil {
 		request = s
 	}
+	r.Host = hostname
+	r.Request = request
+	r.ServiceType = serviceType
+
+	// Validate the service type, if only sending to one
+	if serviceType != "" {
+		valid := false
+		for _, t := range requestServiceTypes {
+			valid = valid || serviceType == t
+		}
+		if !valid {
+			r.Error = fmt.Sprintf("service type must be one of %s", strings.Join(requestServiceTypes, ", "))
+			return
+		}
+	}
 
 	// Map name to address
 	hostaddr := ""
@@ -726,29 +1968,793 @@ func watcherSendRequest(hostname string, request string) (response string) {
 		}
 	}
 	if hostaddr == "" {
-		return "host not found"
+		r.Error = "host not found"
+		return
 	}
 
 	// Get the list of handlers on the host
-	_, _, serviceInstanceIDs, serviceInstanceAddrs, _, err := watcherGetServiceInstances(hostname, hostaddr)
+	_, serviceInstanceIDs, serviceInstanceAddrs, _, err := watcherGetServiceInstancesCached(hostname, hostaddr)
 	if err != nil {
-		return err.Error()
+		r.Error = err.Error()
+		return
 	}
 	if len(serviceInstanceAddrs) == 0 {
-		return "no instances found for host"
+		r.Error = "no instances found for host"
+		return
 	}
 
-	// Grab the activity from all the handlers
-	instances := int64(0)
+	// Send the request to all the handlers of the service type, which is the suffix of the SIID
 	for i, addr := range serviceInstanceAddrs {
-		_, err := getServiceInstanceInfo(addr, serviceInstanceIDs[i], request, "")
+		if serviceType != "" && !strings.HasSuffix(serviceInstanceIDs[i], ":"+serviceType) {
+			continue
+		}
+		r.Matched++
+		_, err := getServiceInstanceInfo(shutdownContext, addr, serviceInstanceIDs[i], request, "")
 		if err != nil {
 			fmt.Printf("getServiceInstanceInfo(%s, %s): %s\n", addr, serviceInstanceIDs[i], err)
 			continue
 		}
-		instances++
+		r.Instances++
 	}
 
-	return fmt.Sprintf("sent request to %d instances on %s\n", instances, hostname)
+	return
+
+}
+
+// Maximum number of devices shown by the top command
+const topDevicesMax = 20
+
+// Response to the top command
+type topResponse struct {
+	Host    string              `json:"host,omitempty"`
+	Time    int64               `json:"time,omitempty"`
+	Devices []topDeviceResponse `json:"devices,omitempty"`
+	Error   string              `json:"error,omitempty"`
+}
+
+// A single device within the top command's response
+type topDeviceResponse struct {
+	DeviceUID      string `json:"device,omitempty"`
+	AppUID         string `json:"app,omitempty"`
+	EventsEnqueued int64  `json:"events_enqueued"`
+	EventsRouted   int64  `json:"events_routed"`
+}
+
+// Show the devices generating the most events on the host
+func watcherTop(hostname string) (response string) {
+
+	r := watcherGetTop(hostname)
+	if r.Error != "" {
+		return r.Error
+	}
+	if len(r.Devices) == 0 {
+		return "no device events in the most recent bucket"
+	}
+
+	response = fmt.Sprintf("top devices on %s by events received in bucket ending %s\n",
+		hostname, time.Unix(r.Time, 0).UTC().Format("01-02 15:04:05"))
+	response += "```"
+	for i, d := range r.Devices {
+		response += fmt.Sprintf("%2d %6d queued %6d routed %s %s\n", i+1, d.EventsEnqueued, d.EventsRouted, d.DeviceUID, d.AppUID)
+	}
+	response += "```"
+	return
+
+}
+
+// Get the devices generating the most events on the host in the most recent bucket
+func watcherGetTop(hostname string) (r topResponse) {
+	r.Host = hostname
+
+	hs, exists := statsExtract(hostname, 0, 0)
+	if !exists {
+		r.Error = "no stats loaded for host"
+		return
+	}
+	r.Time = hs.Time
+
+	// Aggregate the devices across instances
+	devices := map[string]topDeviceResponse{}
+	for _, sis := range hs.Stats {
+		if len(sis) == 0 || sis[0].SnapshotTaken != hs.Time {
+			continue
+		}
+		for _, h := range sis[0].Handlers {
+			if h.DeviceUID == "" {
+				continue
+			}
+			d := devices[h.DeviceUID]
+			d.DeviceUID = h.DeviceUID
+			if h.AppUID != "" {
+				d.AppUID = h.AppUID
+			}
+			d.EventsEnqueued += h.EventsEnqueued
+			d.EventsRouted += h.EventsRouted
+			devices[h.DeviceUID] = d
+		}
+	}
+
+	// Rank them
+	for _, d := range devices {
+		r.Devices = append(r.Devices, d)
+	}
+	sort.Slice(r.Devices, func(i, j int) bool {
+		if r.Devices[i].EventsEnqueued != r.Devices[j].EventsEnqueued {
+			return r.Devices[i].EventsEnqueued > r.Devices[j].EventsEnqueued
+		}
+		return r.Devices[i].DeviceUID < r.Devices[j].DeviceUID
+	})
+	if len(r.Devices) > topDevicesMax {
+		r.Devices = r.Devices[:topDevicesMax]
+	}
+
+	return
+
+}
+
+// Response to the dump command
+type dumpResponse struct {
+	Host     string `json:"host,omitempty"`
+	NodeID   string `json:"node_id,omitempty"`
+	Entries  int    `json:"entries"`
+	Filename string `json:"filename,omitempty"`
+	URL      string `json:"url,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// The contents of a dump file, which are exactly the instance's in-memory stats
+type dumpFile struct {
+	Host           string      `json:"host,omitempty"`
+	NodeID         string      `json:"node_id,omitempty"`
+	ServiceVersion string      `json:"service_version,omitempty"`
+	Exported       int64       `json:"exported,omitempty"`
+	BucketSecs     int64       `json:"bucket_secs,omitempty"`
+	Stats          []StatsStat `json:"stats,omitempty"`
+}
+
+// Export the in-memory stats of a single service instance for download, formatted as text
+func watcherDump(hostname string, nodeID string) (response string) {
+	r := watcherGetDump(hostname, nodeID)
+	if r.Error != "" {
+		return r.Error
+	}
+	return fmt.Sprintf("%d buckets of %s stats: <%s|%s>\n", r.Entries, r.NodeID, r.URL, r.Filename)
+}
+
+// Export the in-memory stats of a single service instance, identified either by its
+// SIID or by its NodeID if that is unambiguous, to a file that may be downloaded
+func watcherGetDump(hostname string, nodeID string) (r dumpResponse) {
+	r.Host = hostname
+
+	if nodeID == "" {
+		r.Error = "/notehub <host> dump <nodeid>"
+		return
+	}
+
+	statsLock.Lock()
+	if !uStatsLoaded(hostname) {
+		statsLock.Unlock()
+		r.Error = "no stats loaded for host"
+		return
+	}
+	hs, _ := uStatsExtract(hostname, 0, 0)
+	siids := make([]string, 0, len(hs.Stats))
+	for siid := range hs.Stats {
+		siids = append(siids, siid)
+	}
+	siid, err := watcherMatchNodeID(nodeID, siids)
+	if err != nil {
+		statsLock.Unlock()
+		r.Error = fmt.Sprintf("%s on %s", err, hostname)
+		return
+	}
+	r.NodeID = siid
+	d := dumpFile{
+		Host:           hostname,
+		NodeID:         r.NodeID,
+		ServiceVersion: statsServiceVersions[hostname],
+		Exported:       time.Now().UTC().Unix(),
+		BucketSecs:     hs.BucketMins * 60,
+		Stats:          hs.Stats[r.NodeID],
+	}
+	r.Entries = len(d.Stats)
+	contents, err := json.MarshalIndent(d, "", "    ")
+	statsLock.Unlock()
+	if err != nil {
+		r.Error = err.Error()
+		return
+	}
+
+	r.Filename, err = sheetSaveFile("dump-"+hostname+"-"+r.NodeID, jsonType, contents)
+	if err != nil {
+		r.Error = err.Error()
+		return
+	}
+	r.URL = Config.HostURL + sheetRoute + r.Filename
+	return
+
+}
+
+// Number of databases shown by the dbgrowth command
+const dbGrowthDatabasesMax = 10
+
+// Response to the dbgrowth command
+type dbGrowthResponse struct {
+	Host      string             `json:"host,omitempty"`
+	Window    string             `json:"window,omitempty"`
+	Begin     int64              `json:"begin,omitempty"`
+	End       int64              `json:"end,omitempty"`
+	Databases []dbGrowthDatabase `json:"databases,omitempty"`
+	Error     string             `json:"error,omitempty"`
+}
+
+// The queries (reads plus writes) of a single database in the earlier and later halves of the window
+type dbGrowthDatabase struct {
+	Database  string   `json:"database,omitempty"`
+	Before    int64    `json:"before"`
+	After     int64    `json:"after"`
+	Growth    int64    `json:"growth"`
+	GrowthPct *float64 `json:"growth_pct,omitempty"`
+}
+
+// Show the databases whose query volume grew the most within a recent window
+func watcherDBGrowth(hostname string, window string) (response string) {
+
+	r := watcherGetDBGrowth(hostname, window)
+	if r.Error != "" {
+		return r.Error
+	}
+	if len(r.Databases) == 0 {
+		return fmt.Sprintf("no database queries grew on %s in the last %s", hostname, r.Window)
+	}
+
+	response = fmt.Sprintf("%s databases with the fastest-growing queries, %s to %s (first half vs second half)\n", hostname,
+		time.Unix(r.Begin, 0).UTC().Format("01-02 15:04"), time.Unix(r.End, 0).UTC().Format("01-02 15:04"))
+	response += "```"
+	for _, db := range r.Databases {
+		pct := "new"
+		if db.GrowthPct != nil {
+			pct = fmt.Sprintf("%+.0f%%", *db.GrowthPct)
+		}
+		response += fmt.Sprintf("%10d %10d %+10d %7s %s\n", db.Before, db.After, db.Growth, pct, db.Database)
+	}
+	response += "```"
+	return
+
+}
+
+// Get the databases whose query volume grew the most within a recent window, comparing the
+// reads and writes in the earlier half of the window's buckets against those in the later half
+func watcherGetDBGrowth(hostname string, window string) (r dbGrowthResponse) {
+	r.Host = hostname
+
+	// Parse the window
+	duration, err := time.ParseDuration(window)
+	if err != nil || duration <= 0 {
+		r.Error = "/notehub <host> dbgrowth <duration> (such as 6h or 24h)"
+		return
+	}
+	r.Window = duration.String()
+
+	hs, exists := statsExtract(hostname, 0, 0)
+	if !exists {
+		r.Error = "no stats loaded for host"
+		return
+	}
+
+	// Gather the aggregated buckets within the window, oldest first
+	since := hs.Time - int64(duration.Seconds())
+	buckets := []AggregatedStat{}
+	for _, as := range statsAggregate(hs.Stats, hs.BucketMins*60) {
+		if as.Time > since {
+			buckets = append(buckets, as)
+		}
+	}
+	sort.Sort(statOccurrence(buckets))
+	if len(buckets) < 2 {
+		r.Error = fmt.Sprintf("not enough stats on %s within %s", hostname, r.Window)
+		return
+	}
+	r.Begin = buckets[0].Time
+	r.End = buckets[len(buckets)-1].Time
+
+	// Compare the halves
+	half := len(buckets) / 2
+	before := map[string]int64{}
+	after := map[string]int64{}
+	for i, as := range buckets {
+		for name, db := range as.Databases {
+			if i < half {
+				before[name] += db.Reads + db.Writes
+			} else if i >= len(buckets)-half {
+				after[name] += db.Reads + db.Writes
+			}
+		}
+	}
+	for name, count := range after {
+		g := dbGrowthDatabase{Database: name, Before: before[name], After: count, Growth: count - before[name]}
+		if g.Growth <= 0 {
+			continue
+		}
+		if g.Before > 0 {
+			pct := float64(g.Growth) * 100 / float64(g.Before)
+			g.GrowthPct = &pct
+		}
+		r.Databases = append(r.Databases, g)
+	}
+
+	// Rank them
+	sort.Slice(r.Databases, func(i, j int) bool {
+		if r.Databases[i].Growth != r.Databases[j].Growth {
+			return r.Databases[i].Growth > r.Databases[j].Growth
+		}
+		return r.Databases[i].Database < r.Databases[j].Database
+	})
+	if len(r.Databases) > dbGrowthDatabasesMax {
+		r.Databases = r.Databases[:dbGrowthDatabasesMax]
+	}
+
+	return
+
+}
+
+// Find the service instance identified either by its SIID or by its NodeID if that is unambiguous
+func watcherMatchNodeID(nodeID string, siids []string) (siid string, err error) {
+	matches := []string{}
+	for _, s := range siids {
+		if s == nodeID {
+			return s, nil
+		}
+		if strings.HasPrefix(s, nodeID+":") {
+			matches = append(matches, s)
+		}
+	}
+	if len(matches) == 0 {
+		err = fmt.Errorf("no instance %s", nodeID)
+		return
+	}
+	if len(matches) > 1 {
+		sort.Strings(matches)
+		err = fmt.Errorf("%s is ambiguous: %s", nodeID, strings.Join(matches, ", "))
+		return
+	}
+	return matches[0], nil
+}
+
+// The header line beginning each goroutine's stack within a goroutine dump, as opposed to the
+// mentions of goroutines within stacks such as "created by ... in goroutine 1"
+var goroutineHeaderPattern = regexp.MustCompile(`(?m)^goroutine \d+ \[`)
+
+// Count the goroutines within a goroutine dump
+func countGoroutines(status string) int {
+	return len(goroutineHeaderPattern.FindAllStringIndex(status, -1))
+}
+
+// Save the full goroutine status of a single service instance for download, formatted as text
+func watcherDumpRoutines(hostname string, nodeID string) (response string) {
+	r := watcherGetDumpRoutines(hostname, nodeID)
+	if r.Error != "" {
+		return r.Error
+	}
+	return fmt.Sprintf("%d goroutines on %s: <%s|%s>\n", r.Entries, r.NodeID, r.URL, r.Filename)
+}
+
+// Save the full goroutine status of a single service instance, identified either by its SIID
+// or by its NodeID if that is unambiguous, to a file that may be downloaded, because it is
+// far too long to be shown in Slack
+func watcherGetDumpRoutines(hostname string, nodeID string) (r dumpResponse) {
+	r.Host = hostname
+
+	if nodeID == "" {
+		r.Error = "/notehub <host> dumproutines <nodeid>"
+		return
+	}
+
+	// Find the host
+	hostaddr := ""
+	for _, v := range Config.MonitoredHosts {
+		if !v.Disabled && hostname == v.Name {
+			hostaddr = v.Addr
+			break
+		}
+	}
+	if hostaddr == "" {
+		r.Error = "host not found"
+		return
+	}
+
+	// Find the instance
+	_, serviceInstanceIDs, serviceInstanceAddrs, _, err := watcherGetServiceInstancesCached(hostname, hostaddr)
+	if err != nil {
+		r.Error = err.Error()
+		return
+	}
+	r.NodeID, err = watcherMatchNodeID(nodeID, serviceInstanceIDs)
+	if err != nil {
+		r.Error = fmt.Sprintf("%s on %s", err, hostname)
+		return
+	}
+	addr := ""
+	for i, siid := range serviceInstanceIDs {
+		if siid == r.NodeID {
+			addr = serviceInstanceAddrs[i]
+		}
+	}
+
+	// Get the goroutines and save them
+	pb, err := getServiceInstanceInfo(shutdownContext, addr, r.NodeID, "", "goroutines")
+	if err != nil {
+		r.Error = err.Error()
+		return
+	}
+	if pb.Body.GoroutineStatus == "" {
+		r.Error = "no goroutine information available"
+		return
+	}
+	r.Entries = countGoroutines(pb.Body.GoroutineStatus)
+	r.Filename, err = sheetSaveFile("goroutines-"+hostname+"-"+r.NodeID, textType, []byte(pb.Body.GoroutineStatus))
+	if err != nil {
+		r.Error = err.Error()
+		return
+	}
+	r.URL = Config.HostURL + sheetRoute + r.Filename
+	return
+
+}
+
+// Response to the total command, with the latest bucket of each host summed across the fleet
+type totalResponse struct {
+	EventsReceived int64               `json:"events_received"`
+	EventsRouted   int64               `json:"events_routed"`
+	Handlers       int64               `json:"handlers"`
+	EventsPending  int64               `json:"events_pending"`
+	DatabaseReads  int64               `json:"database_reads"`
+	DatabaseWrites int64               `json:"database_writes"`
+	Hosts          []totalHostResponse `json:"hosts,omitempty"`
+	Error          string              `json:"error,omitempty"`
+}
+
+// A single host's contribution to the fleet-wide total
+type totalHostResponse struct {
+	Host           string `json:"host,omitempty"`
+	Time           int64  `json:"time,omitempty"`
+	BucketSecs     int64  `json:"bucket_secs,omitempty"`
+	EventsReceived int64  `json:"events_received"`
+	EventsRouted   int64  `json:"events_routed"`
+	Handlers       int64  `json:"handlers"`
+	EventsPending  int64  `json:"events_pending"`
+	DatabaseReads  int64  `json:"database_reads"`
+	DatabaseWrites int64  `json:"database_writes"`
+	Error          string `json:"error,omitempty"`
+}
+
+// Show the latest bucket summed across all hosts, formatted as text
+func watcherTotal() (response string) {
+
+	r := watcherGetTotal()
+	if r.Error != "" {
+		return r.Error
+	}
+
+	response = fmt.Sprintf("fleet: %d events received, %d routed, %d handlers, %d events pending, %d db reads, %d db writes\n",
+		r.EventsReceived, r.EventsRouted, r.Handlers, r.EventsPending, r.DatabaseReads, r.DatabaseWrites)
+	response += "```"
+	for _, h := range r.Hosts {
+		if h.Error != "" {
+			response += fmt.Sprintf("%-12s %s\n", h.Host, h.Error)
+			continue
+		}
+		response += fmt.Sprintf("%-12s %8d rcvd %8d routed %6d handlers %8d pending %9d reads %9d writes (%dm ending %s)\n",
+			h.Host, h.EventsReceived, h.EventsRouted, h.Handlers, h.EventsPending, h.DatabaseReads, h.DatabaseWrites,
+			h.BucketSecs/60, time.Unix(h.Time+h.BucketSecs, 0).UTC().Format("15:04"))
+	}
+	response += "```"
+	return
+
+}
+
+// Sum the latest bucket of each host's aggregated stats across all hosts.  Because hosts may
+// differ in bucket size, each host's contribution notes the bucket that it covers.
+func watcherGetTotal() (r totalResponse) {
+
+	for _, host := range Config.MonitoredHosts {
+		if host.Disabled {
+			continue
+		}
+		h := totalHostResponse{Host: host.Name}
+		hs, exists := statsExtract(host.Name, 0, 0)
+		if !exists || hs.BucketMins == 0 {
+			h.Error = "no stats loaded"
+			r.Hosts = append(r.Hosts, h)
+			continue
+		}
+		h.BucketSecs = hs.BucketMins * 60
+
+		// Find the latest bucket
+		aggregatedStats := statsAggregate(hs.Stats, h.BucketSecs)
+		if len(aggregatedStats) == 0 {
+			h.Error = "no stats buckets"
+			r.Hosts = append(r.Hosts, h)
+			continue
+		}
+		latest := aggregatedStats[0]
+		for _, as := range aggregatedStats {
+			if as.Time > latest.Time {
+				latest = as
+			}
+		}
+		h.Time = latest.Time
+		h.EventsReceived = latest.EventsReceived
+		h.EventsRouted = latest.EventsRouted
+		h.Handlers = latest.HandlersContinuous + latest.HandlersDiscovery + latest.HandlersEphemeral + latest.HandlersNotification
+		h.DatabaseReads = latest.DatabaseReads
+		h.DatabaseWrites = latest.DatabaseWrites
+
+		// The backlog is the pending count of each instance within that bucket
+		for _, sis := range hs.Stats {
+			for _, s := range sis {
+				if statsBucketTime(s.SnapshotTaken, h.BucketSecs) == h.Time {
+					h.EventsPending += s.EventsPending
+				}
+			}
+		}
+
+		r.EventsReceived += h.EventsReceived
+		r.EventsRouted += h.EventsRouted
+		r.Handlers += h.Handlers
+		r.EventsPending += h.EventsPending
+		r.DatabaseReads += h.DatabaseReads
+		r.DatabaseWrites += h.DatabaseWrites
+		r.Hosts = append(r.Hosts, h)
+	}
+	if len(r.Hosts) == 0 {
+		r.Error = "no hosts are being monitored"
+	}
+
+	return
+
+}
+
+// Response to the hosts command, describing the hosts in the running config
+type hostsResponse struct {
+	Suppressed       bool                `json:"suppressed,omitempty"`
+	SuppressedReason string              `json:"suppressed_reason,omitempty"`
+	Hosts            []hostsHostResponse `json:"hosts,omitempty"`
+	Error            string              `json:"error,omitempty"`
+}
+
+// A single configured host, and whether it is being watched
+type hostsHostResponse struct {
+	Host           string `json:"host,omitempty"`
+	Addr           string `json:"address,omitempty"`
+	Disabled       bool   `json:"disabled,omitempty"`
+	ServiceVersion string `json:"service_version,omitempty"`
+}
+
+// List the configured hosts, formatted as text
+func watcherHosts() (response string) {
+
+	r := watcherGetHosts()
+	if r.Error != "" {
+		return r.Error
+	}
+
+	response = fmt.Sprintf("%d hosts configured", len(r.Hosts))
+	if r.Suppressed {
+		response += fmt.Sprintf(" (backlog alerts currently suppressed: %s)", r.SuppressedReason)
+	}
+	response += "\n```"
+	for _, h := range r.Hosts {
+		var state string
+		if h.Disabled {
+			state = "disabled"
+		} else if h.ServiceVersion == "" {
+			state = "enabled, no stats loaded"
+		} else {
+			state = "enabled, " + h.ServiceVersion
+		}
+		response += fmt.Sprintf("%-12s %-40s %s\n", h.Host, h.Addr, state)
+	}
+	response += "```"
+	return
+
+}
+
+// List the hosts in the running config, and whether each is being watched.  Backlog alert
+// suppression windows apply to all hosts rather than to any one of them.
+func watcherGetHosts() (r hostsResponse) {
+
+	r.Suppressed, r.SuppressedReason = alertSuppressed(time.Now())
+
+	statsLock.Lock()
+	for _, host := range Config.MonitoredHosts {
+		h := hostsHostResponse{Host: host.Name, Addr: host.Addr, Disabled: host.Disabled}
+		if !host.Disabled && uStatsLoaded(host.Name) {
+			h.ServiceVersion = statsServiceVersions[host.Name]
+		}
+		r.Hosts = append(r.Hosts, h)
+	}
+	statsLock.Unlock()
+	if len(r.Hosts) == 0 {
+		r.Error = "no hosts are configured"
+	}
+
+	return
+
+}
+
+// Response to the internal command, describing our own footprint
+type internalResponse struct {
+	HostsLoaded   int    `json:"hosts_loaded"`
+	Instances     int    `json:"instances"`
+	Buckets       int    `json:"buckets"`
+	HeapAllocMB   uint64 `json:"heap_alloc_mb"`
+	HeapSysMB     uint64 `json:"heap_sys_mb"`
+	SysMB         uint64 `json:"sys_mb"`
+	NumGC         uint32 `json:"num_gc"`
+	NumGoroutines int    `json:"num_goroutines"`
+}
+
+// Show the size of our in-memory stats and of the process, formatted as text
+func watcherInternal() (response string) {
+	r := watcherGetInternal()
+	response = "```"
+	response += fmt.Sprintf("  hosts loaded: %d\n", r.HostsLoaded)
+	response += fmt.Sprintf("     instances: %d\n", r.Instances)
+	response += fmt.Sprintf("       buckets: %d\n", r.Buckets)
+	response += fmt.Sprintf("     heap used: %d MiB of %d MiB\n", r.HeapAllocMB, r.HeapSysMB)
+	response += fmt.Sprintf("   process sys: %d MiB\n", r.SysMB)
+	response += fmt.Sprintf("   collections: %d\n", r.NumGC)
+	response += fmt.Sprintf("    goroutines: %d\n", r.NumGoroutines)
+	response += "```"
+	return
+}
+
+// Get the size of our in-memory stats and of the process, for sizing our container
+func watcherGetInternal() (r internalResponse) {
+
+	statsLock.Lock()
+	for hostname, hs := range stats {
+		if !uStatsLoaded(hostname) {
+			continue
+		}
+		r.HostsLoaded++
+		r.Instances += len(hs.Stats)
+		for _, sis := range hs.Stats {
+			r.Buckets += len(sis)
+		}
+	}
+	statsLock.Unlock()
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	r.HeapAllocMB = m.HeapAlloc / (1024 * 1024)
+	r.HeapSysMB = m.HeapSys / (1024 * 1024)
+	r.SysMB = m.Sys / (1024 * 1024)
+	r.NumGC = m.NumGC
+	r.NumGoroutines = runtime.NumGoroutine()
+
+	return
+
+}
+
+// Forget what we know of a host's service version and handlers, such as after a manual
+// intervention, so that the next poll re-baselines them rather than announcing the changes
+func watcherResetCache(hostname string) (response string) {
+
+	serviceLock.Lock()
+	cleared := []string{}
+	if version, present := lastServiceVersions[hostname]; present {
+		delete(lastServiceVersions, hostname)
+		cleared = append(cleared, "service version "+version)
+	}
+	if handlers, present := lastServiceHandlers[hostname]; present {
+		delete(lastServiceHandlers, hostname)
+		cleared = append(cleared, fmt.Sprintf("%d handlers", len(handlers)))
+	}
+	if lastServiceNoHandlers[hostname] > 0 {
+		cleared = append(cleared, fmt.Sprintf("%d polls without handlers", lastServiceNoHandlers[hostname]))
+		delete(lastServiceNoHandlers, hostname)
+	}
+	if _, present := serviceInstanceCache[hostname]; present {
+		delete(serviceInstanceCache, hostname)
+		cleared = append(cleared, "cached instances")
+	}
+	serviceLock.Unlock()
+
+	if len(cleared) == 0 {
+		return fmt.Sprintf("nothing cached for %s", hostname)
+	}
+	fmt.Printf("%s: cleared %s\n", hostname, strings.Join(cleared, ", "))
+	return fmt.Sprintf("cleared %s for %s, which will be re-baselined when next polled", strings.Join(cleared, ", "), hostname)
+
+}
+
+// Number of nodes shown by the throughput command if unspecified
+const throughputNodesDefault = 10
+
+// Response to the throughput command, with the busiest nodes across all hosts
+type throughputResponse struct {
+	Nodes []throughputNodeResponse `json:"nodes,omitempty"`
+	Error string                   `json:"error,omitempty"`
+}
+
+// The throughput of a single service instance in its most recent bucket
+type throughputNodeResponse struct {
+	Host         string  `json:"host,omitempty"`
+	NodeID       string  `json:"node_id,omitempty"`
+	Time         int64   `json:"time,omitempty"`
+	EventsRouted int64   `json:"events_routed"`
+	EventsPerMin float64 `json:"events_per_min"`
+}
+
+// Show the busiest nodes across all hosts, formatted as text
+func watcherThroughput(count string) (response string) {
+
+	r := watcherGetThroughput(count)
+	if r.Error != "" {
+		return r.Error
+	}
+	if len(r.Nodes) == 0 {
+		return "no events routed in the most recent buckets"
+	}
+
+	response = fmt.Sprintf("busiest %d nodes by events routed per minute in their most recent bucket\n", len(r.Nodes))
+	response += "```"
+	for i, n := range r.Nodes {
+		response += fmt.Sprintf("%2d %8.1f/min %-12s %s\n", i+1, n.EventsPerMin, n.Host, strings.TrimSuffix(n.NodeID, ":"+DcServiceNameNotehandlerTCP))
+	}
+	response += "```"
+	return
+
+}
+
+// Get the busiest nodes across all hosts by the events they routed in their most recent bucket
+func watcherGetThroughput(count string) (r throughputResponse) {
+
+	n := throughputNodesDefault
+	if count != "" {
+		var err error
+		n, err = strconv.Atoi(count)
+		if err != nil || n <= 0 {
+			r.Error = "/notehub throughput [<number of nodes>]"
+			return
+		}
+	}
+
+	for _, host := range Config.MonitoredHosts {
+		if host.Disabled {
+			continue
+		}
+		hs, exists := statsExtract(host.Name, 0, 0)
+		if !exists || hs.BucketMins == 0 {
+			continue
+		}
+		for siid, sis := range hs.Stats {
+			// Only the instances that are still reporting are of interest
+			if len(sis) == 0 || sis[0].SnapshotTaken != hs.Time || sis[0].EventsRouted == 0 {
+				continue
+			}
+			r.Nodes = append(r.Nodes, throughputNodeResponse{
+				Host:         host.Name,
+				NodeID:       siid,
+				Time:         sis[0].SnapshotTaken,
+				EventsRouted: sis[0].EventsRouted,
+				EventsPerMin: float64(sis[0].EventsRouted) / float64(hs.BucketMins),
+			})
+		}
+	}
+
+	sort.Slice(r.Nodes, func(i, j int) bool {
+		if r.Nodes[i].EventsPerMin != r.Nodes[j].EventsPerMin {
+			return r.Nodes[i].EventsPerMin > r.Nodes[j].EventsPerMin
+		}
+		return r.Nodes[i].Host+r.Nodes[i].NodeID < r.Nodes[j].Host+r.Nodes[j].NodeID
+	})
+	if len(r.Nodes) > n {
+		r.Nodes = r.Nodes[:n]
+	}
+
+	return
 
 }
@@ -0,0 +1,629 @@
+// Copyright 2022 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPendingEventsPerHandlerWarningByHost(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved; lastPendingEventsWarned = nil }()
+	Config.PendingEventsPerHandlerWarning = 100
+	Config.MonitoredHosts = []MonitoredHost{
+		{Name: "busy", PendingEventsPerHandlerWarning: 1000},
+		{Name: "quiet", PendingEventsPerHandlerWarning: 10},
+		{Name: "default"},
+	}
+	Config.SuppressionWindows = nil
+
+	// 500 pending events across 10 handlers
+	stat := StatsStat{
+		EventsEnqueued:              700,
+		EventsDequeued:              200,
+		ContinuousHandlersActivated: 8,
+		DiscoveryHandlersActivated:  2,
+	}
+	tests := []struct {
+		host      string
+		threshold int64
+		exceeded  bool
+	}{
+		{"busy", 1000, false},
+		{"quiet", 10, true},
+		{"default", 100, false},
+		{"unknown", 100, false},
+	}
+	now := time.Date(2022, time.March, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		threshold := pendingEventsPerHandlerWarning(tt.host)
+		if threshold != tt.threshold {
+			t.Errorf("%s: threshold %d, want %d", tt.host, threshold, tt.threshold)
+		}
+		pending, active, exceeded := pendingEventsExceeded(stat, threshold)
+		if exceeded != tt.exceeded {
+			t.Errorf("%s: exceeded %t (%d pending for %d handlers), want %t", tt.host, exceeded, pending, active, tt.exceeded)
+		}
+		pendingMessage := ""
+		if exceeded {
+			pendingMessage = "    siid 500 pending for 10 handlers\n"
+		}
+		warning, _ := uPendingEventsWarning(tt.host, threshold, pendingMessage, now)
+		if (warning != "") != tt.exceeded {
+			t.Errorf("%s: warning %q, want warning %t", tt.host, warning, tt.exceeded)
+		}
+	}
+}
+
+func TestPendingEventsWarningEdgeAndSuppression(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved; lastPendingEventsWarned = nil; lastPendingEventsNoted = nil }()
+	Config.SuppressionWindows = []SuppressionWindow{{Begin: "02:00", End: "04:00"}}
+	lastPendingEventsWarned = nil
+	lastPendingEventsNoted = nil
+
+	during := time.Date(2022, time.March, 1, 3, 0, 0, 0, time.UTC)
+	after := time.Date(2022, time.March, 1, 5, 0, 0, 0, time.UTC)
+	backlog := "    siid 500 pending for 10 handlers\n"
+
+	steps := []struct {
+		name    string
+		now     time.Time
+		pending string
+		warn    bool
+		info    bool
+	}{
+		{"downgraded during window", during, backlog, false, true},
+		{"noted only once during window", during, backlog, false, false},
+		{"warns once window ends", after, backlog, true, false},
+		{"doesn't repeat", after, backlog, false, false},
+		{"clears", after, "", false, false},
+		{"warns again", after, backlog, true, false},
+		{"clears again", after, "", false, false},
+		{"downgraded again during window", during, backlog, false, true},
+	}
+	for _, s := range steps {
+		warning, info := uPendingEventsWarning("host", 10, s.pending, s.now)
+		if (warning != "") != s.warn || (info != "") != s.info {
+			t.Errorf("%s: warning %q info %q, want warning %t info %t", s.name, warning, info, s.warn, s.info)
+		}
+		if info != "" && !strings.Contains(info, "suppressed") {
+			t.Errorf("%s: info %q doesn't give the suppression reason", s.name, info)
+		}
+	}
+}
+
+func TestGetServiceInstanceInfoCancelled(t *testing.T) {
+
+	// An instance that doesn't respond until the test is over
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := getServiceInstanceInfo(ctx, srv.URL, "siid", "", "lb")
+	if err == nil {
+		t.Fatal("expected an error from a cancelled request")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("cancelled request took %s to return", elapsed)
+	}
+	if ctx.Err() != context.Canceled {
+		t.Fatalf("context not cancelled: %v", ctx.Err())
+	}
+
+}
+
+func TestCacheHWMAfterRestart(t *testing.T) {
+
+	// Absolute stats of an instance whose cache restarts, newest first
+	const bucketSecs = 300
+	t0 := int64(1646092800)
+	instance := func(entries []int64, hwms []int64) []StatsStat {
+		sis := []StatsStat{}
+		for i := range entries {
+			sis = append(sis, StatsStat{
+				SnapshotTaken: t0 + int64(len(entries)-1-i)*bucketSecs,
+				Caches:        map[string]StatsCache{"device": {Entries: entries[i], EntriesHWM: hwms[i]}},
+			})
+		}
+		return sis
+	}
+	restarted := ConvertStatsFromAbsoluteToRelative(instance(
+		[]int64{100, 50, 900, 800},
+		[]int64{150, 120, 1000, 1000}), bucketSecs)
+	steady := ConvertStatsFromAbsoluteToRelative(instance(
+		[]int64{200, 200, 200, 200},
+		[]int64{300, 300, 300, 300}), bucketSecs)
+
+	// Each bucket reports its own peak, with the reset noted where it happened
+	wantHWM := []int64{150, 120, 900}
+	wantResets := []int64{0, 1, 0}
+	for i, stat := range restarted {
+		c := stat.Caches["device"]
+		if c.EntriesHWM != wantHWM[i] || c.Resets != wantResets[i] {
+			t.Errorf("bucket %d: hwm %d resets %d, want hwm %d resets %d", i, c.EntriesHWM, c.Resets, wantHWM[i], wantResets[i])
+		}
+	}
+
+	// The aggregated HWM no longer carries the peak from before the restart
+	aggregated := statsAggregate(map[string][]StatsStat{"a": restarted, "b": steady}, bucketSecs)
+	if len(aggregated) != 3 {
+		t.Fatalf("%d aggregated buckets, want 3", len(aggregated))
+	}
+	wantAggregatedHWM := []int64{200, 200, 900}
+	for i, as := range aggregated {
+		c := as.Caches["device"]
+		if c.EntriesHWM != wantAggregatedHWM[i] || c.Resets != wantResets[i] {
+			t.Errorf("aggregated bucket %d: hwm %d resets %d, want hwm %d resets %d", i, c.EntriesHWM, c.Resets, wantAggregatedHWM[i], wantResets[i])
+		}
+	}
+
+}
+
+// Write a self-signed client certificate and its key to the directory
+func watcherTestClientCert(t *testing.T, dir string) (cert *x509.Certificate, certFile string, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "notehub-watch"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, "client.crt")
+	keyFile = filepath.Join(dir, "client.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return
+}
+
+func TestServiceInstancesOverMutualTLS(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved; watcherHTTPClients = nil }()
+	dir := t.TempDir()
+	clientCert, certFile, keyFile := watcherTestClientCert(t, dir)
+
+	// A host that only answers clients presenting our certificate
+	handlers := []AppHandler{{NodeID: "node1", PrimaryService: "handler"}}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pb := PingBody{}
+		pb.Body.ServiceVersion = "v1"
+		pb.Body.AppHandlers = &handlers
+		rspJSON, _ := json.Marshal(pb)
+		w.Write(rspJSON)
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+	caFile := filepath.Join(dir, "ca.crt")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+	hostaddr := srv.Listener.Addr().String()
+
+	tests := []struct {
+		name    string
+		host    MonitoredHost
+		succeed bool
+	}{
+		{"without a client certificate", MonitoredHost{Name: "mtls", Addr: hostaddr, TLSCA: caFile}, false},
+		{"with a client certificate", MonitoredHost{Name: "mtls", Addr: hostaddr, TLSCA: caFile, TLSClientCert: certFile, TLSClientKey: keyFile}, true},
+	}
+	for _, tt := range tests {
+		Config.MonitoredHosts = []MonitoredHost{tt.host}
+		watcherHTTPClients = nil
+
+		_, siids, addrs, _, err := getServiceInstances(context.Background(), hostaddr)
+		if (err == nil) != tt.succeed {
+			t.Errorf("%s: getServiceInstances error %v, want success %t", tt.name, err, tt.succeed)
+			continue
+		}
+		if !tt.succeed {
+			continue
+		}
+		if len(addrs) != 1 || !strings.HasPrefix(addrs[0], "https://") {
+			t.Errorf("%s: instance addresses %v, want https", tt.name, addrs)
+			continue
+		}
+		_, err = getServiceInstanceInfo(context.Background(), addrs[0], siids[0], "", "lb")
+		if err != nil {
+			t.Errorf("%s: getServiceInstanceInfo: %s", tt.name, err)
+		}
+	}
+}
+
+// Measure the connections made to a TLS host by repeated requests, either with the shared client
+// or with a new client for each request as was done before clients were shared
+func benchmarkInstanceInfo(b *testing.B, shared bool) {
+	saved := Config
+	defer func() { Config = saved; watcherHTTPClients = nil }()
+
+	var conns int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"body":{"service_version":"v1"}}`))
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	caFile := filepath.Join(b.TempDir(), "ca.crt")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+	hostaddr := srv.Listener.Addr().String()
+	Config.MonitoredHosts = []MonitoredHost{{Name: "bench", Addr: hostaddr, TLSCA: caFile}}
+	watcherHTTPClients = nil
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !shared {
+			watcherHTTPClientsLock.Lock()
+			watcherHTTPClients = nil
+			watcherHTTPClientsLock.Unlock()
+		}
+		_, err := getServiceInstanceInfo(context.Background(), watcherInstanceAddr(hostaddr), "siid", "", "lb")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadInt64(&conns))/float64(b.N), "conns/op")
+}
+
+func BenchmarkInstanceInfoSharedClient(b *testing.B) {
+	benchmarkInstanceInfo(b, true)
+}
+
+func BenchmarkInstanceInfoNewClient(b *testing.B) {
+	benchmarkInstanceInfo(b, false)
+}
+
+func TestCountGoroutines(t *testing.T) {
+	dump := "goroutine 1 [running]:\n" +
+		"main.main()\n" +
+		"\t/src/main.go:10 +0x1d\n" +
+		"\n" +
+		"goroutine 18 [chan receive, 5 minutes]:\n" +
+		"main.worker()\n" +
+		"\t/src/worker.go:20 +0x2a\n" +
+		"created by main.main in goroutine 1\n" +
+		"\t/src/main.go:8 +0x3b\n" +
+		"\n" +
+		"goroutine 19 [select]:\n" +
+		"main.goroutine (...)\n"
+	tests := []struct {
+		name   string
+		status string
+		want   int
+	}{
+		{"empty", "", 0},
+		{"single", "goroutine 1 [running]:\nmain.main()\n", 1},
+		{"ignores mentions within stacks", dump, 3},
+	}
+	for _, tt := range tests {
+		if got := countGoroutines(tt.status); got != tt.want {
+			t.Errorf("%s: %d goroutines, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHandlersLostNodes(t *testing.T) {
+	handler := func(nodeID string, service string) (string, AppHandler) {
+		return nodeID + ":" + service, AppHandler{NodeID: nodeID + ":" + service, PrimaryService: service}
+	}
+	handlers := func(instances ...[2]string) map[string]AppHandler {
+		m := map[string]AppHandler{}
+		for _, i := range instances {
+			siid, h := handler(i[0], i[1])
+			m[siid] = h
+		}
+		return m
+	}
+	tests := []struct {
+		name      string
+		removed   map[string]AppHandler
+		remaining map[string]AppHandler
+		want      []string
+	}{
+		{"one instance per node", handlers([2]string{"b", "handler"}, [2]string{"a", "handler"}), handlers([2]string{"c", "handler"}), []string{"a", "b"}},
+		{"all of a node's services", handlers([2]string{"a", "handler"}, [2]string{"a", "discovery"}), handlers([2]string{"c", "handler"}), []string{"a"}},
+		{"node still has a service", handlers([2]string{"a", "handler"}), handlers([2]string{"a", "discovery"}), nil},
+	}
+	for _, tt := range tests {
+		got := handlersLostNodes(tt.removed, tt.remaining)
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: lost %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestConvertStatsClampsCounterResets(t *testing.T) {
+
+	// Absolute counters of an instance that restarted between the two older buckets, newest first
+	const bucketSecs = 300
+	t0 := int64(1646092800)
+	absolute := []StatsStat{
+		{SnapshotTaken: t0 + 3*bucketSecs, OSDiskRead: 150, OSDiskWrite: 70, EventsEnqueued: 30, EventsRouted: 25,
+			Databases: map[string]StatsDatabase{"app": {Reads: 12, Writes: 6}}},
+		{SnapshotTaken: t0 + 2*bucketSecs, OSDiskRead: 100, OSDiskWrite: 50, EventsEnqueued: 20, EventsRouted: 15,
+			Databases: map[string]StatsDatabase{"app": {Reads: 10, Writes: 5}}},
+		{SnapshotTaken: t0 + bucketSecs, OSDiskRead: 9000, OSDiskWrite: 8000, EventsEnqueued: 700, EventsRouted: 650,
+			Databases: map[string]StatsDatabase{"app": {Reads: 400, Writes: 300}}},
+		{SnapshotTaken: t0, OSDiskRead: 8000, OSDiskWrite: 7000, EventsEnqueued: 600, EventsRouted: 550,
+			Databases: map[string]StatsDatabase{"app": {Reads: 300, Writes: 200}}},
+	}
+	relative := ConvertStatsFromAbsoluteToRelative(absolute, bucketSecs)
+
+	tests := []struct {
+		name  string
+		value func(s StatsStat) int64
+		want  []int64
+	}{
+		{"disk reads", func(s StatsStat) int64 { return int64(s.OSDiskRead) }, []int64{50, 0, 1000}},
+		{"disk writes", func(s StatsStat) int64 { return int64(s.OSDiskWrite) }, []int64{20, 0, 1000}},
+		{"events received", func(s StatsStat) int64 { return s.EventsEnqueued }, []int64{10, 0, 100}},
+		{"events routed", func(s StatsStat) int64 { return s.EventsRouted }, []int64{10, 0, 100}},
+		{"database reads", func(s StatsStat) int64 { return s.Databases["app"].Reads }, []int64{2, 0, 100}},
+		{"database writes", func(s StatsStat) int64 { return s.Databases["app"].Writes }, []int64{1, 0, 100}},
+	}
+	if len(relative) != 3 {
+		t.Fatalf("%d relative buckets, want 3", len(relative))
+	}
+	for _, tt := range tests {
+		for i, want := range tt.want {
+			if got := tt.value(relative[i]); got != want {
+				t.Errorf("%s: bucket %d is %d, want %d", tt.name, i, got, want)
+			}
+		}
+	}
+
+}
+
+func TestPingParamsForHost(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved; watcherHTTPClients = nil }()
+
+	// A host that records the query of each ping
+	var query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		w.Write([]byte(`{"body":{"service_version":"v1"}}`))
+	}))
+	defer srv.Close()
+	hostaddr := strings.TrimPrefix(srv.URL, "http://")
+
+	tests := []struct {
+		name   string
+		params map[string]string
+		want   string
+	}{
+		{"none", nil, `node="siid"&show="lb"`},
+		{"sorted", map[string]string{"verbose": "1", "flag": "on"}, `node="siid"&show="lb"&flag=on&verbose=1`},
+		{"escaped", map[string]string{"a b": "x&y=z", "q": "50%"}, `node="siid"&show="lb"&a+b=x%26y%3Dz&q=50%25`},
+	}
+	for _, tt := range tests {
+		Config.MonitoredHosts = []MonitoredHost{{Name: "host", Addr: hostaddr, PingParams: tt.params}, {Name: "other", Addr: "other", PingParams: map[string]string{"x": "y"}}}
+		_, err := getServiceInstanceInfo(context.Background(), srv.URL, "siid", "", "lb")
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if query != tt.want {
+			t.Errorf("%s: query %s, want %s", tt.name, query, tt.want)
+		}
+	}
+}
+
+func TestGetServiceInstanceInfoGzip(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved; watcherHTTPClients = nil }()
+	Config.MonitoredHosts = nil
+	const response = `{"body":{"service_version":"v1","status_goroutine":"goroutine 1 [running]:"}}`
+
+	tests := []struct {
+		name string
+		gzip bool
+	}{
+		{"compressed", true},
+		{"identity", false},
+	}
+	for _, tt := range tests {
+		compress := tt.gzip
+		var acceptEncoding string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			acceptEncoding = r.Header.Get("Accept-Encoding")
+			if !compress {
+				w.Write([]byte(response))
+				return
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			gz.Write([]byte(response))
+			gz.Close()
+		}))
+		pb, err := getServiceInstanceInfo(context.Background(), srv.URL, "siid", "", "goroutines")
+		srv.Close()
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if acceptEncoding != "gzip" {
+			t.Errorf("%s: Accept-Encoding %q, want gzip", tt.name, acceptEncoding)
+		}
+		if pb.Body.ServiceVersion != "v1" || pb.Body.GoroutineStatus != "goroutine 1 [running]:" {
+			t.Errorf("%s: decoded %+v", tt.name, pb.Body)
+		}
+	}
+}
+
+func TestActivityTableAlignment(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved }()
+	Config.ActivityNodeIDRemovals = nil
+	Config.ActivityColumnMaxWidth = 0
+
+	nodes := []activityNodeResponse{
+		{NodeID: "n1:" + DcServiceNameNotehandlerTCP, NodeName: "a", NodeTags: "tcp", Sessions: 5, Events: 12},
+		{NodeID: "node-with-a-much-longer-id:" + DcServiceNameNotehandlerTCP, NodeName: "handler-name-that-is-long", NodeTags: "t", Sessions: 12345},
+		{NodeID: "n3", NodeName: "mid-name", NodeTags: "tags-longer", Events: 7},
+	}
+	lines := strings.Split(strings.TrimSuffix(activityTable(nodes), "\n"), "\n")
+	if len(lines) != len(nodes) {
+		t.Fatalf("%d lines, want %d", len(lines), len(nodes))
+	}
+
+	// Each column begins at the same offset on every line, regardless of the lengths of the names
+	columnAt := func(column func(n activityNodeResponse) string) {
+		offset := -1
+		for i, line := range lines {
+			at := strings.Index(line, " "+column(nodes[i])) + 1
+			if at == 0 {
+				t.Fatalf("line %q is missing %q", line, column(nodes[i]))
+			}
+			if offset == -1 {
+				offset = at
+			} else if at != offset {
+				t.Errorf("line %q has %q at %d, want %d", line, column(nodes[i]), at, offset)
+			}
+		}
+	}
+	columnAt(func(n activityNodeResponse) string { return n.NodeName })
+	columnAt(func(n activityNodeResponse) string { return n.NodeTags })
+
+	// Counts are right-aligned, so their units line up
+	if a, b := strings.Index(lines[0], " sessions"), strings.Index(lines[1], " sessions"); a != b {
+		t.Errorf("sessions at %d and %d", a, b)
+	}
+	if a, b := strings.Index(lines[0], " events"), strings.Index(lines[2], " events"); a != b {
+		t.Errorf("events at %d and %d", a, b)
+	}
+
+	// The service suffix is trimmed from node IDs
+	if strings.Contains(lines[0], DcServiceNameNotehandlerTCP) {
+		t.Errorf("node ID suffix wasn't trimmed: %q", lines[0])
+	}
+
+	// Columns are truncated to the configured maximum width
+	Config.ActivityColumnMaxWidth = 8
+	for _, line := range strings.Split(activityTable(nodes), "\n") {
+		if strings.Contains(line, "handler-name-that-is-long") || strings.Contains(line, "node-with-a-much-longer-id") {
+			t.Errorf("column wasn't truncated: %q", line)
+		}
+	}
+}
+
+func TestServiceInstancesWithCollidingHandlers(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved; watcherHTTPClients = nil }()
+
+	// On Local Dev a single node hosts several services, but two handlers reporting the same
+	// node and the same primary service can't be told apart
+	handlers := []AppHandler{
+		{NodeID: "n1", PrimaryService: "handler", NodeName: "first"},
+		{NodeID: "n1", PrimaryService: "handler", NodeName: "second"},
+		{NodeID: "n1", PrimaryService: "other", NodeName: "other"},
+		{NodeID: "n2", PrimaryService: "handler", NodeName: "n2"},
+	}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pb := PingBody{}
+		pb.Body.ServiceVersion = "v1"
+		pb.Body.AppHandlers = &handlers
+		rspJSON, _ := json.Marshal(pb)
+		w.Write(rspJSON)
+	}))
+	defer srv.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+	hostaddr := srv.Listener.Addr().String()
+	Config.MonitoredHosts = []MonitoredHost{{Name: "dev", Addr: hostaddr, TLSCA: caFile}}
+	watcherHTTPClients = nil
+
+	_, siids, addrs, got, err := getServiceInstances(context.Background(), hostaddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"n1:handler", "n1:other", "n2:handler"}
+	if !reflect.DeepEqual(siids, want) {
+		t.Errorf("service instances %v, want %v", siids, want)
+	}
+	if len(addrs) != len(siids) || len(got) != len(siids) {
+		t.Errorf("%d addresses and %d handlers for %d instances", len(addrs), len(got), len(siids))
+	}
+	if got["n1:handler"].NodeName != "first" {
+		t.Errorf("kept %q of the colliding handlers, want the first", got["n1:handler"].NodeName)
+	}
+}
+
+func TestNodeStartedTime(t *testing.T) {
+	started := time.Date(2022, time.March, 1, 12, 30, 45, 0, time.UTC).Unix()
+	const legacy = 1640995200
+	tests := []struct {
+		name        string
+		nodeStarted string
+		legacy      int64
+		want        int64
+	}{
+		{"utc", "2022-03-01T12:30:45Z", 0, started},
+		{"rfc3339 with offset", "2022-03-01T07:30:45-05:00", 0, started},
+		{"rfc3339 with nanos", "2022-03-01T12:30:45.123456789Z", 0, started},
+		{"numeric offset", "2022-03-01T14:30:45+0200", 0, started},
+		{"numeric offset with fraction", "2022-03-01T14:30:45.5+0200", 0, started},
+		{"preferred over legacy", "2022-03-01T12:30:45Z", legacy, started},
+		{"unparseable falls back to legacy", "March 1st", legacy, legacy},
+		{"absent falls back to legacy", "", legacy, legacy},
+		{"unknown", "March 1st", 0, 0},
+	}
+	for _, tt := range tests {
+		got := nodeStartedTime("siid", tt.nodeStarted, tt.legacy)
+		if got != tt.want {
+			t.Errorf("%s: started %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}